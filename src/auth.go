@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles that can be given to API keys and users
+const (
+	RoleRead  = "read"  // Can read the power, history and configuration
+	RoleAdmin = "admin" // Can also top-up, set meter readings, change the configuration and read the logs
+)
+
+// keyHashPrefix is the prefix of an API key stored as a SHA-256 hash
+const keyHashPrefix = "sha256:"
+
+// APIKey is a key that gives a client access to the API
+type APIKey struct {
+	Name string `json:"name"` // Name of the client the key was issued to
+	Key  string `json:"key"`  // Key, or its hash in the form sha256:<hex>
+	Role string `json:"role"` // Role granted by the key
+}
+
+// APIUser is a user that can access the API using HTTP basic authentication
+type APIUser struct {
+	Username string `json:"username"` // User name
+	Password string `json:"password"` // Password, or its bcrypt hash
+	Role     string `json:"role"`     // Role granted to the user
+}
+
+// roleContextKey is the request context key of the role granted to the request
+type roleContextKey struct{}
+
+// Authorize creates a handler wrapper that only calls the handler if the request has
+// an API key or basic auth credentials with the required role. The credentials are
+// checked against the active configuration, so changes to the keys and users apply
+// to the next request. Requests that change the service must be JSON and not come from
+// another site, as browsers send cached basic auth credentials with cross-site form posts.
+// It is wrapped by the Logger, so that rejected requests are also logged:
+//
+//	Logger(c, Authorize(s, RoleAdmin, http.HandlerFunc(c.handleTopUp)))
+func Authorize(s *Server, role string, inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		granted, ok := s.GetConfig().Authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="PowerMonitor", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !roleAllows(granted, role) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if code, msg := checkCrossSite(r); code != 0 {
+			http.Error(w, msg, code)
+			return
+		}
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleContextKey{}, granted)))
+	})
+}
+
+// checkCrossSite checks that a request that changes the service cannot have been sent by a
+// page on another site and returns the status code and message to reject it with, if it can.
+// Cross-site form posts are not preflighted, but cannot send a JSON content type.
+func checkCrossSite(r *http.Request) (int, string) {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return 0, ""
+	}
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return http.StatusForbidden, "Cross-site requests are not allowed"
+	}
+	if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || t != "application/json" {
+		return http.StatusUnsupportedMediaType, "Content-Type must be application/json"
+	}
+	return 0, ""
+}
+
+// RequestRole returns the role granted to the request by Authorize
+func RequestRole(r *http.Request) string {
+	if role, ok := r.Context().Value(roleContextKey{}).(string); ok {
+		return role
+	}
+	return ""
+}
+
+// roleAllows checks if the granted role includes the required role
+func roleAllows(granted string, required string) bool {
+	return granted == RoleAdmin || granted == required
+}
+
+// AuthEnabled returns true if API keys or users are configured. If not, access is not restricted.
+func (c *Config) AuthEnabled() bool {
+	return len(c.APIKeys) != 0 || len(c.Users) != 0
+}
+
+// Authenticate checks the API key or basic auth credentials of the request and returns the
+// role granted. The API key can be sent in the X-API-Key header, as a bearer token or, for
+// browser EventSource and WebSocket clients that cannot set headers, the apikey query parameter.
+func (c *Config) Authenticate(r *http.Request) (string, bool) {
+	if !c.AuthEnabled() {
+		return RoleAdmin, true
+	}
+
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
+			key = strings.TrimPrefix(a, "Bearer ")
+		}
+	}
+	if key == "" {
+		key = r.URL.Query().Get("apikey")
+	}
+	if key != "" {
+		for _, k := range c.APIKeys {
+			if k.matches(key) {
+				return k.Role, true
+			}
+		}
+		return "", false
+	}
+
+	if username, password, ok := r.BasicAuth(); ok {
+		for _, u := range c.Users {
+			if u.Username == username && u.matches(password) {
+				return u.Role, true
+			}
+		}
+	}
+	return "", false
+}
+
+// matches checks if the key is this API key
+func (k *APIKey) matches(key string) bool {
+	if strings.HasPrefix(k.Key, keyHashPrefix) {
+		return subtle.ConstantTimeCompare([]byte(k.Key), []byte(hashAPIKey(key))) == 1
+	}
+	return k.Key != "" && subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1
+}
+
+// matches checks if the password is the password of this user
+func (u *APIUser) matches(password string) bool {
+	if isPasswordHash(u.Password) {
+		return passwordCache.check(u.Username, u.Password, password)
+	}
+	return u.Password != "" && subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1
+}
+
+// NewAPIKey generates a random API key and returns the key and the hash to store in the configuration
+func NewAPIKey() (string, string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key := hex.EncodeToString(b)
+	return key, hashAPIKey(key), nil
+}
+
+// hashAPIKey returns the hash of the API key in the form sha256:<hex>
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return keyHashPrefix + hex.EncodeToString(h[:])
+}
+
+// isAPIKeyHash checks if the value is a valid API key hash
+func isAPIKeyHash(v string) bool {
+	h := strings.TrimPrefix(v, keyHashPrefix)
+	if _, err := hex.DecodeString(h); err != nil {
+		return false
+	}
+	return len(h) == 2*sha256.Size
+}
+
+// HashPassword returns the bcrypt hash of the password to store in the configuration
+func HashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(b), err
+}
+
+// isPasswordHash checks if the value is a bcrypt hash
+func isPasswordHash(v string) bool {
+	return strings.HasPrefix(v, "$2a$") || strings.HasPrefix(v, "$2b$") || strings.HasPrefix(v, "$2y$")
+}
+
+// passwordCache remembers the passwords that matched their bcrypt hash for a while, as
+// checking a bcrypt hash on every request would be very slow on a Raspberry Pi
+var passwordCache = &authCache{}
+
+// authCache holds the hashes of recently verified credentials, with the time they expire
+type authCache struct {
+	entries map[[sha256.Size]byte]time.Time
+	mu      sync.Mutex
+}
+
+// check checks the password against the bcrypt hash, using the cache if possible
+func (a *authCache) check(username string, hash string, password string) bool {
+	k := sha256.Sum256([]byte(username + "\x00" + hash + "\x00" + password))
+	now := time.Now()
+
+	a.mu.Lock()
+	exp, ok := a.entries[k]
+	a.mu.Unlock()
+	if ok && now.Before(exp) {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.entries == nil || len(a.entries) >= 100 {
+		a.entries = map[[sha256.Size]byte]time.Time{}
+	}
+	a.entries[k] = now.Add(10 * time.Minute)
+	return true
+}
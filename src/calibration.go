@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Calibration states
+const (
+	CalibrationIdle     = "idle"     // No calibration has been started
+	CalibrationRunning  = "running"  // Counting pulses until the second reading is entered
+	CalibrationFinished = "finished" // Both readings have been entered
+)
+
+const (
+	calibrationMinUnits = 1.0  // Minimum units (kWh) used between the readings
+	keypadResolution    = 0.1  // Resolution (kWh) of the readings shown on the meter keypad
+	meterRateTolerance  = 0.02 // Difference from a standard meter rate, beyond the reading uncertainty, treated as missed or extra pulses
+)
+
+// meterRates are the impulses per kWh that meters are commonly made with
+var meterRates = []int64{100, 200, 250, 400, 500, 600, 800, 1000, 1200, 1600, 2000, 2400, 3200, 4000, 5000, 6400, 8000, 10000}
+
+// Calibration measures the flash rate of the meter from two keypad readings taken
+// some hours apart, and collects the light levels seen by the sensor to tune its threshold.
+// The calibration is kept in memory, so restarting the service cancels it.
+type Calibration struct {
+	Srv    *Server            // Server instance
+	state  string             // Calibration state
+	start  CalibrationReading // First reading
+	end    CalibrationReading // Second reading
+	levels lightLevels        // Light levels seen since the calibration started
+	mu     sync.Mutex
+}
+
+// CalibrationReading holds a keypad reading and the pulses counted when it was entered
+type CalibrationReading struct {
+	Time     time.Time `json:"time"`     // Time the reading was entered
+	Reading  float64   `json:"reading"`  // Units (kWh) shown on the meter keypad
+	Accepted int64     `json:"accepted"` // Pulses accepted by the filter since the service started
+	Rejected int64     `json:"rejected"` // Pulses rejected by the filter since the service started
+}
+
+// CalibrationReport holds the progress and results of the calibration
+type CalibrationReport struct {
+	State              string              `json:"state"`                        // Calibration state
+	Start              *CalibrationReading `json:"start,omitempty"`              // First reading
+	End                *CalibrationReading `json:"end,omitempty"`                // Second reading
+	Pulses             int64               `json:"pulses"`                       // Pulses accepted since the first reading
+	Rejected           int64               `json:"rejected"`                     // Pulses rejected since the first reading
+	TopUps             float64             `json:"topUps"`                       // Units (kWh) topped up between the readings
+	Used               float64             `json:"used"`                         // Units (kWh) used between the readings
+	MeasuredRate       float64             `json:"measuredRate"`                 // Measured impulses per kWh
+	Uncertainty        float64             `json:"uncertainty"`                  // Uncertainty of the measured rate (in %) due to the keypad resolution
+	FlashRate          int64               `json:"flashRate"`                    // Configured flash rate
+	SuggestedFlashRate int64               `json:"suggestedFlashRate,omitempty"` // Flash rate the measurement suggests
+	Accuracy           float64             `json:"accuracy"`                     // Pulses detected as a percentage of the pulses expected at the suggested flash rate
+	Light              LightReport         `json:"light"`                        // Light levels seen by the sensor
+}
+
+// LightReport holds the light levels seen by the sensor, between 0 and 1
+type LightReport struct {
+	Threshold          float64   `json:"threshold"`                    // Configured threshold
+	Dark               float64   `json:"dark"`                         // Average of the lowest levels seen
+	Lit                float64   `json:"lit"`                          // Average of the highest levels seen while the meter was flashing
+	SuggestedThreshold float64   `json:"suggestedThreshold,omitempty"` // Threshold halfway between the dark and lit levels
+	Reports            int       `json:"reports"`                      // Number of level reports the averages are based on
+	Since              time.Time `json:"since"`                        // Time the levels have been collected since
+}
+
+// CalibrationValues holds the configuration values set from the calibration
+type CalibrationValues struct {
+	FlashRate       int64   `json:"flashRate"`       // Flash rate. The suggested flash rate is used if not set.
+	SensorThreshold float64 `json:"sensorThreshold"` // Sensor threshold. The suggested threshold, if any, is used if not set.
+}
+
+// lightLevels accumulates the light levels reported by the pulse detector
+type lightLevels struct {
+	dark    float64   // Sum of the lowest levels
+	lit     float64   // Sum of the highest levels of the reports with pulses
+	reports int       // Number of reports
+	flashes int       // Number of reports with pulses
+	since   time.Time // Time the levels have been collected since
+}
+
+// Start starts the calibration with the units shown on the meter keypad.
+// Starting again discards the previous calibration.
+func (c *Calibration) Start(reading float64) error {
+	if reading < 0 {
+		return errors.New("reading cannot be negative")
+	}
+	r := c.reading(reading)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = CalibrationRunning
+	c.start = r
+	c.end = CalibrationReading{}
+	c.levels = lightLevels{since: r.Time}
+	c.logInfo("Calibration started at a reading of ", reading, " units")
+	return nil
+}
+
+// Finish completes the calibration with the units shown on the meter keypad.
+// Enough units must have been used since the first reading to measure the flash rate.
+func (c *Calibration) Finish(reading float64) (CalibrationReport, error) {
+	if reading < 0 {
+		return CalibrationReport{}, errors.New("reading cannot be negative")
+	}
+	r := c.reading(reading)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != CalibrationRunning {
+		return CalibrationReport{}, errors.New("calibration has not been started")
+	}
+
+	used := c.start.Reading + c.topUps(c.start.Time, r.Time) - reading
+	if used < calibrationMinUnits {
+		return CalibrationReport{}, fmt.Errorf("only %.1f units have been used since the first reading, at least %.0f is needed", used, calibrationMinUnits)
+	}
+	if r.Accepted == c.start.Accepted {
+		return CalibrationReport{}, errors.New("no pulses have been detected since the first reading")
+	}
+	c.end = r
+	c.state = CalibrationFinished
+	rep := c.report()
+	c.logInfo("Calibration finished. Measured ", rep.MeasuredRate, " impulses per kWh, suggesting a flash rate of ", rep.SuggestedFlashRate)
+	return rep, nil
+}
+
+// Cancel discards the calibration
+func (c *Calibration) Cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = CalibrationIdle
+	c.start = CalibrationReading{}
+	c.end = CalibrationReading{}
+}
+
+// GetReport returns the progress and results of the calibration
+func (c *Calibration) GetReport() CalibrationReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.report()
+}
+
+// Apply saves the flash rate and sensor threshold to the configuration file and applies them.
+// The values not set are taken from the results of the finished calibration.
+func (c *Calibration) Apply(v CalibrationValues) (*Config, error) {
+	rep := c.GetReport()
+	if v.FlashRate == 0 || v.SensorThreshold == 0 {
+		if rep.State != CalibrationFinished {
+			return nil, errors.New("calibration has not finished")
+		}
+		if v.FlashRate == 0 {
+			v.FlashRate = rep.SuggestedFlashRate
+		}
+		if v.SensorThreshold == 0 {
+			v.SensorThreshold = rep.Light.SuggestedThreshold
+		}
+	}
+
+	nc, err := c.Srv.UpdateConfigFile(func(fc *Config) error {
+		fc.FlashRate = v.FlashRate
+		if v.SensorThreshold > 0 {
+			fc.SensorThreshold = v.SensorThreshold
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.logInfo("Flash rate set to ", nc.FlashRate, " and sensor threshold set to ", nc.SensorThreshold)
+	return nc, nil
+}
+
+// restamp moves the times of the readings onto the clock corrected by the step
+func (c *Calibration) restamp(now time.Time, step time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.start.Time = shiftWall(c.start.Time, now, step)
+	c.end.Time = shiftWall(c.end.Time, now, step)
+	c.levels.since = shiftWall(c.levels.since, now, step)
+}
+
+// addLevels records the lowest and highest light levels seen over a period, and the pulses in it
+func (c *Calibration) addLevels(low float64, high float64, pulses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.levels.since.IsZero() {
+		c.levels.since = c.Srv.Now()
+	}
+	c.levels.dark += low
+	c.levels.reports++
+	if pulses > 0 {
+		c.levels.lit += high
+		c.levels.flashes++
+	}
+}
+
+// reading returns the keypad reading with the pulses counted so far
+func (c *Calibration) reading(units float64) CalibrationReading {
+	f := c.Srv.Power.GetFilterReport()
+	return CalibrationReading{
+		Time:     c.Srv.Now(),
+		Reading:  units,
+		Accepted: f.Accepted,
+		Rejected: f.Bounced + f.Burst,
+	}
+}
+
+// topUps returns the units topped up between the specified times
+func (c *Calibration) topUps(from time.Time, to time.Time) float64 {
+	u := 0.0
+	for _, t := range c.Srv.History.GetTopUps() {
+		if !t.Time.Before(from) && !t.Time.After(to) {
+			u += t.Units
+		}
+	}
+	return u
+}
+
+// report returns the progress and results of the calibration
+func (c *Calibration) report() CalibrationReport {
+	rep := CalibrationReport{
+		State:     c.state,
+		FlashRate: c.Srv.GetConfig().FlashRate,
+		Light:     c.lightReport(),
+	}
+	if rep.State == "" {
+		rep.State = CalibrationIdle
+	}
+	if rep.State == CalibrationIdle {
+		return rep
+	}
+
+	start := c.start
+	rep.Start = &start
+	end := c.end
+	if rep.State == CalibrationRunning {
+		end = c.reading(0)
+	} else {
+		rep.End = &end
+	}
+	rep.Pulses = end.Accepted - start.Accepted
+	rep.Rejected = end.Rejected - start.Rejected
+	if rep.State != CalibrationFinished {
+		return rep
+	}
+
+	rep.TopUps = c.topUps(start.Time, end.Time)
+	rep.Used = round(start.Reading+rep.TopUps-end.Reading, 3)
+	measured := float64(rep.Pulses) / rep.Used
+	rep.MeasuredRate = round(measured, 1)
+	uncertainty := keypadResolution / rep.Used
+	rep.Uncertainty = round(uncertainty*100, 1)
+
+	// Use the nearest standard rate if the difference can be explained by the readings or the sensor
+	rep.SuggestedFlashRate = int64(math.Round(measured))
+	nearest := uncertainty + meterRateTolerance
+	for _, r := range meterRates {
+		if d := math.Abs(measured-float64(r)) / float64(r); d <= nearest {
+			rep.SuggestedFlashRate = r
+			nearest = d
+		}
+	}
+	if rep.SuggestedFlashRate < 1 {
+		rep.SuggestedFlashRate = 1
+	}
+	rep.Accuracy = round(float64(rep.Pulses)/(rep.Used*float64(rep.SuggestedFlashRate))*100, 1)
+	return rep
+}
+
+// lightReport returns the light levels seen since the calibration started
+func (c *Calibration) lightReport() LightReport {
+	l := c.levels
+	r := LightReport{
+		Threshold: c.Srv.GetConfig().SensorThreshold,
+		Reports:   l.reports,
+		Since:     l.since,
+	}
+	if l.reports > 0 {
+		r.Dark = round(l.dark/float64(l.reports), 3)
+	}
+	if l.flashes > 0 {
+		r.Lit = round(l.lit/float64(l.flashes), 3)
+	}
+	if l.flashes > 0 && r.Lit > r.Dark {
+		r.SuggestedThreshold = math.Max(0.01, math.Min(0.99, round((r.Dark+r.Lit)/2, 2)))
+	}
+	return r
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (r *CalibrationReport) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// logInfo logs an information message to the logger
+func (c *Calibration) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("Calibration", a)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestCalibration checks the flash rate measured from two readings, allowing for a top-up between them
+func TestCalibration(t *testing.T) {
+	s, clock := newTestServer(t)
+	if err := s.Calibration.Start(500); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1230 pulses over 1.5 units is close enough to a standard meter of 800 impulses per kWh
+	for _, pt := range pulsesEvery(testStart, 3*time.Second, 1230) {
+		clock.Set(pt)
+		s.Power.recordPulse(pt)
+	}
+	s.Power.TopUp(10)
+	s.Calibration.addLevels(0.05, 0.6, 3)
+	s.Calibration.addLevels(0.07, 0.1, 0)
+
+	if _, err := s.Calibration.Finish(509.8); err == nil {
+		t.Error("calibration finished with less than a unit used")
+	}
+	rep, err := s.Calibration.Finish(508.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.State != CalibrationFinished || rep.Pulses != 1230 || rep.TopUps != 10 || rep.Used != 1.5 {
+		t.Errorf("report is %+v", rep)
+	}
+	if rep.MeasuredRate != 820 || rep.SuggestedFlashRate != 800 || rep.Accuracy != 102.5 {
+		t.Errorf("measured %v, suggested %v with accuracy %v", rep.MeasuredRate, rep.SuggestedFlashRate, rep.Accuracy)
+	}
+	if l := rep.Light; l.Dark != 0.06 || l.Lit != 0.6 || l.SuggestedThreshold != 0.33 || l.Reports != 2 {
+		t.Errorf("light report is %+v", l)
+	}
+}
+
+// TestCalibrationNearestRate checks that the nearest standard rate is suggested when more than one is within the uncertainty
+func TestCalibrationNearestRate(t *testing.T) {
+	s, clock := newTestServer(t)
+	if err := s.Calibration.Start(500); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1100 pulses over a unit is within the uncertainty of 1000 and 1200, and nearest to 1200
+	for _, pt := range pulsesEvery(testStart, 3*time.Second, 1100) {
+		clock.Set(pt)
+		s.Power.recordPulse(pt)
+	}
+	rep, err := s.Calibration.Finish(499)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.MeasuredRate != 1100 || rep.SuggestedFlashRate != 1200 {
+		t.Errorf("measured %v, suggested %v", rep.MeasuredRate, rep.SuggestedFlashRate)
+	}
+}
+
+// TestCalibrationController checks the calibration workflow through the API
+func TestCalibrationController(t *testing.T) {
+	s, clock := newTestServer(t)
+	ts := newTestHTTP(t, s)
+
+	if code, _ := doRequest(t, "POST", ts.URL+"/calibrate/finish", `{"reading":10}`); code != 409 {
+		t.Errorf("finishing without starting returned %d", code)
+	}
+	if code, _ := doRequest(t, "POST", ts.URL+"/calibrate/start", `{}`); code != 400 {
+		t.Errorf("starting without a reading returned %d", code)
+	}
+	if code, body := doRequest(t, "POST", ts.URL+"/calibrate/start", `{"reading":100}`); code != 200 {
+		t.Fatalf("start returned %d %s", code, body)
+	}
+
+	// 2000 pulses over 2 units is exactly the default flash rate
+	for _, pt := range pulsesEvery(testStart, 2*time.Second, 2000) {
+		clock.Set(pt)
+		s.Power.recordPulse(pt)
+	}
+	code, body := doRequest(t, "GET", ts.URL+"/calibrate", "")
+	rep := CalibrationReport{}
+	if err := json.Unmarshal([]byte(body), &rep); code != 200 || err != nil {
+		t.Fatalf("status returned %d %s", code, body)
+	}
+	if rep.State != CalibrationRunning || rep.Pulses != 2000 {
+		t.Errorf("running report is %+v", rep)
+	}
+
+	if code, body := doRequest(t, "POST", ts.URL+"/calibrate/finish", `{"reading":98}`); code != 200 {
+		t.Fatalf("finish returned %d %s", code, body)
+	}
+	if code, _ := doRequest(t, "POST", ts.URL+"/calibrate/apply", `{"sensorThreshold":2}`); code != 400 {
+		t.Errorf("invalid threshold returned %d", code)
+	}
+	if code, body := doRequest(t, "POST", ts.URL+"/calibrate/apply", `{"flashRate":1600,"sensorThreshold":0.2}`); code != 200 {
+		t.Fatalf("apply returned %d %s", code, body)
+	}
+	if s.GetConfig().FlashRate != 1600 || s.GetConfig().SensorThreshold != 0.2 {
+		t.Errorf("configuration was not applied %+v", s.GetConfig())
+	}
+	c := &Config{}
+	if err := c.ReadFromFile("config.json"); err != nil || c.FlashRate != 1600 {
+		t.Errorf("configuration file has flash rate %d. %v", c.FlashRate, err)
+	}
+
+	if code, body := doRequest(t, "DELETE", ts.URL+"/calibrate", ""); code != 200 || !json.Valid([]byte(body)) {
+		t.Errorf("cancel returned %d %s", code, body)
+	}
+	if rep := s.Calibration.GetReport(); rep.State != CalibrationIdle {
+		t.Errorf("state is %s after cancelling", rep.State)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// CalibrationController handles the Web Methods for calibrating the flash rate and sensor threshold
+type CalibrationController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *CalibrationController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/calibrate").Name("GetCalibration").
+		Handler(Logger(c, Authorize(s, RoleRead, http.HandlerFunc(c.handleGetCalibration))))
+	router.Methods("DELETE").Path("/calibrate").Name("CancelCalibration").
+		Handler(Logger(c, Authorize(s, RoleAdmin, http.HandlerFunc(c.handleCancel))))
+	router.Methods("POST").Path("/calibrate/start").Name("StartCalibration").
+		Handler(Logger(c, Authorize(s, RoleAdmin, http.HandlerFunc(c.handleStart))))
+	router.Methods("POST").Path("/calibrate/finish").Name("FinishCalibration").
+		Handler(Logger(c, Authorize(s, RoleAdmin, http.HandlerFunc(c.handleFinish))))
+	router.Methods("POST").Path("/calibrate/apply").Name("ApplyCalibration").
+		Handler(Logger(c, Authorize(s, RoleAdmin, http.HandlerFunc(c.handleApply))))
+}
+
+// readingRequest holds a reading from the meter keypad
+type readingRequest struct {
+	Reading *float64 `json:"reading"` // Units (kWh) shown on the meter keypad
+}
+
+// handleGetCalibration will return the progress and results of the calibration
+func (c *CalibrationController) handleGetCalibration(w http.ResponseWriter, r *http.Request) {
+	c.writeReport(w, c.Srv.Calibration.GetReport())
+}
+
+// handleCancel discards the calibration
+func (c *CalibrationController) handleCancel(w http.ResponseWriter, r *http.Request) {
+	c.Srv.Calibration.Cancel()
+	c.writeReport(w, c.Srv.Calibration.GetReport())
+}
+
+// handleStart starts the calibration with the first keypad reading
+func (c *CalibrationController) handleStart(w http.ResponseWriter, r *http.Request) {
+	v, ok := c.readReading(w, r)
+	if !ok {
+		return
+	}
+	if err := c.Srv.Calibration.Start(v); err != nil {
+		http.Error(w, "Invalid reading. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.writeReport(w, c.Srv.Calibration.GetReport())
+}
+
+// handleFinish completes the calibration with the second keypad reading and returns the results
+func (c *CalibrationController) handleFinish(w http.ResponseWriter, r *http.Request) {
+	v, ok := c.readReading(w, r)
+	if !ok {
+		return
+	}
+	rep, err := c.Srv.Calibration.Finish(v)
+	if err != nil {
+		http.Error(w, "Cannot finish calibration. "+err.Error(), http.StatusConflict)
+		return
+	}
+	c.writeReport(w, rep)
+}
+
+// handleApply saves the flash rate and sensor threshold, either sent or suggested by the
+// calibration, to the configuration and returns the configuration
+func (c *CalibrationController) handleApply(w http.ResponseWriter, r *http.Request) {
+	v := CalibrationValues{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			http.Error(w, "Invalid request. "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	nc, err := c.Srv.Calibration.Apply(v)
+	if err != nil {
+		if errs, ok := err.(ConfigErrors); ok {
+			b, _ := json.Marshal(map[string]interface{}{"errors": errs})
+			w.Header().Set("content-type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(b)
+		} else {
+			http.Error(w, "Cannot apply calibration. "+err.Error(), http.StatusConflict)
+		}
+		return
+	}
+	if err := nc.Redacted().WriteTo(w); err != nil {
+		c.LogError("Error serializing config.", err.Error())
+		http.Error(w, "Error serializing config", http.StatusInternalServerError)
+	}
+}
+
+// readReading reads the keypad reading from the request
+func (c *CalibrationController) readReading(w http.ResponseWriter, r *http.Request) (float64, bool) {
+	req := readingRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+	if req.Reading == nil {
+		http.Error(w, "Reading is required", http.StatusBadRequest)
+		return 0, false
+	}
+	return *req.Reading, true
+}
+
+// writeReport writes the calibration report to the response
+func (c *CalibrationController) writeReport(w http.ResponseWriter, rep CalibrationReport) {
+	if err := rep.WriteTo(w); err != nil {
+		c.LogError("Error serializing calibration.", err.Error())
+		http.Error(w, "Error serializing calibration", http.StatusInternalServerError)
+	}
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *CalibrationController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("CalibrationController", a)
+}
+
+// LogError is used to log error messages for this controller.
+func (c *CalibrationController) LogError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("CalibrationController", a)
+}
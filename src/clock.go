@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates timers, so that the time can be
+// accelerated by the simulator or controlled by tests
+type Clock interface {
+	Now() time.Time                         // Current time
+	After(d time.Duration) <-chan time.Time // Sends the time after the duration has passed
+	NewTicker(d time.Duration) Ticker       // Sends the time every time the duration passes
+}
+
+// Ticker sends the time at regular intervals
+type Ticker interface {
+	C() <-chan time.Time // Channel the time is sent on
+	Stop()               // Stops the ticker
+}
+
+// realClock is the system clock
+type realClock struct{}
+
+// Now returns the current time
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// After sends the time after the duration has passed
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// NewTicker sends the time every time the duration passes
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// realTicker is a system ticker
+type realTicker struct {
+	t *time.Ticker
+}
+
+// C returns the channel the time is sent on
+func (t realTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+// Stop stops the ticker
+func (t realTicker) Stop() {
+	t.t.Stop()
+}
+
+// ScaledClock runs faster than the system clock, starting at the time it is created
+type ScaledClock struct {
+	Speed  float64   // Speed of the clock, e.g. 60 for an hour per minute
+	origin time.Time // System time the clock was created
+}
+
+// NewScaledClock returns a clock that runs at the specified speed
+func NewScaledClock(speed float64) *ScaledClock {
+	return &ScaledClock{Speed: speed, origin: time.Now()}
+}
+
+// Now returns the current time
+func (c *ScaledClock) Now() time.Time {
+	return c.origin.Add(time.Duration(float64(time.Since(c.origin)) * c.Speed))
+}
+
+// After sends the time after the duration has passed
+func (c *ScaledClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	time.AfterFunc(c.real(d), func() {
+		ch <- c.Now()
+	})
+	return ch
+}
+
+// NewTicker sends the time every time the duration passes
+func (c *ScaledClock) NewTicker(d time.Duration) Ticker {
+	t := &scaledTicker{t: time.NewTicker(c.real(d)), c: make(chan time.Time, 1), done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-t.t.C:
+				select {
+				case t.c <- c.Now():
+				default:
+				}
+			}
+		}
+	}()
+	return t
+}
+
+// real returns the system duration of the duration on the clock
+func (c *ScaledClock) real(d time.Duration) time.Duration {
+	r := time.Duration(float64(d) / c.Speed)
+	if r <= 0 && d > 0 {
+		r = 1
+	}
+	return r
+}
+
+// scaledTicker is a ticker of a scaled clock
+type scaledTicker struct {
+	t    *time.Ticker   // System ticker
+	c    chan time.Time // Channel the scaled time is sent on
+	done chan struct{}  // Closed to stop the ticker
+	once sync.Once
+}
+
+// C returns the channel the time is sent on
+func (t *scaledTicker) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop stops the ticker
+func (t *scaledTicker) Stop() {
+	t.once.Do(func() {
+		t.t.Stop()
+		close(t.done)
+	})
+}
+
+// clock returns the clock used by the server
+func (s *Server) clock() Clock {
+	if s.Clock == nil {
+		return realClock{}
+	}
+	return s.Clock
+}
+
+// Now returns the current time of the server clock
+func (s *Server) Now() time.Time {
+	return s.clock().Now()
+}
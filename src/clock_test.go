@@ -0,0 +1,191 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestFakeClock checks that the timers and tickers fire when the clock is advanced
+func TestFakeClock(t *testing.T) {
+	c := NewFakeClock(testStart)
+	a := c.After(2 * time.Second)
+	tk := c.NewTicker(time.Second)
+	if c.Waiters() != 2 {
+		t.Fatalf("%d waiters, want 2", c.Waiters())
+	}
+
+	c.Advance(time.Second)
+	select {
+	case <-a:
+		t.Fatal("timer fired early")
+	case at := <-tk.C():
+		if !at.Equal(testStart.Add(time.Second)) {
+			t.Errorf("tick at %v", at)
+		}
+	}
+
+	c.Advance(time.Second)
+	if at := <-a; !at.Equal(testStart.Add(2 * time.Second)) {
+		t.Errorf("timer fired at %v", at)
+	}
+	<-tk.C()
+	if c.Waiters() != 1 {
+		t.Errorf("%d waiters after the timer fired, want 1", c.Waiters())
+	}
+
+	// Setting the clock back does not fire the ticker
+	c.Set(testStart)
+	select {
+	case <-tk.C():
+		t.Error("ticker fired when the clock was set back")
+	default:
+	}
+	tk.Stop()
+	if c.Waiters() != 0 {
+		t.Errorf("%d waiters after the ticker stopped, want 0", c.Waiters())
+	}
+}
+
+// TestScaledClock checks that the scaled clock runs at its speed
+func TestScaledClock(t *testing.T) {
+	c := NewScaledClock(3600)
+	start := c.Now()
+	<-c.After(time.Minute)
+	if d := c.Now().Sub(start); d < time.Minute || d > time.Hour {
+		t.Errorf("a minute on the clock took %v", d)
+	}
+}
+
+// TestScheduler checks that the job runs every period of the clock
+func TestScheduler(t *testing.T) {
+	c := NewFakeClock(testStart)
+	runs := atomic.Int32{}
+	s := &Scheduler{Clock: c, Period: 5 * time.Minute, Job: jobFunc(func() { runs.Add(1) })}
+	s.Start()
+	defer s.Stop()
+
+	for i := 1; i <= 3; i++ {
+		c.Advance(5 * time.Minute)
+		waitFor(t, "the scheduled job", func() bool { return runs.Load() == int32(i) })
+	}
+	c.Advance(4 * time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if runs.Load() != 3 {
+		t.Errorf("job ran %d times, want 3", runs.Load())
+	}
+}
+
+// jobFunc runs a function as a scheduled job
+type jobFunc func()
+
+// Run runs the function
+func (f jobFunc) Run() {
+	f()
+}
+
+// TestClockStep checks that the history is held until the clock is synchronized,
+// and that a clock step moves the held history and the pulse times
+func TestClockStep(t *testing.T) {
+	s, clock := newTestServer(t)
+	// A Pi without a real-time clock boots a day behind
+	boot := testStart.AddDate(0, 0, -1)
+	clock.Set(boot)
+	s.TimeSync.Check(boot, 0, false, "")
+	s.History.Hold()
+	s.Power.SetReading(100)
+
+	// The held usage is merged per minute
+	for _, pt := range pulsesEvery(boot, 36*time.Second, 100) {
+		clock.Set(pt)
+		s.Power.recordPulse(pt)
+	}
+	s.Power.TopUp(20)
+	if st := s.TimeSync.GetStatus(); st.Synchronized || st.Held != 51 {
+		t.Errorf("clock status is %+v", st)
+	}
+	if l := s.History.GetTopUps(); len(l) != 1 || !l[0].Time.Equal(boot.Add(time.Hour)) {
+		t.Errorf("held top-ups are %v", l)
+	}
+	if u := s.History.GetDaily(boot, 1); u[0].Units != 0 {
+		t.Errorf("held usage was added to the history %v", u)
+	}
+
+	// NTP steps the clock forward
+	step := testStart.Sub(boot)
+	clock.Set(clock.Now().Add(step))
+	s.TimeSync.Check(clock.Now(), step, true, "")
+	if st := s.TimeSync.GetStatus(); !st.Synchronized || st.Steps != 1 || st.LastStep != step.Seconds() || st.Held != 0 {
+		t.Errorf("clock status is %+v after the step", st)
+	}
+	if u := s.History.GetHourly(testStart); !closeEnough(u[9].Units, 0.1) {
+		t.Errorf("hourly history is %v after the step", u)
+	}
+	if l := s.History.GetTopUps(); len(l) != 1 || !l[0].Time.Equal(testStart.Add(time.Hour)) {
+		t.Errorf("top-ups are %v after the step", l)
+	}
+	if st := s.Power.GetStatus(); !st.LastPulse.Equal(testStart.Add(time.Hour)) {
+		t.Errorf("last pulse is %v after the step", st.LastPulse)
+	}
+	if r := s.Power.GetPowerReport(); !r.StartTime.Equal(testStart) {
+		t.Errorf("start time is %v after the step", r.StartTime)
+	}
+
+	// A slewed clock is not a step
+	s.TimeSync.Check(clock.Now(), 10*time.Millisecond, true, "")
+	if st := s.TimeSync.GetStatus(); st.Steps != 1 {
+		t.Errorf("%d steps after a slew", st.Steps)
+	}
+}
+
+// TestClockHoldLimit checks that the held history is added on the unsynchronized clock once it
+// has been held for too long, so a Pi that stays offline still records its history
+func TestClockHoldLimit(t *testing.T) {
+	s, clock := newTestServer(t)
+	s.Power.SetReading(100)
+	s.TimeSync.Check(testStart, 0, true, "")
+	s.TimeSync.Check(testStart, 0, false, "")
+	for _, pt := range pulsesEvery(testStart, 36*time.Second, 100) {
+		clock.Set(pt)
+		s.Power.recordPulse(pt)
+	}
+	s.TimeSync.Check(testStart.Add(clockHoldLimit-time.Minute), 0, false, "")
+	if st := s.TimeSync.GetStatus(); st.Held != 50 || st.Unsynced {
+		t.Errorf("clock status is %+v before the limit", st)
+	}
+
+	s.TimeSync.Check(testStart.Add(clockHoldLimit), 0, false, "")
+	if st := s.TimeSync.GetStatus(); st.Held != 0 || !st.Unsynced {
+		t.Errorf("clock status is %+v after the limit", st)
+	}
+	if u := s.History.GetHourly(testStart); !closeEnough(u[9].Units, 0.1) {
+		t.Errorf("hourly history is %v after the limit", u)
+	}
+
+	// Usage is no longer held, until the clock is synchronized
+	s.Power.recordPulse(clock.Now().Add(time.Minute))
+	if st := s.TimeSync.GetStatus(); st.Held != 0 {
+		t.Errorf("%d entries held after the limit", st.Held)
+	}
+	s.TimeSync.Check(clock.Now(), 0, true, "")
+	if st := s.TimeSync.GetStatus(); !st.Synchronized || st.Unsynced {
+		t.Errorf("clock status is %+v once synchronized", st)
+	}
+}
+
+// TestShiftWall checks that times with a monotonic reading are placed by their interval to the
+// current time, so a time taken after the step is not moved again, and other times are moved by the step
+func TestShiftWall(t *testing.T) {
+	// The step happened before both times were taken, so neither is moved
+	before := time.Now()
+	now := before.Add(time.Second)
+	if got := shiftWall(before, now, time.Hour); !got.Equal(before) || got != got.Round(0) {
+		t.Errorf("time with a monotonic reading moved to %v, want %v", got, before)
+	}
+	if got := shiftWall(before.Round(0), now, time.Hour); !got.Equal(before.Add(time.Hour)) {
+		t.Errorf("time without a monotonic reading moved to %v, want %v", got, before.Add(time.Hour))
+	}
+	if got := shiftWall(time.Time{}, now, time.Hour); !got.IsZero() {
+		t.Errorf("zero time moved to %v", got)
+	}
+}
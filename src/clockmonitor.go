@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	clockCheckInterval = time.Minute    // Time between clock checks
+	clockStepLimit     = time.Second    // Difference between the wall clock and the monotonic clock treated as a step
+	clockHoldLimit     = 24 * time.Hour // Time the history is held for while the clock is not synchronized
+)
+
+// ClockStatus holds the state of the system clock
+type ClockStatus struct {
+	Synchronized bool      `json:"synchronized"`        // Signals that the clock is synchronized, or that it cannot be checked
+	SyncError    string    `json:"syncError,omitempty"` // Error checking the synchronization, if it cannot be checked
+	Steps        int       `json:"steps"`               // Number of clock steps detected since the service started
+	LastStep     float64   `json:"lastStep"`            // Size of the last step (in seconds)
+	LastStepAt   time.Time `json:"lastStepAt"`          // Time of the last step, on the corrected clock
+	Held         int       `json:"held"`                // Number of usage and top-up entries held until the clock is synchronized
+	Unsynced     bool      `json:"unsynced"`            // Signals that the history is recorded on the unsynchronized clock, as it was held for too long
+}
+
+// ClockMonitor watches the system clock for steps, e.g. when a Raspberry Pi without a
+// real-time clock boots with the wrong time and NTP corrects it later.
+// Intervals are measured on the monotonic clock that Go keeps with the times from Now,
+// so they are not affected by a step, but the times that are shown and saved are moved
+// by the step. The history is held while the clock is not synchronized, for up to
+// clockHoldLimit, after which it is recorded on the unsynchronized clock so it is not lost.
+type ClockMonitor struct {
+	Srv       *Server       // Server instance
+	state     ClockStatus   // Current state of the clock
+	heldSince time.Time     // Time the history started being held, or zero if it is not held
+	done      chan struct{} // Closed to stop checking
+	mu        sync.Mutex
+}
+
+// Start starts watching the clock. The simulated clocks do not follow the system
+// clock, so they are not watched.
+func (m *ClockMonitor) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done != nil || m.Srv.Clock != nil {
+		return
+	}
+	m.state.Synchronized, m.state.SyncError = m.synchronized()
+	if !m.state.Synchronized {
+		m.logInfo("Clock is not synchronized. The history is held until it is.")
+		m.Srv.History.Hold()
+		m.heldSince = time.Now()
+	}
+	m.done = make(chan struct{})
+	go m.run(m.done)
+}
+
+// Stop stops watching the clock
+func (m *ClockMonitor) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done != nil {
+		close(m.done)
+		m.done = nil
+	}
+}
+
+// GetStatus returns the state of the clock
+func (m *ClockMonitor) GetStatus() ClockStatus {
+	m.mu.Lock()
+	st := m.state
+	m.mu.Unlock()
+	st.Held = m.Srv.History.Held()
+	return st
+}
+
+// run checks the clock until it is stopped. The system clock is watched,
+// so the system ticker is used.
+func (m *ClockMonitor) run(done chan struct{}) {
+	t := time.NewTicker(clockCheckInterval)
+	defer t.Stop()
+	ref := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-t.C:
+			// The wall clock moves with a step, the monotonic clock does not
+			step := now.Round(0).Sub(ref.Round(0)) - now.Sub(ref)
+			ref = now
+			synced, syncErr := m.synchronized()
+			m.Check(now, step, synced, syncErr)
+		}
+	}
+}
+
+// Check records the clock step measured at the specified time and the synchronization state.
+// A step moves the times held by the service, and the held history is saved once the
+// clock is synchronized, or once it has been held for clockHoldLimit.
+func (m *ClockMonitor) Check(now time.Time, step time.Duration, synced bool, syncErr string) {
+	stepped := step >= clockStepLimit || step <= -clockStepLimit
+	m.mu.Lock()
+	was := m.state.Synchronized
+	m.state.Synchronized = synced
+	m.state.SyncError = syncErr
+	if stepped {
+		m.state.Steps++
+		m.state.LastStep = round(step.Seconds(), 3)
+		m.state.LastStepAt = now
+	}
+	expired := false
+	switch {
+	case synced && !was:
+		m.heldSince = time.Time{}
+		m.state.Unsynced = false
+	case !synced && was:
+		m.heldSince = now
+	case !synced && !m.heldSince.IsZero() && now.Sub(m.heldSince) >= clockHoldLimit:
+		m.heldSince = time.Time{}
+		m.state.Unsynced = true
+		expired = true
+	}
+	m.mu.Unlock()
+
+	if stepped {
+		m.logInfo("Clock stepped by ", step.Round(time.Millisecond), ". Moving the pulse and history times by the step.")
+		m.Srv.Power.restamp(now, step)
+		m.Srv.PulseSource.restamp(now, step)
+		m.Srv.History.Restamp(now, step)
+		m.Srv.Calibration.restamp(now, step)
+		m.Srv.Events.Publish(EventAlert, AlertEvent{
+			Source:  "Clock",
+			Message: fmt.Sprintf("Clock stepped by %s", step.Round(time.Second)),
+		})
+	}
+	switch {
+	case synced && !was:
+		n := m.Srv.History.Release()
+		m.logInfo("Clock is synchronized. ", n, " held history entries were added.")
+	case !synced && was:
+		m.logInfo("Clock is not synchronized. The history is held until it is.")
+		m.Srv.History.Hold()
+	case expired:
+		n := m.Srv.History.Release()
+		m.logInfo("Clock has not been synchronized for ", clockHoldLimit, ". ", n, " held history entries were added on the unsynchronized clock.")
+		m.Srv.Events.Publish(EventAlert, AlertEvent{
+			Source:  "Clock",
+			Message: "Clock is not synchronized, so the history is recorded with the wrong times",
+		})
+	}
+}
+
+// synchronized checks if the clock is synchronized. If it cannot be checked it is
+// treated as synchronized, so the history is not held forever.
+func (m *ClockMonitor) synchronized() (bool, string) {
+	synced, err := clockSynchronized()
+	if err != nil {
+		return true, err.Error()
+	}
+	return synced, ""
+}
+
+// shiftWall moves the time onto the wall clock of the current time, which has been corrected
+// by the clock step. A time with a monotonic reading is placed by its interval to the current
+// time, which the step did not change, so a time taken after the step is not moved by it again.
+// Other times, e.g. read from a file or already moved, are moved by the step.
+// The monotonic reading is dropped, so intervals to the time use the corrected wall clock.
+func shiftWall(t, now time.Time, step time.Duration) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	if t != t.Round(0) && now != now.Round(0) {
+		return now.Round(0).Add(-now.Sub(t))
+	}
+	return t.Round(0).Add(step)
+}
+
+// logInfo logs an information message to the logger
+func (m *ClockMonitor) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("Clock", a)
+}
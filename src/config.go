@@ -1,73 +1,504 @@
-package main
-
-import (
-	"encoding/json"
-	"io"
-	"io/ioutil"
-	"net/http"
-	"os"
-)
-
-// Config holds the configuration required for the Service
-type Config struct {
-	FlashRate    int64  `json:"flashRate"`    // Number of flashes per KWh
-	Period       int    `json:"period"`       // Cloud update period (in minutes)
-	EnableMqtt   bool   `json:"enableMqtt"`   // Enable MQTT integration
-	MqttHost     string `json:"mqttHost"`     // MQTT Host
-	MqttUsername string `json:"mqttUsername"` // MQTT Username
-	MqttPassword string `json:"mqttPassword"` // MQTT password
-}
-
-// ReadFromFile will read the configuration settings from the specified file
-func (c *Config) ReadFromFile(path string) error {
-	_, err := os.Stat(path)
-	if !os.IsNotExist(err) {
-		b, err := ioutil.ReadFile(path)
-		if err == nil {
-			err = json.Unmarshal(b, &c)
-		}
-	}
-	c.SetDefaults()
-	return err
-}
-
-// WriteToFile will write the configuration settings to the specified file
-func (c *Config) WriteToFile(path string) error {
-	b, err := json.Marshal(c)
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(path, b, 0666)
-}
-
-// ReadFrom reads the string from the reader and deserializes it into the config values
-func (c *Config) ReadFrom(r io.ReadCloser) error {
-	b, err := ioutil.ReadAll(r)
-	if err == nil {
-		if b != nil && len(b) != 0 {
-			err = json.Unmarshal(b, &c)
-		}
-	}
-	c.SetDefaults()
-	return err
-}
-
-// WriteTo serializes the config and writes it to the http response
-func (c *Config) WriteTo(w http.ResponseWriter) error {
-	b, err := json.Marshal(c)
-	if err != nil {
-		return err
-	}
-	w.Header().Set("content-type", "application/json")
-	w.Write(b)
-	return nil
-}
-
-// SetDefaults checks the configuration and makes sure that, if
-// a value is not configured, the default value is set.
-func (c *Config) SetDefaults() {
-	// Set default values, if required
-	if c.FlashRate <= 0 {
-		c.FlashRate = 1000
-	}
-}
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Config holds the configuration required for the Service
+type Config struct {
+	Version int `json:"version"` // Version of the configuration file layout
+
+	FlashRate    int64  `json:"flashRate"`    // Number of flashes per KWh
+	Period       int    `json:"period"`       // Cloud update period (in minutes)
+	EnableMqtt   bool   `json:"enableMqtt"`   // Enable MQTT integration
+	MqttHost     string `json:"mqttHost"`     // MQTT Host
+	MqttUsername string `json:"mqttUsername"` // MQTT Username
+	MqttPassword string `json:"mqttPassword"` // MQTT password
+
+	AlertBalance    float64 `json:"alertBalance"`    // Balance (in Kwh) below which an alert is raised
+	MaxLoad         float64 `json:"maxLoad"`         // Maximum possible load (in Watts), from the main breaker rating. Faster pulses are rejected.
+	SensorPin       int     `json:"sensorPin"`       // GPIO number of the light sensor
+	SensorThreshold float64 `json:"sensorThreshold"` // Light level, between 0 and 1, above which the sensor detects a pulse
+	FaultSilence    int     `json:"faultSilence"`    // Hours without a pulse after which the sensor is reported as faulty, if the load is never that low
+	FaultBaseLoad   float64 `json:"faultBaseLoad"`   // Load (in Watts) that the base load must stay above for the silence to be reported
+	LedPin          int     `json:"ledPin"`          // GPIO number of the pulse LED
+
+	PulseSource string  `json:"pulseSource"` // Source of the pulses, sensor, replay or simulator
+	ReplayFile  string  `json:"replayFile"`  // Pulse recording replayed by the replay source
+	ReplaySpeed float64 `json:"replaySpeed"` // Speed of the replay, e.g. 1 for real time or 60 for an hour per minute. 0 backfills the history instantly.
+	RecordFile  string  `json:"recordFile"`  // File the raw pulses are recorded to. Empty disables recording.
+	SimProfile  string  `json:"simProfile"`  // Load profile file of the simulator. If not set, a typical household is simulated.
+	SimSpeed    float64 `json:"simSpeed"`    // Speed of the simulated time, e.g. 60 for an hour per minute
+	SimSeed     int64   `json:"simSeed"`     // Seed of the simulator random numbers, for repeatable runs. 0 uses a random seed.
+
+	EnableEmoncms bool   `json:"enableEmoncms"` // Enable emoncms integration
+	EmoncmsURL    string `json:"emoncmsUrl"`    // emoncms base URL
+	EmoncmsAPIKey string `json:"emoncmsApiKey"` // emoncms read/write API key
+	EmoncmsNode   string `json:"emoncmsNode"`   // emoncms input node name
+
+	EnablePVOutput   bool   `json:"enablePvOutput"`   // Enable PVOutput integration
+	PVOutputURL      string `json:"pvOutputUrl"`      // PVOutput base URL
+	PVOutputAPIKey   string `json:"pvOutputApiKey"`   // PVOutput API key
+	PVOutputSystemID string `json:"pvOutputSystemId"` // PVOutput system ID
+
+	EnableTLS        bool   `json:"enableTls"`        // Serve the API over HTTPS
+	TLSCertFile      string `json:"tlsCertFile"`      // PEM certificate file. If not set, a self-signed certificate is generated.
+	TLSKeyFile       string `json:"tlsKeyFile"`       // PEM private key file of the certificate
+	HTTPRedirectPort int    `json:"httpRedirectPort"` // Port on which HTTP requests are redirected to HTTPS (0 to disable)
+
+	LogLevel  string            `json:"logLevel"`  // Minimum level logged (debug, info, warning or error)
+	LogLevels map[string]string `json:"logLevels"` // Minimum level logged for each component, e.g. {"Power": "debug"}
+
+	APIKeys []APIKey  `json:"apiKeys"` // API keys that can access the API. If there are no keys or users, access is not restricted.
+	Users   []APIUser `json:"users"`   // Users that can access the API using basic authentication
+
+	sources    map[string]string // Source of each value, keyed by field name
+	secretRefs map[string]string // File or environment variable references of the secrets, keyed by field name
+	secretErrs map[string]string // Errors resolving the secret references, keyed by field name
+}
+
+// ReadFromFile will read the configuration settings from the specified file
+func (c *Config) ReadFromFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		b, _, err = migrateConfig(b)
+	}
+	if err == nil {
+		if err = json.Unmarshal(b, &c); err == nil {
+			c.markFileSources(b)
+			c.resolveSecrets()
+		}
+	} else if os.IsNotExist(err) {
+		// No file, so use the default values
+		err = nil
+	}
+	c.SetDefaults()
+	return err
+}
+
+// WriteToFile will write the configuration settings to the specified file.
+// Secrets read from a file or environment variable are written as the reference.
+// As the file can hold secrets, it can only be read by the owner.
+func (c *Config) WriteToFile(path string) error {
+	b, err := json.Marshal(c.withSecretRefs())
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
+}
+
+// ReadFrom reads the string from the reader and deserializes it into the config values.
+// The secrets cannot be file or environment variable references, as the values are
+// sent by a client, so only the configuration file and the command line can set them.
+func (c *Config) ReadFrom(r io.ReadCloser) error {
+	b, err := ioutil.ReadAll(r)
+	if err == nil {
+		if b != nil && len(b) != 0 {
+			b, _, err = migrateConfig(b)
+			if err == nil {
+				prev := c.clone()
+				if err = json.Unmarshal(b, &c); err == nil {
+					c.markFileSources(b)
+					err = c.checkClientSecrets(prev)
+				}
+			}
+		}
+	}
+	c.SetDefaults()
+	return err
+}
+
+// WriteTo serializes the config and writes it to the http response
+func (c *Config) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// Changes returns the names of the subsystems affected by the differences
+// between this configuration and the specified configuration
+func (c *Config) Changes(n *Config) []string {
+	l := []string{}
+	if c.FlashRate != n.FlashRate || c.MaxLoad != n.MaxLoad {
+		l = append(l, "power")
+	}
+	if c.SensorPin != n.SensorPin || c.SensorThreshold != n.SensorThreshold || c.PulseSource != n.PulseSource ||
+		c.ReplayFile != n.ReplayFile || c.ReplaySpeed != n.ReplaySpeed ||
+		c.SimProfile != n.SimProfile || c.SimSeed != n.SimSeed {
+		l = append(l, "sensor")
+	}
+	if c.ClockSpeed() != n.ClockSpeed() {
+		l = append(l, "clock")
+	}
+	if c.RecordFile != n.RecordFile {
+		l = append(l, "recording")
+	}
+	if c.Period != n.Period {
+		l = append(l, "schedule")
+	}
+	if c.EnableMqtt != n.EnableMqtt || c.MqttHost != n.MqttHost ||
+		c.MqttUsername != n.MqttUsername || c.MqttPassword != n.MqttPassword {
+		l = append(l, "mqtt")
+	}
+	if c.EnableEmoncms != n.EnableEmoncms || c.EmoncmsURL != n.EmoncmsURL ||
+		c.EmoncmsAPIKey != n.EmoncmsAPIKey || c.EmoncmsNode != n.EmoncmsNode {
+		l = append(l, "emoncms")
+	}
+	if c.EnablePVOutput != n.EnablePVOutput || c.PVOutputURL != n.PVOutputURL ||
+		c.PVOutputAPIKey != n.PVOutputAPIKey || c.PVOutputSystemID != n.PVOutputSystemID {
+		l = append(l, "pvoutput")
+	}
+	if c.EnableTLS != n.EnableTLS || c.TLSCertFile != n.TLSCertFile ||
+		c.TLSKeyFile != n.TLSKeyFile || c.HTTPRedirectPort != n.HTTPRedirectPort {
+		l = append(l, "https")
+	}
+	if c.LogLevel != n.LogLevel || !reflect.DeepEqual(c.LogLevels, n.LogLevels) {
+		l = append(l, "logging")
+	}
+	if !reflect.DeepEqual(c.APIKeys, n.APIKeys) || !reflect.DeepEqual(c.Users, n.Users) {
+		l = append(l, "auth")
+	}
+	return l
+}
+
+// redacted is the value returned in place of a configured secret
+const redacted = "********"
+
+// ClockSpeed returns the speed of the clock the service runs on. The simulator and
+// accelerated replays run the whole service on a faster clock, so that the times
+// and intervals of the pulses, the load and the history stay consistent.
+func (c *Config) ClockSpeed() float64 {
+	switch {
+	case c.PulseSource == SourceSimulator:
+		return c.SimSpeed
+	case c.PulseSource == SourceReplay && c.ReplaySpeed > 0:
+		return c.ReplaySpeed
+	default:
+		return 1
+	}
+}
+
+// Redacted returns a copy of the configuration with the secrets removed.
+// Secrets read from a file or environment variable show the reference instead.
+func (c *Config) Redacted() *Config {
+	r := c.clone()
+	for n, v := range r.secrets() {
+		if ref, ok := r.secretRefs[n]; ok {
+			*v = ref
+		} else if *v != "" {
+			*v = redacted
+		}
+	}
+	return r
+}
+
+// KeepSecrets copies the secrets from the previous configuration for any
+// secret that was returned redacted and has not been changed
+func (c *Config) KeepSecrets(prev *Config) {
+	p := prev.secrets()
+	for n, v := range c.secrets() {
+		if pv, ok := p[n]; ok && *v == redacted {
+			*v = *pv
+			if ref, ok := prev.secretRefs[n]; ok {
+				c.setSecretRef(n, ref)
+			}
+		}
+	}
+}
+
+// secrets returns pointers to the secret configuration values, keyed by field name.
+// The API keys and user passwords are keyed by name, so that they can be matched
+// when keys and users are added or removed.
+func (c *Config) secrets() map[string]*string {
+	m := map[string]*string{
+		"mqttPassword":   &c.MqttPassword,
+		"emoncmsApiKey":  &c.EmoncmsAPIKey,
+		"pvOutputApiKey": &c.PVOutputAPIKey,
+	}
+	for i := range c.APIKeys {
+		m["apiKeys["+c.APIKeys[i].Name+"].key"] = &c.APIKeys[i].Key
+	}
+	for i := range c.Users {
+		m["users["+c.Users[i].Username+"].password"] = &c.Users[i].Password
+	}
+	return m
+}
+
+// ConfigError describes a configuration value that is not valid
+type ConfigError struct {
+	Field   string `json:"field"`   // Path of the field in the configuration file
+	Message string `json:"message"` // Description of the problem
+}
+
+// Error returns the error message
+func (e ConfigError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ConfigErrors holds all the problems found when validating the configuration
+type ConfigErrors []ConfigError
+
+// Error returns the error messages
+func (e ConfigErrors) Error() string {
+	l := []string{}
+	for _, ce := range e {
+		l = append(l, ce.Error())
+	}
+	return strings.Join(l, "; ")
+}
+
+// add adds a problem with the specified field
+func (e *ConfigErrors) add(field string, format string, v ...interface{}) {
+	*e = append(*e, ConfigError{Field: field, Message: fmt.Sprintf(format, v...)})
+}
+
+// Validate checks all the configuration values and returns a ConfigErrors
+// listing every value that is not valid
+func (c *Config) Validate() error {
+	e := ConfigErrors{}
+
+	if c.Version > configVersion {
+		e.add("version", "version %d is newer than the supported version %d", c.Version, configVersion)
+	}
+	if c.FlashRate < 1 || c.FlashRate > 100000 {
+		e.add("flashRate", "must be between 1 and 100000 flashes per kWh")
+	}
+	if c.Period < 1 || c.Period > 1440 {
+		e.add("period", "must be between 1 and 1440 minutes")
+	}
+	if c.AlertBalance < 0 {
+		e.add("alertBalance", "cannot be negative")
+	}
+	if c.MaxLoad < 1000 || c.MaxLoad > 100000 {
+		e.add("maxLoad", "must be between 1000 and 100000 Watts")
+	}
+	if c.SensorPin < 2 || c.SensorPin > 27 {
+		e.add("sensorPin", "must be a GPIO number between 2 and 27")
+	}
+	if c.SensorThreshold < 0.01 || c.SensorThreshold > 0.99 {
+		e.add("sensorThreshold", "must be between 0.01 and 0.99")
+	}
+	if c.FaultSilence < 1 || c.FaultSilence > 168 {
+		e.add("faultSilence", "must be between 1 and 168 hours")
+	}
+	if c.FaultBaseLoad < 1 || c.FaultBaseLoad > 10000 {
+		e.add("faultBaseLoad", "must be between 1 and 10000 Watts")
+	}
+	if c.LedPin < 2 || c.LedPin > 27 {
+		e.add("ledPin", "must be a GPIO number between 2 and 27")
+	} else if c.LedPin == c.SensorPin {
+		e.add("ledPin", "cannot be the same as sensorPin")
+	}
+
+	switch c.PulseSource {
+	case SourceSensor:
+	case SourceReplay:
+		if c.ReplayFile == "" {
+			e.add("replayFile", "is required when the pulse source is replay")
+		}
+	case SourceSimulator:
+		if _, err := ReadLoadProfile(c.SimProfile); err != nil {
+			e.add("simProfile", "cannot read the load profile. %s", err.Error())
+		}
+	default:
+		e.add("pulseSource", "must be %s, %s or %s", SourceSensor, SourceReplay, SourceSimulator)
+	}
+	if c.SimSpeed <= 0 || c.SimSpeed > 3600 {
+		e.add("simSpeed", "must be greater than 0 and at most 3600")
+	}
+	if c.ReplaySpeed < 0 || c.ReplaySpeed > 3600 {
+		e.add("replaySpeed", "cannot be negative or more than 3600")
+	}
+	if c.RecordFile != "" && c.RecordFile == c.ReplayFile && c.PulseSource == SourceReplay {
+		e.add("recordFile", "cannot be the file being replayed")
+	}
+
+	if c.EnableMqtt {
+		if c.MqttHost == "" {
+			e.add("mqttHost", "is required when MQTT is enabled")
+		} else if err := checkURL(c.MqttHost, "tcp", "ssl", "tls", "mqtt", "mqtts", "ws", "wss"); err != nil {
+			e.add("mqttHost", "%s", err.Error())
+		}
+		if c.MqttUsername == "" {
+			e.add("mqttUsername", "is required when MQTT is enabled")
+		}
+		if c.MqttPassword == "" {
+			e.add("mqttPassword", "is required when MQTT is enabled")
+		}
+	}
+
+	if c.EnableEmoncms {
+		if err := checkURL(c.EmoncmsURL, "http", "https"); err != nil {
+			e.add("emoncmsUrl", "%s", err.Error())
+		}
+		if c.EmoncmsAPIKey == "" {
+			e.add("emoncmsApiKey", "is required when emoncms is enabled")
+		}
+		if c.EmoncmsNode == "" || strings.ContainsAny(c.EmoncmsNode, " /?&") {
+			e.add("emoncmsNode", "must be a name without spaces or URL characters")
+		}
+	}
+
+	if c.EnablePVOutput {
+		if err := checkURL(c.PVOutputURL, "http", "https"); err != nil {
+			e.add("pvOutputUrl", "%s", err.Error())
+		}
+		if c.PVOutputAPIKey == "" {
+			e.add("pvOutputApiKey", "is required when PVOutput is enabled")
+		}
+		if _, err := strconv.Atoi(c.PVOutputSystemID); err != nil {
+			e.add("pvOutputSystemId", "must be the numeric PVOutput system ID")
+		}
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		e.add("tlsKeyFile", "tlsCertFile and tlsKeyFile must both be set, or both be empty for a self-signed certificate")
+	} else if c.EnableTLS && c.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile); err != nil {
+			e.add("tlsCertFile", "cannot load the certificate. %s", err.Error())
+		}
+	}
+	if c.HTTPRedirectPort < 0 || c.HTTPRedirectPort > 65535 {
+		e.add("httpRedirectPort", "must be a port number between 1 and 65535, or 0 to disable")
+	}
+
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		e.add("logLevel", "%s", err.Error())
+	}
+	for n, lvl := range c.LogLevels {
+		if _, err := parseLogLevel(lvl); err != nil {
+			e.add("logLevels."+n, "%s", err.Error())
+		}
+	}
+
+	names := map[string]bool{}
+	for i, k := range c.APIKeys {
+		f := fmt.Sprintf("apiKeys[%d]", i)
+		if k.Name == "" {
+			e.add(f+".name", "is required")
+		} else if names[k.Name] {
+			e.add(f+".name", "'%s' is used by more than one key", k.Name)
+		}
+		names[k.Name] = true
+		if strings.HasPrefix(k.Key, keyHashPrefix) {
+			if !isAPIKeyHash(k.Key) {
+				e.add(f+".key", "must be %s followed by 64 hexadecimal characters", keyHashPrefix)
+			}
+		} else if len(k.Key) < 16 {
+			e.add(f+".key", "must be at least 16 characters")
+		}
+		if k.Role != RoleRead && k.Role != RoleAdmin {
+			e.add(f+".role", "must be %s or %s", RoleRead, RoleAdmin)
+		}
+	}
+	names = map[string]bool{}
+	for i, u := range c.Users {
+		f := fmt.Sprintf("users[%d]", i)
+		if u.Username == "" || strings.Contains(u.Username, ":") {
+			e.add(f+".username", "is required and cannot contain ':'")
+		} else if names[u.Username] {
+			e.add(f+".username", "'%s' is used by more than one user", u.Username)
+		}
+		names[u.Username] = true
+		if len(u.Password) < 8 {
+			e.add(f+".password", "must be at least 8 characters")
+		}
+		if u.Role != RoleRead && u.Role != RoleAdmin {
+			e.add(f+".role", "must be %s or %s", RoleRead, RoleAdmin)
+		}
+	}
+
+	for n, msg := range c.secretErrs {
+		e.add(n, "%s", msg)
+	}
+
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// checkURL checks that the value is an absolute URL with one of the specified schemes
+func checkURL(v string, schemes ...string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return fmt.Errorf("is not a valid URL. %s", err.Error())
+	}
+	if u.Host == "" {
+		return fmt.Errorf("must be a URL of the form %s://host:port", schemes[0])
+	}
+	for _, s := range schemes {
+		if u.Scheme == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("must use one of the schemes %s", strings.Join(schemes, ", "))
+}
+
+// SetDefaults checks the configuration and makes sure that, if
+// a value is not configured, the default value is set.
+func (c *Config) SetDefaults() {
+	// Set default values, if required
+	if c.Version == 0 {
+		c.Version = configVersion
+	}
+	if c.FlashRate == 0 {
+		c.FlashRate = 1000
+	}
+	if c.Period == 0 {
+		c.Period = 5
+	}
+	if c.MaxLoad == 0 {
+		c.MaxLoad = 13800
+	}
+	if c.SensorPin == 0 {
+		c.SensorPin = 19
+	}
+	if c.SensorThreshold == 0 {
+		c.SensorThreshold = 0.1
+	}
+	if c.FaultSilence == 0 {
+		c.FaultSilence = 3
+	}
+	if c.FaultBaseLoad == 0 {
+		c.FaultBaseLoad = 50
+	}
+	if c.LedPin == 0 {
+		c.LedPin = 26
+	}
+	if c.PulseSource == "" {
+		c.PulseSource = SourceSensor
+	}
+	if c.SimSpeed == 0 {
+		c.SimSpeed = 1
+	}
+	if c.EmoncmsURL == "" {
+		c.EmoncmsURL = "https://emoncms.org"
+	}
+	if c.EmoncmsNode == "" {
+		c.EmoncmsNode = "power"
+	}
+	if c.PVOutputURL == "" {
+		c.PVOutputURL = "https://pvoutput.org"
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = LevelInfo
+	}
+}
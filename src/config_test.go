@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// TestConfigDefaults checks the default values used when there is no configuration file
+func TestConfigDefaults(t *testing.T) {
+	t.Chdir(t.TempDir())
+	c := &Config{}
+	if err := c.ReadFromFile("config.json"); err != nil {
+		t.Fatal(err)
+	}
+	if c.FlashRate != 1000 || c.Period != 5 || c.MaxLoad != 13800 || c.PulseSource != SourceSensor {
+		t.Errorf("unexpected defaults %+v", c)
+	}
+	if c.Version != configVersion {
+		t.Errorf("version is %d, want %d", c.Version, configVersion)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("default configuration is not valid. %v", err)
+	}
+}
+
+// TestConfigRoundTrip checks that a configuration written to a file reads back the same
+func TestConfigRoundTrip(t *testing.T) {
+	t.Chdir(t.TempDir())
+	c := &Config{
+		FlashRate:     800,
+		Period:        10,
+		EnableMqtt:    true,
+		MqttHost:      "tcp://broker:1883",
+		MqttUsername:  "power",
+		MqttPassword:  "secret",
+		AlertBalance:  20,
+		EnableEmoncms: true,
+		EmoncmsAPIKey: "0123456789abcdef",
+		LogLevels:     map[string]string{"Power": LevelDebug},
+		APIKeys:       []APIKey{{Name: "dashboard", Key: hashAPIKey("key"), Role: RoleRead}},
+	}
+	c.SetDefaults()
+	if err := c.WriteToFile("config.json"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat("config.json"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("config file is not private. %v %v", fi.Mode(), err)
+	}
+
+	r := &Config{}
+	if err := r.ReadFromFile("config.json"); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(c)
+	got, _ := json.Marshal(r)
+	if string(got) != string(want) {
+		t.Errorf("read back\n%s\nwant\n%s", got, want)
+	}
+}
+
+// TestConfigValidate checks that every invalid value is reported
+func TestConfigValidate(t *testing.T) {
+	c := &Config{FlashRate: -1, MaxLoad: 10, EnableMqtt: true}
+	c.SetDefaults()
+	err := c.Validate()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("got %v, want ConfigErrors", err)
+	}
+	fields := map[string]bool{}
+	for _, e := range errs {
+		fields[e.Field] = true
+	}
+	for _, f := range []string{"flashRate", "maxLoad", "mqttHost"} {
+		if !fields[f] {
+			t.Errorf("%s was not reported in %v", f, err)
+		}
+	}
+}
+
+// TestConfigChanges checks the subsystems affected by configuration changes
+func TestConfigChanges(t *testing.T) {
+	c := &Config{}
+	c.SetDefaults()
+	n := c.clone()
+	if l := c.Changes(n); len(l) != 0 {
+		t.Errorf("unchanged configuration has changes %v", l)
+	}
+	n.FlashRate = 500
+	n.MqttPassword = "changed"
+	n.Period = 1
+	if l := c.Changes(n); !reflect.DeepEqual(l, []string{"power", "schedule", "mqtt"}) {
+		t.Errorf("got changes %v", l)
+	}
+
+	// Leaving an accelerated simulator needs a restart to leave its clock
+	sim := c.clone()
+	sim.PulseSource = SourceSimulator
+	sim.SimSpeed = 60
+	n = sim.clone()
+	n.PulseSource = SourceSensor
+	if l := sim.Changes(n); !reflect.DeepEqual(l, []string{"sensor", "clock"}) {
+		t.Errorf("got changes %v leaving the simulator", l)
+	}
+
+	// An accelerated replay runs on a faster clock
+	n = c.clone()
+	n.PulseSource = SourceReplay
+	n.ReplaySpeed = 60
+	if l := c.Changes(n); !reflect.DeepEqual(l, []string{"sensor", "clock"}) {
+		t.Errorf("got changes %v for an accelerated replay", l)
+	}
+}
+
+// TestConfigSecrets checks that secrets are redacted and kept when the redacted value is sent back
+func TestConfigSecrets(t *testing.T) {
+	c := &Config{MqttPassword: "secret", EmoncmsAPIKey: "key"}
+	c.SetDefaults()
+	r := c.Redacted()
+	if r.MqttPassword != redacted || r.EmoncmsAPIKey != redacted {
+		t.Errorf("secrets were not redacted %q %q", r.MqttPassword, r.EmoncmsAPIKey)
+	}
+	if c.MqttPassword != "secret" {
+		t.Error("redacting changed the configuration")
+	}
+
+	r.EmoncmsAPIKey = "newkey"
+	r.KeepSecrets(c)
+	if r.MqttPassword != "secret" || r.EmoncmsAPIKey != "newkey" {
+		t.Errorf("got secrets %q %q", r.MqttPassword, r.EmoncmsAPIKey)
+	}
+}
+
+// TestSecretFlags checks that the secret flags only take a reference to the secret
+func TestSecretFlags(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("MQTT_SECRET", "from-env")
+	values := map[string]string{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	AddConfigFlags(fs, values)
+	if err := fs.Parse([]string{"-mqtt-password", "secret"}); err == nil {
+		t.Error("a secret was accepted on the command line")
+	}
+	if err := fs.Parse([]string{"-mqtt-password", "env:MQTT_SECRET", "-period", "10"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig("config.json", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MqttPassword != "from-env" || c.Period != 10 {
+		t.Errorf("got password %q and period %d", c.MqttPassword, c.Period)
+	}
+}
+
+// TestConfigOverrides checks that the environment variables and flags override the file
+func TestConfigOverrides(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("config.json", []byte(`{"flashRate":800,"period":10}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("POWER_PERIOD", "15")
+	c, err := LoadConfig("config.json", map[string]string{"flashRate": "1200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.FlashRate != 1200 || c.Period != 15 {
+		t.Errorf("got flashRate %d and period %d", c.FlashRate, c.Period)
+	}
+
+	sources := map[string]string{}
+	for _, s := range c.Sources() {
+		sources[s.Field] = s.Source
+	}
+	if sources["flashRate"] != SourceFlag || sources["period"] != SourceEnv || sources["maxLoad"] != SourceDefault {
+		t.Errorf("got sources %v", sources)
+	}
+
+	if _, err := LoadConfig("config.json", map[string]string{"flashRate": "many"}); err == nil {
+		t.Error("invalid flag value was accepted")
+	}
+}
+
+// TestConfigConcurrentChanges checks that the configuration can be changed while it is read
+func TestConfigConcurrentChanges(t *testing.T) {
+	s, _ := newTestServer(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			n := s.GetConfig().clone()
+			n.AlertBalance = float64(i)
+			s.ApplyConfig(n)
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := s.UpdateConfigFile(func(c *Config) error {
+				c.MaxLoad = float64(10000 + i)
+				return nil
+			}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	for i := 0; i < 100; i++ {
+		s.Power.checkBalance(float64(i))
+		if c := s.GetConfig(); c.FlashRate != 1000 {
+			t.Fatalf("flash rate is %d", c.FlashRate)
+		}
+	}
+	wg.Wait()
+
+	c := &Config{}
+	if err := c.ReadFromFile("config.json"); err != nil || c.MaxLoad < 10000 {
+		t.Errorf("configuration file has max load %v. %v", c.MaxLoad, err)
+	}
+}
+
+// TestLoadInvalidConfig checks that the service does not start with an invalid configuration
+func TestLoadInvalidConfig(t *testing.T) {
+	t.Chdir(t.TempDir())
+	s := &Server{ConfigPath: "config.json"}
+	if err := s.loadConfig(); err != nil {
+		t.Fatalf("default configuration was not loaded. %v", err)
+	}
+
+	for _, b := range []string{`{"flashRate":-1}`, `{"period":-5,"maxLoad":-1}`, `{"flashRate":`} {
+		if err := os.WriteFile("config.json", []byte(b), 0600); err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{ConfigPath: "config.json"}
+		if err := s.loadConfig(); err == nil {
+			t.Errorf("configuration %s was loaded", b)
+		}
+		if s.GetConfig() != nil {
+			t.Errorf("configuration %s was made active", b)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// configSchema is the JSON Schema of the configuration file
+//
+//go:embed config.schema.json
+var configSchema []byte
+
+// ConfigController handles the Web Methods for reading and updating the configuration.
+type ConfigController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *ConfigController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/config").Name("GetConfig").
+		Handler(Logger(c, Authorize(s, RoleRead, http.HandlerFunc(c.handleGetConfig))))
+	router.Methods("GET").Path("/config/schema").Name("GetConfigSchema").
+		Handler(Logger(c, Authorize(s, RoleRead, http.HandlerFunc(c.handleGetConfigSchema))))
+	router.Methods("PUT").Path("/config").Name("ReplaceConfig").
+		Handler(Logger(c, Authorize(s, RoleAdmin, http.HandlerFunc(c.handleReplaceConfig))))
+	router.Methods("PATCH").Path("/config").Name("UpdateConfig").
+		Handler(Logger(c, Authorize(s, RoleAdmin, http.HandlerFunc(c.handleUpdateConfig))))
+}
+
+// handleGetConfig will return the current configuration, with the secrets redacted.
+// With the sources query parameter, e.g. /config?sources, it returns the effective
+// value and source of each field instead.
+func (c *ConfigController) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.URL.Query()["sources"]; ok {
+		c.writeSources(w)
+		return
+	}
+	if err := c.Srv.GetConfig().Redacted().WriteTo(w); err != nil {
+		c.LogError("Error serializing config.", err.Error())
+		http.Error(w, "Error serializing config", http.StatusInternalServerError)
+	}
+}
+
+// handleGetConfigSchema will return the JSON Schema of the configuration file
+func (c *ConfigController) handleGetConfigSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/schema+json")
+	w.Write(configSchema)
+}
+
+// writeSources returns the effective value and source of each configuration field, with the secrets redacted
+func (c *ConfigController) writeSources(w http.ResponseWriter) {
+	b, err := json.Marshal(c.Srv.GetConfig().Sources())
+	if err != nil {
+		c.LogError("Error serializing config sources.", err.Error())
+		http.Error(w, "Error serializing config sources", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+}
+
+// handleReplaceConfig will replace the configuration with the one supplied
+func (c *ConfigController) handleReplaceConfig(w http.ResponseWriter, r *http.Request) {
+	c.updateConfig(w, r, false)
+}
+
+// handleUpdateConfig will update the configuration with the values supplied
+func (c *ConfigController) handleUpdateConfig(w http.ResponseWriter, r *http.Request) {
+	c.updateConfig(w, r, true)
+}
+
+// updateConfig reads the configuration values from the request, either replacing or
+// updating the configuration file values, validates it and, if valid, saves and applies it.
+// The environment variable and command line flag overrides are never written to the file.
+func (c *ConfigController) updateConfig(w http.ResponseWriter, r *http.Request, update bool) {
+	var reqErr error
+	nc, err := c.Srv.UpdateConfigFile(func(fc *Config) error {
+		prev := fc.clone()
+		if !update {
+			*fc = Config{}
+		}
+		if reqErr = fc.ReadFrom(r.Body); reqErr != nil {
+			return reqErr
+		}
+		fc.KeepSecrets(prev)
+		return nil
+	})
+	if reqErr != nil {
+		http.Error(w, "Invalid configuration. "+reqErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := err.(ConfigErrors); ok {
+		c.writeErrors(w, err)
+		return
+	}
+	if err != nil {
+		c.LogError("Error updating config.", err.Error())
+		http.Error(w, "Error updating config", http.StatusInternalServerError)
+		return
+	}
+	c.LogInfo("Configuration updated")
+
+	if err := nc.Redacted().WriteTo(w); err != nil {
+		c.LogError("Error serializing config.", err.Error())
+		http.Error(w, "Error serializing config", http.StatusInternalServerError)
+	}
+}
+
+// writeErrors returns the validation errors to the client
+func (c *ConfigController) writeErrors(w http.ResponseWriter, err error) {
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		http.Error(w, "Invalid configuration. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(map[string]interface{}{"errors": errs})
+	if err != nil {
+		http.Error(w, "Error serializing errors", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(b)
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *ConfigController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("ConfigController", a)
+}
+
+// LogError is used to log error messages for this controller.
+func (c *ConfigController) LogError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("ConfigController", a)
+}
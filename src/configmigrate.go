@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// configVersion is the current version of the configuration file layout.
+// Files without a version are version 1.
+const configVersion = 2
+
+// configMigrations upgrade the configuration file layout, one version at a time.
+// The migration at index i upgrades version i+1 to version i+2.
+var configMigrations = []func(m map[string]interface{}) error{
+	migrateMqttHostScheme, // 1 -> 2
+}
+
+// migrateConfig upgrades the configuration JSON to the current layout.
+// It returns the upgraded JSON and the version it was upgraded from.
+func migrateConfig(b []byte) ([]byte, int, error) {
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return b, 0, err
+	}
+	from := 1
+	if v, ok := m["version"].(float64); ok {
+		from = int(v)
+	}
+	if from >= configVersion {
+		return b, from, nil
+	}
+	for v := from; v < configVersion; v++ {
+		if v < 1 {
+			continue
+		}
+		if err := configMigrations[v-1](m); err != nil {
+			return b, from, fmt.Errorf("error upgrading configuration from version %d. %s", v, err.Error())
+		}
+	}
+	m["version"] = configVersion
+	nb, err := json.Marshal(m)
+	if err != nil {
+		return b, from, err
+	}
+	return nb, from, nil
+}
+
+// MigrateConfigFile upgrades the configuration file to the current layout, if required.
+// The original file is kept as a backup, named after its version.
+// It returns the version the file was upgraded from, or 0 if it was not upgraded.
+func MigrateConfigFile(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	nb, from, err := migrateConfig(b)
+	if err != nil || from >= configVersion {
+		return 0, err
+	}
+	bak := fmt.Sprintf("%s.v%d.bak", path, from)
+	if err := ioutil.WriteFile(bak, b, 0600); err != nil {
+		return 0, fmt.Errorf("error backing up configuration to %s. %s", bak, err.Error())
+	}
+	if err := ioutil.WriteFile(path, nb, 0600); err != nil {
+		return 0, err
+	}
+	return from, nil
+}
+
+// migrateMqttHostScheme adds the tcp scheme to MQTT hosts configured as host:port,
+// which the MQTT client used to accept
+func migrateMqttHostScheme(m map[string]interface{}) error {
+	h, ok := m["mqttHost"].(string)
+	if ok && h != "" && !strings.Contains(h, "://") {
+		if strings.HasPrefix(h, ":") {
+			h = "127.0.0.1" + h
+		}
+		m["mqttHost"] = "tcp://" + h
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Prefixes of the secret references. A secret value can be read from a file,
+// such as a Docker secret or systemd credential, or an environment variable:
+//
+//	"mqttPassword": "file:/run/secrets/mqtt_password"
+//	"mqttPassword": "file:mqtt_password" (relative to $CREDENTIALS_DIRECTORY)
+//	"mqttPassword": "env:MQTT_PASSWORD"
+const (
+	secretFile = "file:" // Secret is read from a file
+	secretEnv  = "env:"  // Secret is read from an environment variable
+)
+
+// resolveSecrets replaces the secret references with the secret values.
+// References that cannot be resolved are reported by Validate.
+func (c *Config) resolveSecrets() {
+	for n, v := range c.secrets() {
+		ref := *v
+		var s string
+		var err error
+		switch {
+		case strings.HasPrefix(ref, secretFile):
+			s, err = readSecretFile(strings.TrimPrefix(ref, secretFile))
+		case strings.HasPrefix(ref, secretEnv):
+			env := strings.TrimPrefix(ref, secretEnv)
+			var ok bool
+			if s, ok = os.LookupEnv(env); !ok {
+				err = fmt.Errorf("environment variable %s is not set", env)
+			}
+		default:
+			continue
+		}
+		c.setSecretRef(n, ref)
+		if c.secretErrs != nil {
+			delete(c.secretErrs, n)
+		}
+		if err != nil {
+			if c.secretErrs == nil {
+				c.secretErrs = map[string]string{}
+			}
+			c.secretErrs[n] = err.Error()
+		}
+		*v = s
+	}
+}
+
+// checkClientSecrets returns an error if a secret sent by a client is a reference, as resolving
+// it would send the file or environment variable to the client or an upload server.
+// The references of the secrets that the client changed are removed.
+func (c *Config) checkClientSecrets(prev *Config) error {
+	p := prev.secrets()
+	for n, v := range c.secrets() {
+		if strings.HasPrefix(*v, secretFile) || strings.HasPrefix(*v, secretEnv) {
+			return fmt.Errorf("%s can only be set to a file: or env: reference in the configuration file or on the command line", n)
+		}
+		if pv, ok := p[n]; !ok || *pv != *v {
+			c.clearSecretRef(n)
+		}
+	}
+	return nil
+}
+
+// readSecretFile reads the secret from the file. Relative paths are read from the
+// systemd credentials directory, if there is one.
+func readSecretFile(path string) (string, error) {
+	if d := os.Getenv("CREDENTIALS_DIRECTORY"); d != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(d, path)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read secret file. %s", err.Error())
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// setSecretRef records the reference the secret was read from
+func (c *Config) setSecretRef(name string, ref string) {
+	if c.secretRefs == nil {
+		c.secretRefs = map[string]string{}
+	}
+	c.secretRefs[name] = ref
+}
+
+// clearSecretRef removes the reference of a secret that has been set directly
+func (c *Config) clearSecretRef(name string) {
+	delete(c.secretRefs, name)
+	delete(c.secretErrs, name)
+}
+
+// withSecretRefs returns a copy of the configuration with the secrets
+// read from a reference replaced with the reference
+func (c *Config) withSecretRefs() *Config {
+	r := c.clone()
+	s := r.secrets()
+	for n, ref := range r.secretRefs {
+		if v, ok := s[n]; ok {
+			*v = ref
+		}
+	}
+	return r
+}
+
+// SecretValues returns the secret values that are configured
+func (c *Config) SecretValues() []string {
+	l := []string{}
+	for _, v := range c.secrets() {
+		if *v != "" {
+			l = append(l, *v)
+		}
+	}
+	return l
+}
+
+// clone returns a copy of the configuration
+func (c *Config) clone() *Config {
+	n := *c
+	n.APIKeys = append([]APIKey(nil), c.APIKeys...)
+	n.Users = append([]APIUser(nil), c.Users...)
+	n.LogLevels = copyMap(c.LogLevels)
+	n.sources = copyMap(c.sources)
+	n.secretRefs = copyMap(c.secretRefs)
+	n.secretErrs = copyMap(c.secretErrs)
+	return &n
+}
+
+// copyMap returns a copy of the map
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	n := make(map[string]string, len(m))
+	for k, v := range m {
+		n[k] = v
+	}
+	return n
+}
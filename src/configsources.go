@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Sources of the configuration values, in order of precedence
+const (
+	SourceDefault = "default" // Default value
+	SourceFile    = "file"    // Configuration file
+	SourceEnv     = "env"     // POWER_* environment variable
+	SourceFlag    = "flag"    // Command line flag
+)
+
+// ConfigSource describes the effective value of a configuration field and where it came from
+type ConfigSource struct {
+	Field  string      `json:"field"`  // Name of the field in the configuration file
+	Value  interface{} `json:"value"`  // Effective value
+	Source string      `json:"source"` // Source of the value
+	Env    string      `json:"env"`    // Environment variable that overrides the field
+	Flag   string      `json:"flag"`   // Command line flag that overrides the field
+}
+
+// configField describes a configuration field that can be overridden
+type configField struct {
+	Name  string // Name of the field in the configuration file
+	Env   string // Environment variable name
+	Flag  string // Command line flag name
+	index int    // Index of the field in the Config struct
+}
+
+// configFields returns the overridable configuration fields.
+// Lists and maps, such as the API keys, can only be set in the file.
+func configFields() []configField {
+	l := []configField{}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		n := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if n == "" || n == "-" || n == "version" {
+			continue
+		}
+		if k := t.Field(i).Type.Kind(); k == reflect.Slice || k == reflect.Map {
+			continue
+		}
+		w := splitWords(n)
+		l = append(l, configField{
+			Name:  n,
+			Env:   "POWER_" + strings.ToUpper(strings.Join(w, "_")),
+			Flag:  strings.ToLower(strings.Join(w, "-")),
+			index: i,
+		})
+	}
+	return l
+}
+
+// splitWords splits a camel case name into words
+func splitWords(n string) []string {
+	l := []string{}
+	r := []rune(n)
+	s := 0
+	for i := 1; i < len(r); i++ {
+		if unicode.IsUpper(r[i]) && !unicode.IsUpper(r[i-1]) {
+			l = append(l, string(r[s:i]))
+			s = i
+		}
+	}
+	return append(l, string(r[s:]))
+}
+
+// LoadConfig reads the configuration file and applies the environment
+// variable and command line flag overrides
+func LoadConfig(path string, flags map[string]string) (*Config, error) {
+	c := &Config{}
+	if err := c.ReadFromFile(path); err != nil {
+		return nil, err
+	}
+	return c.WithOverrides(flags)
+}
+
+// AddConfigFlags defines a command line flag for each configuration field.
+// The values of the flags that are set are added to the values map, keyed by field name.
+// The command line can be seen by other users, so the secret flags only take a reference.
+func AddConfigFlags(fs *flag.FlagSet, values map[string]string) {
+	secrets := (&Config{}).secrets()
+	for _, f := range configFields() {
+		n := f.Name
+		_, secret := secrets[n]
+		usage := fmt.Sprintf("Overrides the '%s' configuration value.", n)
+		if secret {
+			usage = fmt.Sprintf("Overrides the '%s' configuration value with a reference to the secret, either file:<path> or env:<variable>.", n)
+		}
+		fs.Func(f.Flag, usage, func(v string) error {
+			if secret && !strings.HasPrefix(v, secretFile) && !strings.HasPrefix(v, secretEnv) {
+				return fmt.Errorf("only a file: or env: reference to the secret can be set on the command line")
+			}
+			values[n] = v
+			return nil
+		})
+	}
+}
+
+// WithOverrides returns a copy of the configuration with the POWER_* environment
+// variables and then the command line flag values applied
+func (c *Config) WithOverrides(flags map[string]string) (*Config, error) {
+	n := c.clone()
+
+	env := map[string]string{}
+	for _, f := range configFields() {
+		if v, ok := os.LookupEnv(f.Env); ok {
+			env[f.Name] = v
+		}
+	}
+	if err := n.applyOverrides(env, SourceEnv); err != nil {
+		return nil, err
+	}
+	if err := n.applyOverrides(flags, SourceFlag); err != nil {
+		return nil, err
+	}
+	n.resolveSecrets()
+	return n, nil
+}
+
+// applyOverrides sets the field values, keyed by field name, from the specified source
+func (c *Config) applyOverrides(values map[string]string, source string) error {
+	e := ConfigErrors{}
+	v := reflect.ValueOf(c).Elem()
+	for _, f := range configFields() {
+		s, ok := values[f.Name]
+		if !ok {
+			continue
+		}
+		fv := v.Field(f.index)
+		var err error
+		switch fv.Kind() {
+		case reflect.String:
+			fv.SetString(s)
+		case reflect.Bool:
+			var b bool
+			if b, err = strconv.ParseBool(s); err == nil {
+				fv.SetBool(b)
+			}
+		case reflect.Int, reflect.Int64:
+			var i int64
+			if i, err = strconv.ParseInt(s, 10, 64); err == nil {
+				fv.SetInt(i)
+			}
+		case reflect.Float64:
+			var fl float64
+			if fl, err = strconv.ParseFloat(s, 64); err == nil {
+				fv.SetFloat(fl)
+			}
+		default:
+			err = fmt.Errorf("cannot be overridden")
+		}
+		if err != nil {
+			name := f.Env
+			if source == SourceFlag {
+				name = "-" + f.Flag
+			}
+			e.add(f.Name, "invalid value '%s' in %s", s, name)
+			continue
+		}
+		c.setSource(f.Name, source)
+		c.clearSecretRef(f.Name)
+	}
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// markFileSources records the fields present in the JSON as coming from the file
+func (c *Config) markFileSources(b []byte) {
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return
+	}
+	for k := range m {
+		c.setSource(k, SourceFile)
+	}
+}
+
+// setSource records the source of the field value
+func (c *Config) setSource(name string, source string) {
+	if c.sources == nil {
+		c.sources = map[string]string{}
+	}
+	c.sources[name] = source
+}
+
+// Sources returns the effective value and its source for each field, with the secrets redacted
+func (c *Config) Sources() []ConfigSource {
+	l := []ConfigSource{}
+	v := reflect.ValueOf(c.Redacted()).Elem()
+	for _, f := range configFields() {
+		s := c.sources[f.Name]
+		if s == "" {
+			s = SourceDefault
+		}
+		l = append(l, ConfigSource{
+			Field:  f.Name,
+			Value:  v.Field(f.index).Interface(),
+			Source: s,
+			Env:    f.Env,
+			Flag:   "-" + f.Flag,
+		})
+	}
+	return l
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ConfigWatcher reloads the configuration when the configuration file
+// changes or a SIGHUP signal is received
+type ConfigWatcher struct {
+	Srv     *Server           // Server instance
+	watcher *fsnotify.Watcher // File system watcher
+	signals chan os.Signal    // SIGHUP signals
+	done    chan struct{}     // Closed to stop watching
+}
+
+// Start starts watching the configuration file and listening for SIGHUP
+func (w *ConfigWatcher) Start() error {
+	w.done = make(chan struct{})
+	w.signals = make(chan os.Signal, 1)
+	signal.Notify(w.signals, syscall.SIGHUP)
+
+	// Watch the directory rather than the file, as editors usually replace the
+	// file when saving, which would end a watch on the file itself
+	path, err := filepath.Abs(w.Srv.ConfigPath)
+	if err != nil {
+		return err
+	}
+	w.watcher, err = fsnotify.NewWatcher()
+	if err == nil {
+		err = w.watcher.Add(filepath.Dir(path))
+	}
+	if err != nil {
+		w.logError("Error watching ", path, ". Only SIGHUP will reload the configuration. ", err.Error())
+	}
+
+	go w.run(path)
+	return nil
+}
+
+// Stop stops watching for configuration changes
+func (w *ConfigWatcher) Stop() {
+	if w.done == nil {
+		return
+	}
+	signal.Stop(w.signals)
+	close(w.done)
+	if w.watcher != nil {
+		w.watcher.Close()
+	}
+}
+
+// run waits for changes and reloads the configuration. File changes are
+// delayed slightly, so that a file that is written in parts is only read once.
+func (w *ConfigWatcher) run(path string) {
+	var events chan fsnotify.Event
+	var errs chan error
+	if w.watcher != nil {
+		events = w.watcher.Events
+		errs = w.watcher.Errors
+	}
+	delay := time.NewTimer(time.Hour)
+	delay.Stop()
+	for {
+		select {
+		case <-w.done:
+			delay.Stop()
+			return
+		case <-w.signals:
+			w.logInfo("SIGHUP received")
+			w.Srv.ReloadConfig()
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Clean(e.Name) == path && e.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				delay.Reset(500 * time.Millisecond)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			w.logError("Error watching configuration file.", err.Error())
+		case <-delay.C:
+			w.logInfo("Configuration file changed")
+			w.Srv.ReloadConfig()
+		}
+	}
+}
+
+// logInfo logs an information message to the logger
+func (w *ConfigWatcher) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("ConfigWatcher", a)
+}
+
+// logError logs an error message to the logger
+func (w *ConfigWatcher) logError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("ConfigWatcher", a)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPowerControllerTopUp checks the top-up and meter reading methods
+func TestPowerControllerTopUp(t *testing.T) {
+	s, _ := newTestServer(t)
+	ts := newTestHTTP(t, s)
+	s.Power.SetReading(10)
+	for _, pt := range pulsesEvery(testStart, time.Minute, 250) {
+		s.Power.recordPulse(pt)
+	}
+
+	code, body := doRequest(t, "POST", ts.URL+"/power/topup", `{"units":20}`)
+	if code != http.StatusOK {
+		t.Fatalf("top-up returned %d %s", code, body)
+	}
+	rep := PowerReport{}
+	if err := json.Unmarshal([]byte(body), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if !closeEnough(rep.CurrentPower, 29.75) || rep.PulseCount != 250 {
+		t.Errorf("power after the top-up is %+v", rep)
+	}
+	if _, err := os.Stat("power.dat"); err != nil {
+		t.Errorf("balance was not saved. %v", err)
+	}
+
+	for _, req := range []string{`{"units":0}`, `{"units":-5}`, `units`} {
+		if code, body := doRequest(t, "POST", ts.URL+"/power/topup", req); code != http.StatusBadRequest {
+			t.Errorf("top-up of %s returned %d %s", req, code, body)
+		}
+	}
+	if code, _ := doRequest(t, "POST", ts.URL+"/power/reading", `{"units":-1}`); code != http.StatusBadRequest {
+		t.Errorf("negative reading returned %d", code)
+	}
+	if code, body := doRequest(t, "POST", ts.URL+"/power/reading", `{"units":55.5}`); code != http.StatusOK || !strings.Contains(body, `"currentPower":55.5`) {
+		t.Errorf("reading returned %d %s", code, body)
+	}
+	if got := s.Power.GetCurrentPower(); got != 55.5 {
+		t.Errorf("balance is %v after the reading, want 55.5", got)
+	}
+}
+
+// TestPowerControllerHistory checks the history and forecast methods
+func TestPowerControllerHistory(t *testing.T) {
+	s, clock := newTestServer(t)
+	ts := newTestHTTP(t, s)
+	s.Power.SetReading(10)
+	for _, pt := range pulsesEvery(testStart, time.Minute, 120) {
+		s.Power.recordPulse(pt)
+	}
+	clock.Set(testStart.Add(2 * time.Hour))
+	s.Power.TopUp(5)
+
+	code, body := doRequest(t, "GET", ts.URL+"/power/history", "")
+	if code != http.StatusOK {
+		t.Fatalf("history returned %d %s", code, body)
+	}
+	rep := HistoryReport{}
+	if err := json.Unmarshal([]byte(body), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if !closeEnough(rep.Today[9].Units, 0.059) || !closeEnough(rep.Today[10].Units, 0.060) || !closeEnough(rep.Today[11].Units, 0.001) {
+		t.Errorf("hourly consumption is %v", rep.Today[9:12])
+	}
+	if len(rep.TopUps) != 1 || rep.TopUps[0].Units != 5 {
+		t.Errorf("top-ups are %v", rep.TopUps)
+	}
+
+	code, body = doRequest(t, "GET", ts.URL+"/power/forecast", "")
+	f := Forecast{}
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &f) != nil {
+		t.Fatalf("forecast returned %d %s", code, body)
+	}
+	if !closeEnough(f.Balance, 14.88) || f.DailyAverage != 1.44 {
+		t.Errorf("forecast is %+v", f)
+	}
+
+	code, body = doRequest(t, "GET", ts.URL+"/power/filter", "")
+	if code != http.StatusOK || !strings.Contains(body, `"accepted":120`) {
+		t.Errorf("filter returned %d %s", code, body)
+	}
+}
+
+// TestConfigController checks that the configuration is returned without the secrets
+// and that updates are validated, saved and applied
+func TestConfigController(t *testing.T) {
+	s, _ := newTestServer(t)
+	ts := newTestHTTP(t, s)
+	s.GetConfig().MqttPassword = "secret"
+	if err := s.GetConfig().WriteToFile("config.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := doRequest(t, "GET", ts.URL+"/config", "")
+	if code != http.StatusOK || strings.Contains(body, "secret") || !strings.Contains(body, `"mqttPassword":"********"`) {
+		t.Errorf("config returned %d %s", code, body)
+	}
+
+	code, body = doRequest(t, "PATCH", ts.URL+"/config", `{"flashRate":800,"mqttPassword":"********"}`)
+	if code != http.StatusOK {
+		t.Fatalf("update returned %d %s", code, body)
+	}
+	if s.GetConfig().FlashRate != 800 || s.Power.FlashRate != 800 {
+		t.Errorf("flash rate was not applied, config %d, power %d", s.GetConfig().FlashRate, s.Power.FlashRate)
+	}
+	c := &Config{}
+	if err := c.ReadFromFile("config.json"); err != nil {
+		t.Fatal(err)
+	}
+	if c.FlashRate != 800 || c.MqttPassword != "secret" {
+		t.Errorf("saved flash rate %d and password %q", c.FlashRate, c.MqttPassword)
+	}
+
+	code, body = doRequest(t, "PATCH", ts.URL+"/config", `{"flashRate":0,"period":-1}`)
+	if code != http.StatusBadRequest || !strings.Contains(body, `"field":"period"`) {
+		t.Errorf("invalid update returned %d %s", code, body)
+	}
+	if s.GetConfig().Period != 5 {
+		t.Errorf("invalid update was applied")
+	}
+
+	code, body = doRequest(t, "GET", ts.URL+"/config?sources", "")
+	if code != http.StatusOK || !strings.Contains(body, `{"field":"flashRate","value":800,"source":"file"`) ||
+		strings.Contains(body, "secret") || !strings.Contains(body, `{"field":"mqttPassword","value":"********","source":"file"`) {
+		t.Errorf("sources returned %d %s", code, body)
+	}
+}
+
+// TestConfigControllerSecretRefs checks that a client cannot set a secret to a file or
+// environment variable reference, and that a secret it sets replaces the reference in the file
+func TestConfigControllerSecretRefs(t *testing.T) {
+	s, _ := newTestServer(t)
+	ts := newTestHTTP(t, s)
+	t.Setenv("POWER_TEST_SECRET", "from-env")
+	if err := os.WriteFile("secret", []byte("from-file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("config.json", []byte(`{"mqttPassword":"env:POWER_TEST_SECRET"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.ReloadConfig()
+
+	for _, req := range []string{`{"emoncmsApiKey":"file:secret","emoncmsUrl":"http://localhost"}`, `{"pvOutputApiKey":"env:POWER_TEST_SECRET"}`} {
+		if code, body := doRequest(t, "PATCH", ts.URL+"/config", req); code != http.StatusBadRequest {
+			t.Errorf("update %s returned %d %s", req, code, body)
+		}
+	}
+	if c := s.GetConfig(); c.EmoncmsAPIKey != "" || c.PVOutputAPIKey != "" || c.MqttPassword != "from-env" {
+		t.Errorf("secrets are %q %q %q", c.EmoncmsAPIKey, c.PVOutputAPIKey, c.MqttPassword)
+	}
+
+	if code, body := doRequest(t, "PATCH", ts.URL+"/config", `{"mqttPassword":"new"}`); code != http.StatusOK {
+		t.Fatalf("update returned %d %s", code, body)
+	}
+	b, err := os.ReadFile("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"mqttPassword":"new"`) || s.GetConfig().MqttPassword != "new" {
+		t.Errorf("saved config is %s", b)
+	}
+}
+
+// TestAuthorization checks that the API keys restrict access by role
+func TestAuthorization(t *testing.T) {
+	s, _ := newTestServer(t)
+	ts := newTestHTTP(t, s)
+	s.GetConfig().APIKeys = []APIKey{
+		{Name: "dashboard", Key: hashAPIKey("read-key"), Role: RoleRead},
+		{Name: "admin", Key: hashAPIKey("admin-key"), Role: RoleAdmin},
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		header []string
+		code   int
+	}{
+		{"GET", "/power/get", nil, http.StatusUnauthorized},
+		{"GET", "/power/get", []string{"X-API-Key", "wrong"}, http.StatusUnauthorized},
+		{"GET", "/power/get", []string{"X-API-Key", "read-key"}, http.StatusOK},
+		{"GET", "/power/get?apikey=read-key", nil, http.StatusOK},
+		{"POST", "/power/topup", []string{"X-API-Key", "read-key"}, http.StatusForbidden},
+		{"POST", "/power/topup", []string{"Authorization", "Bearer admin-key"}, http.StatusOK},
+		{"GET", "/log/get", []string{"X-API-Key", "read-key"}, http.StatusForbidden},
+		{"GET", "/health", nil, http.StatusServiceUnavailable}, // Not restricted, but the pulse source is not running
+	}
+	for _, tt := range tests {
+		code, body := doRequest(t, tt.method, ts.URL+tt.path, `{"units":1}`, tt.header...)
+		if code != tt.code {
+			t.Errorf("%s %s %v returned %d %s, want %d", tt.method, tt.path, tt.header, code, body, tt.code)
+		}
+	}
+}
+
+// TestAuthorizationCrossSite checks that a page on another site cannot change the service
+// with the basic auth credentials cached by the browser
+func TestAuthorizationCrossSite(t *testing.T) {
+	s, _ := newTestServer(t)
+	ts := newTestHTTP(t, s)
+	s.GetConfig().Users = []APIUser{{Username: "admin", Password: "secret", Role: RoleAdmin}}
+	s.Power.SetReading(10)
+	auth := "Basic YWRtaW46c2VjcmV0" // admin:secret
+
+	tests := []struct {
+		method string
+		path   string
+		header []string
+		code   int
+	}{
+		{"POST", "/power/topup", []string{"Authorization", auth, "Content-Type", "text/plain"}, http.StatusUnsupportedMediaType},
+		{"POST", "/power/reading", []string{"Authorization", auth, "Content-Type", "application/x-www-form-urlencoded"}, http.StatusUnsupportedMediaType},
+		{"POST", "/calibrate/apply", []string{"Authorization", auth, "Content-Type", ""}, http.StatusUnsupportedMediaType},
+		{"POST", "/power/topup", []string{"Authorization", auth, "Sec-Fetch-Site", "cross-site"}, http.StatusForbidden},
+		{"GET", "/power/get", []string{"Authorization", auth, "Sec-Fetch-Site", "cross-site", "Content-Type", "text/plain"}, http.StatusOK},
+		{"POST", "/power/topup", []string{"Authorization", auth, "Content-Type", "application/json; charset=utf-8", "Sec-Fetch-Site", "same-origin"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		code, body := doRequest(t, tt.method, ts.URL+tt.path, `{"units":1}`, tt.header...)
+		if code != tt.code {
+			t.Errorf("%s %s %v returned %d %s, want %d", tt.method, tt.path, tt.header, code, body, tt.code)
+		}
+	}
+	if got := s.Power.GetCurrentPower(); got != 11 {
+		t.Errorf("balance is %v, want 11 from the one same-site top-up", got)
+	}
+}
+
+// TestAuthorizationChanges checks that removing an API key takes effect while requests are being served
+func TestAuthorizationChanges(t *testing.T) {
+	s, _ := newTestServer(t)
+	ts := newTestHTTP(t, s)
+	keys := func(names ...string) *Config {
+		c := s.GetConfig().clone()
+		c.APIKeys = nil
+		for _, n := range names {
+			c.APIKeys = append(c.APIKeys, APIKey{Name: n, Key: hashAPIKey(n + "-key"), Role: RoleRead})
+		}
+		return c
+	}
+	s.ApplyConfig(keys("kept", "removed"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			s.ApplyConfig(keys("kept", "removed"))
+			s.ApplyConfig(keys("kept"))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if code, body := doRequest(t, "GET", ts.URL+"/power/get", "", "X-API-Key", "kept-key"); code != http.StatusOK {
+			t.Fatalf("kept key returned %d %s", code, body)
+		}
+	}
+	<-done
+
+	if code, _ := doRequest(t, "GET", ts.URL+"/power/get", "", "X-API-Key", "removed-key"); code != http.StatusUnauthorized {
+		t.Errorf("removed key returned %d", code)
+	}
+}
+
+// TestHealthConfig checks that the health check does not expose the configuration errors
+func TestHealthConfig(t *testing.T) {
+	s, _ := newTestServer(t)
+	ts := newTestHTTP(t, s)
+	c := s.GetConfig().clone()
+	c.TLSCertFile = "/private/power/cert.pem"
+	s.ApplyConfig(c)
+
+	_, body := doRequest(t, "GET", ts.URL+"/health", "")
+	rep := HealthReport{}
+	if err := json.Unmarshal([]byte(body), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if ch := rep.Checks["config"]; ch.Status != HealthDegraded || ch.Message != "configuration is not valid" {
+		t.Errorf("config check is %+v", ch)
+	}
+	if strings.Contains(body, "/private/power") {
+		t.Errorf("health report exposes the configuration %s", body)
+	}
+}
+
+// TestHealthController checks that the service is only ready once the pulse source is running
+func TestHealthController(t *testing.T) {
+	s, _ := newTestServer(t)
+	ts := newTestHTTP(t, s)
+
+	if code, body := doRequest(t, "GET", ts.URL+"/ready", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("ready returned %d %s before starting", code, body)
+	}
+
+	s.PulseSource.Source = &fakeSource{}
+	s.PulseSource.Start()
+	s.ready.Store(true)
+	waitFor(t, "the pulse source", func() bool { return s.PulseSource.GetStatus().Running })
+
+	code, body := doRequest(t, "GET", ts.URL+"/ready", "")
+	if code != http.StatusOK {
+		t.Errorf("ready returned %d %s", code, body)
+	}
+	rep := HealthReport{}
+	if err := json.Unmarshal([]byte(body), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Ready || rep.Checks["pulseSource"].Status != HealthOK {
+		t.Errorf("health report is %+v", rep)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+//go:embed html
+var htmlFiles embed.FS
+
+// DashboardController serves the web dashboard embedded in the binary
+type DashboardController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *DashboardController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	assets, err := fs.Sub(htmlFiles, "html/assets")
+	if err != nil {
+		c.LogError("Error loading dashboard assets.", err.Error())
+		return
+	}
+	router.Methods("GET").PathPrefix("/assets/").Name("GetAssets").
+		Handler(http.StripPrefix("/assets/", http.FileServer(http.FS(assets))))
+	router.Methods("GET").Path("/").Name("GetDashboard").
+		Handler(Logger(c, Authorize(s, RoleRead, http.HandlerFunc(c.handleGetDashboard))))
+}
+
+// handleGetDashboard will return the dashboard page
+func (c *DashboardController) handleGetDashboard(w http.ResponseWriter, r *http.Request) {
+	b, err := htmlFiles.ReadFile("html/index.html")
+	if err != nil {
+		c.LogError("Error reading dashboard.", err.Error())
+		http.Error(w, "Error reading dashboard", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.Write(b)
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *DashboardController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("DashboardController", a)
+}
+
+// LogError is used to log error messages for this controller.
+func (c *DashboardController) LogError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("DashboardController", a)
+}
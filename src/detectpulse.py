@@ -1,16 +1,43 @@
 from gpiozero import LightSensor
 from time import sleep
+import argparse
+
+parser = argparse.ArgumentParser(description='Detect the meter pulses.')
+parser.add_argument('-n', default='19', type=int, help='The number of the GPIO pin of the light sensor.')
+parser.add_argument('-t', default='0.1', type=float, help='The light level, between 0 and 1, above which a pulse is detected.')
+args = parser.parse_args()
 
 pulseCount = 0
 
+# Light levels seen since they were last reported, used to tune the threshold
+levelLow = 1.0
+levelHigh = 0.0
+levelPulses = 0
+
 def lightPulse():
-    global pulseCount
+    global pulseCount, levelHigh, levelPulses
     pulseCount = pulseCount + 1
+    levelHigh = max(levelHigh, ldr.value)
+    levelPulses = levelPulses + 1
     print(pulseCount)
 
-ldr = LightSensor(19,queue_len=1)
+def lightOff():
+    # Reported so that a sensor stuck in the light can be detected
+    print('dark')
+
+ldr = LightSensor(args.n,queue_len=1)
 ldr.when_light = lightPulse
-ldr.threshold = 0.1
+ldr.when_dark = lightOff
+ldr.threshold = args.t
 
 while True:
-    sleep(1)
\ No newline at end of file
+    # Sample the light level and report the levels seen every 10 seconds
+    for i in range(100):
+        sleep(0.1)
+        v = ldr.value
+        levelLow = min(levelLow, v)
+        levelHigh = max(levelHigh, v)
+    print('levels %.3f %.3f %d' % (levelLow, levelHigh, levelPulses))
+    levelLow = 1.0
+    levelHigh = 0.0
+    levelPulses = 0
\ No newline at end of file
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSource is a pulse source that records the pulses at the specified times.
+// It then waits to be stopped, or reports that it has no more pulses if Done is set.
+type fakeSource struct {
+	Pulses []time.Time // Times of the pulses
+	Done   bool        // Signals that the source ends after the pulses
+}
+
+// Name returns the name of the pulse source
+func (f *fakeSource) Name() string {
+	return "fake"
+}
+
+// Run records the pulses
+func (f *fakeSource) Run(s *Supervisor, stop <-chan struct{}) error {
+	for _, t := range f.Pulses {
+		s.Srv.Power.recordPulse(t)
+	}
+	if f.Done {
+		return errSourceDone
+	}
+	<-stop
+	return nil
+}
+
+// fakeEmoncms is an emoncms input API that keeps the posted inputs
+type fakeEmoncms struct {
+	posts []url.Values
+	mu    sync.Mutex
+}
+
+// newFakeEmoncms starts an emoncms input API
+func newFakeEmoncms(t *testing.T) (*fakeEmoncms, *httptest.Server) {
+	e := &fakeEmoncms{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/input/post" || r.ParseForm() != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		e.mu.Lock()
+		e.posts = append(e.posts, r.PostForm)
+		e.mu.Unlock()
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(ts.Close)
+	return e, ts
+}
+
+// Posts returns the posted inputs
+func (e *fakeEmoncms) Posts() []url.Values {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]url.Values(nil), e.posts...)
+}
+
+// fakePVOutput is a PVOutput add-status API that keeps the posted statuses
+type fakePVOutput struct {
+	posts []url.Values
+	mu    sync.Mutex
+}
+
+// newFakePVOutput starts a PVOutput add-status API for the API key and system ID
+func newFakePVOutput(t *testing.T, key string, system string) (*fakePVOutput, *httptest.Server) {
+	p := &fakePVOutput{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Pvoutput-Apikey") != key || r.Header.Get("X-Pvoutput-SystemId") != system {
+			http.Error(w, "Unauthorized 401: Invalid API Key", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" || r.URL.Path != "/service/r2/addstatus.jsp" || r.ParseForm() != nil {
+			http.Error(w, "Bad request 400", http.StatusBadRequest)
+			return
+		}
+		p.mu.Lock()
+		p.posts = append(p.posts, r.PostForm)
+		p.mu.Unlock()
+		w.Write([]byte("OK 200: Added Status"))
+	}))
+	t.Cleanup(ts.Close)
+	return p, ts
+}
+
+// Posts returns the posted statuses
+func (p *fakePVOutput) Posts() []url.Values {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]url.Values(nil), p.posts...)
+}
+
+// newTelemetryServer returns a test server that publishes to the broker and emoncms
+func newTelemetryServer(t *testing.T) (*Server, *FakeClock, *fakeBroker, *fakeEmoncms) {
+	b := newFakeBroker(t, "power", "secret")
+	e, ets := newFakeEmoncms(t)
+	s, clock := newTestServer(t)
+	s.GetConfig().EnableMqtt = true
+	s.GetConfig().MqttHost = b.URL()
+	s.GetConfig().MqttUsername = "power"
+	s.GetConfig().MqttPassword = "secret"
+	s.GetConfig().EnableEmoncms = true
+	s.GetConfig().EmoncmsURL = ets.URL + "/"
+	s.GetConfig().EmoncmsAPIKey = "emoncms-key"
+	return s, clock, b, e
+}
+
+// TestEndToEndTelemetry drives an hour of pulses through to MQTT and emoncms
+func TestEndToEndTelemetry(t *testing.T) {
+	s, clock, b, e := newTelemetryServer(t)
+	s.Power.SetReading(20)
+
+	// 360 W for an hour
+	s.PulseSource.Source = &fakeSource{Pulses: pulsesEvery(testStart, 10*time.Second, 360), Done: true}
+	s.PulseSource.Start()
+	waitFor(t, "the pulses", func() bool { return s.PulseSource.GetStatus().State == SourceFinished })
+	clock.Set(testStart.Add(time.Hour))
+	s.Uploader.Run()
+
+	if l := b.WaitMessages(t, "home/power/current", 1); l[0].Payload != "19.640" {
+		t.Errorf("published balance %q, want 19.640", l[0].Payload)
+	}
+	posts := e.Posts()
+	if len(posts) != 1 {
+		t.Fatalf("%d posts to emoncms, want 1", len(posts))
+	}
+	p := posts[0]
+	if p.Get("apikey") != "emoncms-key" || p.Get("node") != "power" || p.Get("time") != fmt.Sprint(clock.Now().Unix()) {
+		t.Errorf("emoncms post is %v", p)
+	}
+	in := map[string]float64{}
+	if err := json.Unmarshal([]byte(p.Get("fulljson")), &in); err != nil {
+		t.Fatal(err)
+	}
+	if in["power"] != 360 || in["energy"] != 360 {
+		t.Errorf("emoncms inputs are %v, want 360 W and 360 Wh", in)
+	}
+
+	st := s.Uploader.GetStatus()
+	for _, n := range []string{"mqtt", "emoncms"} {
+		if !st[n].Enabled || !st[n].LastSuccess.Equal(clock.Now()) || st[n].LastError != "" {
+			t.Errorf("%s status is %+v", n, st[n])
+		}
+	}
+	if st["pvoutput"].Enabled {
+		t.Errorf("pvoutput status is %+v", st["pvoutput"])
+	}
+	if !s.Uploader.LastRun().Equal(clock.Now()) {
+		t.Errorf("last run is %v", s.Uploader.LastRun())
+	}
+
+	// The balance and history are saved for a restart
+	p2 := &Power{Srv: s, FlashRate: 1000}
+	if err := p2.LoadCurrentPower("power.dat"); err != nil || !closeEnough(p2.GetCurrentPower(), 19.64) {
+		t.Errorf("saved balance is %v. %v", p2.GetCurrentPower(), err)
+	}
+	h := &History{}
+	if err := h.ReadFromFile("history.json"); err != nil {
+		t.Fatal(err)
+	}
+	if d := h.GetDaily(clock.Now(), 1); !closeEnough(d[0].Units, 0.36) {
+		t.Errorf("saved history is %v", d)
+	}
+
+	// The next run reports the load since the last run
+	for _, pt := range pulsesEvery(clock.Now(), 36*time.Second, 50) {
+		s.Power.recordPulse(pt)
+	}
+	clock.Advance(30 * time.Minute)
+	s.Uploader.Run()
+	if l := b.WaitMessages(t, "home/power/current", 2); l[1].Payload != "19.590" {
+		t.Errorf("published balance %q, want 19.590", l[1].Payload)
+	}
+	posts = e.Posts()
+	if len(posts) != 2 || !strings.Contains(posts[1].Get("fulljson"), `"power":100`) {
+		t.Errorf("emoncms posts are %v", posts)
+	}
+
+	// Setting the reading between runs does not reset the energy or the load
+	s.Power.SetReading(50)
+	for _, pt := range pulsesEvery(clock.Now(), 36*time.Second, 50) {
+		s.Power.recordPulse(pt)
+	}
+	clock.Advance(30 * time.Minute)
+	s.Uploader.Run()
+	posts = e.Posts()
+	if len(posts) != 3 || posts[2].Get("fulljson") != `{"energy":460,"power":100}` {
+		t.Errorf("emoncms posts after the reading are %v", posts)
+	}
+}
+
+// TestEndToEndPVOutput checks the daily consumption and load posted to PVOutput,
+// and that the energy used before midnight is not added to the next day
+func TestEndToEndPVOutput(t *testing.T) {
+	p, pts := newFakePVOutput(t, "pvoutput-key", "12345")
+	s, clock := newTestServer(t)
+	s.GetConfig().EnablePVOutput = true
+	s.GetConfig().PVOutputURL = pts.URL + "/"
+	s.GetConfig().PVOutputAPIKey = "pvoutput-key"
+	s.GetConfig().PVOutputSystemID = "12345"
+	s.Power.SetReading(20)
+
+	// 360 W from 23:00 until ten past midnight, posted at 23:50 and ten past midnight
+	evening := time.Date(2024, 3, 14, 23, 0, 0, 0, time.UTC)
+	for _, pt := range pulsesEvery(evening, 10*time.Second, 300) {
+		s.Power.recordPulse(pt)
+	}
+	clock.Set(evening.Add(50 * time.Minute))
+	s.Uploader.Run()
+	for _, pt := range pulsesEvery(clock.Now(), 10*time.Second, 120) {
+		s.Power.recordPulse(pt)
+	}
+	clock.Set(evening.Add(70 * time.Minute))
+	s.Uploader.Run()
+
+	posts := p.Posts()
+	if len(posts) != 2 {
+		t.Fatalf("%d posts to PVOutput, want 2", len(posts))
+	}
+	// The pulse at midnight is the first of the new day
+	want := []url.Values{
+		{"d": {"20240314"}, "t": {"23:50"}, "v3": {"300"}, "v4": {"20"}},
+		{"d": {"20240315"}, "t": {"00:10"}, "v3": {"61"}, "v4": {"360"}},
+	}
+	for i, w := range want {
+		for k := range w {
+			if posts[i].Get(k) != w.Get(k) {
+				t.Errorf("post %d has %s=%q, want %q", i, k, posts[i].Get(k), w.Get(k))
+			}
+		}
+	}
+	if st := s.Uploader.GetStatus()["pvoutput"]; !st.Enabled || st.LastError != "" {
+		t.Errorf("pvoutput status is %+v", st)
+	}
+
+	// The fake rejects a wrong API key
+	s.GetConfig().PVOutputAPIKey = "wrong"
+	if err := s.Uploader.PVOutput.SendTelemetry(); err == nil {
+		t.Error("post with the wrong API key succeeded")
+	}
+}
+
+// TestEndToEndSinkErrors checks that a failing destination does not stop the others
+func TestEndToEndSinkErrors(t *testing.T) {
+	s, clock, b, _ := newTelemetryServer(t)
+	s.GetConfig().EmoncmsURL = "http://127.0.0.1:1"
+	s.Power.SetReading(3)
+	s.Uploader.Run()
+
+	if l := b.WaitMessages(t, "home/power/current", 1); l[0].Payload != "3.000" {
+		t.Errorf("published balance %q, want 3.000", l[0].Payload)
+	}
+	st := s.Uploader.GetStatus()
+	if st["emoncms"].LastError == "" || !st["emoncms"].LastSuccess.IsZero() {
+		t.Errorf("emoncms status is %+v", st["emoncms"])
+	}
+	if !st["mqtt"].LastSuccess.Equal(clock.Now()) {
+		t.Errorf("mqtt status is %+v", st["mqtt"])
+	}
+	if rep := s.CheckHealth(); rep.Checks["emoncms"].Status == HealthOK {
+		t.Errorf("emoncms health is %+v", rep.Checks["emoncms"])
+	}
+}
+
+// TestEndToEndSimulator runs the simulator for an hour of a constant load on the fake clock
+func TestEndToEndSimulator(t *testing.T) {
+	s, clock, b, _ := newTelemetryServer(t)
+	s.Power.SetReading(50)
+	s.PulseSource.Source = &SimulatorSource{
+		Profile: LoadProfile{BaseLoad: 1000},
+		Seed:    1,
+	}
+	s.PulseSource.Start()
+
+	// The simulator waits for each pulse on the clock
+	end := testStart.Add(time.Hour)
+	for clock.Now().Before(end) {
+		waitFor(t, "the simulator", func() bool { return clock.Waiters() != 0 })
+		clock.Advance(time.Minute)
+	}
+	waitFor(t, "the simulator", func() bool { return clock.Waiters() != 0 })
+	s.PulseSource.Stop()
+
+	if n := s.Power.GetStatus().PulseCount; n < 999 || n > 1000 {
+		t.Errorf("%d pulses in an hour at 1 kW, want 1000", n)
+	}
+	if l := s.Power.GetCurrentLoad(); l != 1000 {
+		t.Errorf("load is %v, want 1000", l)
+	}
+	s.Uploader.Run()
+	if l := b.WaitMessages(t, "home/power/current", 1); l[0].Payload != "49.000" && l[0].Payload != "49.001" {
+		t.Errorf("published balance %q, want 49.000", l[0].Payload)
+	}
+}
+
+// TestEndToEndSimulatorFlashRate checks that the simulator flashes at the new rate
+// when the flash rate is changed while it runs
+func TestEndToEndSimulatorFlashRate(t *testing.T) {
+	s, clock := newTestServer(t)
+	s.Power.SetReading(50)
+	s.GetConfig().PulseSource = SourceSimulator
+	s.PulseSource.Source = &SimulatorSource{Profile: LoadProfile{BaseLoad: 1000}, Seed: 1}
+	s.PulseSource.Start()
+	run := func(d time.Duration) {
+		end := clock.Now().Add(d)
+		for clock.Now().Before(end) {
+			waitFor(t, "the simulator", func() bool { return clock.Waiters() != 0 })
+			clock.Advance(time.Minute)
+		}
+		waitFor(t, "the simulator", func() bool { return clock.Waiters() != 0 })
+	}
+
+	run(30 * time.Minute)
+	s.Power.SetFlashRate(500)
+	run(30 * time.Minute)
+	s.PulseSource.Stop()
+
+	if n := s.Power.GetStatus().PulseCount; n < 249 || n > 251 {
+		t.Errorf("%d pulses in half an hour at 1 kW and 500 flashes per kWh, want 250", n)
+	}
+	if got := s.Power.GetCurrentPower(); got < 48.997 || got > 49.003 {
+		t.Errorf("balance is %v, want 49", got)
+	}
+	if l := s.Power.GetCurrentLoad(); l != 1000 {
+		t.Errorf("load is %v, want 1000", l)
+	}
+}
+
+// TestEndToEndRecordReplay records the pulses of the light sensor and replays them on another server
+func TestEndToEndRecordReplay(t *testing.T) {
+	s, _ := newTestServer(t)
+	rec, err := filepath.Abs("pulses.rec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Recorder.Open(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake clock does not move, so all the pulses are read at the same time
+	s.Power.SetMaxLoad(0)
+	s.Power.SetReading(10)
+	s.PulseSource.Source = &SensorSource{Command: func() *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestPulseDetectorProcess$")
+		cmd.Env = append(os.Environ(), "GO_TEST_PULSE_DETECTOR=1")
+		return cmd
+	}}
+	s.PulseSource.Start()
+	waitFor(t, "the pulses", func() bool {
+		return s.Power.GetStatus().PulseCount == 5 && len(s.PulseSource.GetStatus().Stderr) != 0
+	})
+	if st := s.PulseSource.GetStatus(); !st.Running || st.Stderr[0] != "sensor ready" {
+		t.Errorf("pulse source status is %+v", st)
+	}
+	s.PulseSource.Stop()
+	s.Recorder.Close()
+	if got := s.Power.GetCurrentPower(); !closeEnough(got, 9.995) {
+		t.Errorf("balance is %v, want 9.995", got)
+	}
+
+	// Backfilling replaces the hour that was recorded, without changing the balance
+	r, clock, b, _ := newTelemetryServer(t)
+	clock.Set(testStart.Add(24 * time.Hour))
+	r.Power.SetMaxLoad(0)
+	r.Power.SetReading(10)
+	// The recorded times are read back in local time
+	start := testStart.Local()
+	r.History.AddUsage(start, 1)
+	r.History.AddUsage(start.Add(-time.Hour), 1)
+	r.GetConfig().PulseSource = SourceReplay
+	r.GetConfig().ReplayFile = rec
+	r.PulseSource.Start()
+	waitFor(t, "the replay", func() bool { return r.PulseSource.GetStatus().State == SourceFinished })
+	if st := r.Power.GetStatus(); st.PulseCount != 0 || r.Power.GetFilterReport().Accepted != 0 {
+		t.Errorf("backfill changed the pulses to %+v", st)
+	}
+	if got := r.History.GetHourly(start)[start.Hour()].Units; !closeEnough(got, 0.005) {
+		t.Errorf("backfilled hour is %v, want 0.005", got)
+	}
+	if got := r.History.GetHourly(start)[start.Hour()-1].Units; got != 1 {
+		t.Errorf("hour before the recording is %v, want 1", got)
+	}
+	r.Uploader.Run()
+	if l := b.WaitMessages(t, "home/power/current", 1); l[0].Payload != "10.000" {
+		t.Errorf("published balance %q, want 10.000", l[0].Payload)
+	}
+}
+
+// TestPulseDetectorProcess is run by TestEndToEndRecordReplay in place of detectpulse.py
+func TestPulseDetectorProcess(t *testing.T) {
+	if os.Getenv("GO_TEST_PULSE_DETECTOR") != "1" {
+		t.Skip("only run as the pulse detector")
+	}
+	fmt.Fprintln(os.Stderr, "sensor ready")
+	for i := 0; i < 5; i++ {
+		fmt.Println("pulse")
+		fmt.Println("dark")
+	}
+	// Run until stopped, like detectpulse.py
+	time.Sleep(time.Minute)
+	os.Exit(0)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Emoncms publishes the telemetry to the emoncms input API.
+// The average load since the last post is sent as "power" (W) and the energy
+// consumed since the service started as "energy" (Wh). The energy input should
+// be logged using the "Wh Accumulator" process, which handles the restart resets.
+type Emoncms struct {
+	Srv               *Server      // Server instance
+	LastUpdateAttempt time.Time    // Last time an update was attempted
+	LastUpdate        time.Time    // Last time an update was published
+	client            *http.Client // HTTP client
+	enabled           bool         // Signals that emoncms is enabled and configured
+	lastConsumed      float64      // Power consumed (in Kwh) at the last update
+	lastTime          time.Time    // Time of the last update
+}
+
+// Initialize initializes the emoncms client
+func (e *Emoncms) Initialize() error {
+	e.client = &http.Client{Timeout: 30 * time.Second}
+	c := e.Srv.GetConfig()
+	e.enabled = c.EnableEmoncms
+	if !c.EnableEmoncms {
+		e.logInfo("emoncms has been disabled")
+		return nil
+	}
+	if c.EmoncmsAPIKey == "" {
+		e.logError("emoncms API Key has not been configured.")
+		e.enabled = false
+		return errors.New("api key has not been configured")
+	}
+	e.lastTime = e.Srv.Power.StartTime
+	return nil
+}
+
+// SendTelemetry posts the current load and energy to the emoncms input API
+func (e *Emoncms) SendTelemetry() error {
+	if !e.enabled {
+		return nil
+	}
+
+	c := e.Srv.GetConfig()
+	e.logInfo("Publishing power to emoncms")
+	now := e.Srv.Now()
+	e.LastUpdateAttempt = now
+
+	consumed := e.Srv.Power.GetConsumed()
+	load := 0.0
+	if !e.lastTime.IsZero() {
+		load = averageLoad(consumed-e.lastConsumed, now.Sub(e.lastTime))
+	}
+	b, err := json.Marshal(map[string]float64{
+		"power":  round(load, 1),
+		"energy": round(consumed*1000, 1),
+	})
+	if err != nil {
+		return err
+	}
+
+	v := url.Values{}
+	v.Set("node", c.EmoncmsNode)
+	v.Set("time", fmt.Sprint(now.Unix()))
+	v.Set("fulljson", string(b))
+	v.Set("apikey", c.EmoncmsAPIKey)
+
+	resp, err := e.client.PostForm(strings.TrimRight(c.EmoncmsURL, "/")+"/input/post", v)
+	if err != nil {
+		e.logError("Error posting to emoncms.", err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		e.logError("emoncms returned status ", resp.Status)
+		return fmt.Errorf("emoncms returned status %s", resp.Status)
+	}
+
+	e.lastConsumed = consumed
+	e.lastTime = now
+	e.LastUpdate = now
+
+	return nil
+}
+
+// logInfo logs an information message to the logger
+func (e *Emoncms) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("Emoncms", a)
+}
+
+// logError logs an error message to the logger
+func (e *Emoncms) logError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("Emoncms", a)
+}
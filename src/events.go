@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event types published by the service
+const (
+	EventPulse   = "pulse"   // A pulse was detected
+	EventBalance = "balance" // The remaining balance changed
+	EventTopUp   = "topup"   // Units were added to the balance
+	EventAlert   = "alert"   // An alert was raised
+)
+
+// eventRingSize is the number of recent events kept for resuming streams
+const eventRingSize = 256
+
+// Event is a single live event published by the service
+type Event struct {
+	ID   int64       `json:"id"`   // Sequential event ID
+	Type string      `json:"type"` // Event type
+	Time time.Time   `json:"time"` // Time the event was raised
+	Data interface{} `json:"data"` // Event payload
+}
+
+// PulseEvent holds the details of a detected pulse
+type PulseEvent struct {
+	Time     time.Time `json:"time"`     // Time of the pulse
+	Interval float64   `json:"interval"` // Seconds since the previous pulse
+	Load     float64   `json:"load"`     // Instantaneous load in Watts
+}
+
+// BalanceEvent holds the remaining balance
+type BalanceEvent struct {
+	Balance float64 `json:"balance"` // Remaining power in Kwh
+}
+
+// TopUpEvent holds the details of a top-up
+type TopUpEvent struct {
+	Units   float64 `json:"units"`   // Units (Kwh) added
+	Balance float64 `json:"balance"` // Remaining power in Kwh after the top-up
+}
+
+// AlertEvent holds the details of an alert
+type AlertEvent struct {
+	Source  string `json:"source"`  // Component raising the alert
+	Message string `json:"message"` // Alert message
+}
+
+// EventBroker fans out live events to subscribers and keeps a short
+// history of recent events so that clients can resume a stream.
+type EventBroker struct {
+	lastID int64               // ID of the last published event
+	ring   []Event             // Recent events, oldest first
+	subs   map[chan Event]bool // Current subscribers
+	closed bool                // Signals that the broker has been closed
+	mu     sync.Mutex
+}
+
+// Publish publishes a new event to all subscribers
+func (b *EventBroker) Publish(typ string, data interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.lastID++
+	e := Event{ID: b.lastID, Type: typ, Time: time.Now(), Data: data}
+	b.ring = append(b.ring, e)
+	if len(b.ring) > eventRingSize {
+		b.ring = b.ring[len(b.ring)-eventRingSize:]
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// Subscriber is not keeping up, drop the event
+		}
+	}
+}
+
+// Subscribe registers a new subscriber and returns the channel the events
+// will be delivered on. The channel is closed when the broker is closed.
+func (b *EventBroker) Subscribe() chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan Event, 32)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	if b.subs == nil {
+		b.subs = make(map[chan Event]bool)
+	}
+	b.subs[ch] = true
+	return ch
+}
+
+// Unsubscribe removes the subscriber
+func (b *EventBroker) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[ch] {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// Since returns the recent events published after the specified event ID
+func (b *EventBroker) Since(id int64) []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l := []Event{}
+	for _, e := range b.ring {
+		if e.ID > id {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// Close closes all the subscriber channels and stops publishing events
+func (b *EventBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		close(ch)
+	}
+	b.subs = nil
+}
+
+// WriteStream writes the event to the writer in Server-Sent Events format
+func (e *Event) WriteStream(w io.Writer) error {
+	b, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+	return err
+}
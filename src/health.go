@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Health statuses, in order of severity
+const (
+	HealthOK       = "ok"       // Working normally
+	HealthDegraded = "degraded" // Working, but needs attention
+	HealthFailed   = "failed"   // Not working
+)
+
+// healthSeverity holds the severity of each health status
+var healthSeverity = map[string]int{HealthOK: 0, HealthDegraded: 1, HealthFailed: 2}
+
+const (
+	pulseStale    = time.Hour         // Time without a pulse after which the sensor is reported
+	diskLow       = 100 * 1024 * 1024 // Free space (in bytes) below which the disk is reported as low
+	diskCritical  = 10 * 1024 * 1024  // Free space (in bytes) below which the disk check fails
+	journalFolder = "/var/log/journal"
+)
+
+// HealthCheck holds the status of a subsystem
+type HealthCheck struct {
+	Status  string                 `json:"status"`            // Health status
+	Message string                 `json:"message,omitempty"` // Reason for the status
+	Details map[string]interface{} `json:"details,omitempty"` // Values the status is based on
+}
+
+// HealthReport holds the status of the service and each of its subsystems
+type HealthReport struct {
+	Status string                 `json:"status"` // Worst status of the subsystems
+	Ready  bool                   `json:"ready"`  // Signals that the service is ready to serve requests
+	Time   time.Time              `json:"time"`   // Time of the report
+	Uptime float64                `json:"uptime"` // Time since the service started (in seconds)
+	Checks map[string]HealthCheck `json:"checks"` // Status of each subsystem
+}
+
+// CheckHealth checks each subsystem and returns the health report
+func (s *Server) CheckHealth() HealthReport {
+	now := s.Now()
+	r := HealthReport{
+		Status: HealthOK,
+		Time:   now,
+		Checks: map[string]HealthCheck{},
+	}
+	if !s.startTime.IsZero() {
+		r.Uptime = now.Sub(s.startTime).Seconds()
+	}
+
+	r.Checks["pulseSource"] = s.checkPulseSource(now)
+	r.Checks["sensor"] = s.checkSensor()
+	r.Checks["balance"] = s.checkBalance(now)
+	r.Checks["config"] = s.checkConfig()
+	r.Checks["clock"] = s.checkClock()
+	r.Checks["disk"] = checkDisk()
+	for n, c := range s.checkSinks() {
+		r.Checks[n] = c
+	}
+
+	for _, c := range r.Checks {
+		if healthSeverity[c.Status] > healthSeverity[r.Status] {
+			r.Status = c.Status
+		}
+	}
+	r.Ready = s.ready.Load() && r.Checks["pulseSource"].Status != HealthFailed
+	return r
+}
+
+// checkPulseSource checks that the pulse source is running and producing pulses
+func (s *Server) checkPulseSource(now time.Time) HealthCheck {
+	st := s.Power.GetStatus()
+	src := s.PulseSource.GetStatus()
+	f := s.Power.GetFilterReport()
+	c := HealthCheck{
+		Status: HealthOK,
+		Details: map[string]interface{}{
+			"state":      src.State,
+			"running":    src.Running,
+			"restarts":   src.Restarts,
+			"failures":   src.Failures,
+			"lastPulse":  st.LastPulse,
+			"pulseCount": st.PulseCount,
+			"rejected":   f.Bounced + f.Burst,
+		},
+	}
+	if src.LastError != "" {
+		c.Details["lastError"] = src.LastError
+	}
+	switch {
+	case src.State == SourceFailed:
+		c.Status = HealthFailed
+		c.Message = fmt.Sprintf("pulse source has failed %d times in a row. %s", src.Failures, src.LastError)
+	case src.State == SourceFinished:
+		c.Message = "pulse source has no more pulses"
+	case src.State == SourceStopped:
+		c.Status = HealthFailed
+		c.Message = "pulse source is not running"
+	case !src.Running:
+		c.Status = HealthDegraded
+		c.Message = "pulse source is restarting"
+	case now.Sub(src.Started) > pulseStale && now.Sub(st.LastPulse) > pulseStale:
+		c.Status = HealthDegraded
+		c.Message = fmt.Sprintf("no pulses for more than %s", pulseStale)
+	}
+	return c
+}
+
+// checkSensor checks that the light sensor is not faulty
+func (s *Server) checkSensor() HealthCheck {
+	f := s.Sensor.GetFault()
+	if f.Fault == FaultNone {
+		return HealthCheck{Status: HealthOK}
+	}
+	return HealthCheck{
+		Status:  HealthFailed,
+		Message: f.Message,
+		Details: map[string]interface{}{"fault": f.Fault, "since": f.Since},
+	}
+}
+
+// checkBalance checks that the balance is being saved
+func (s *Server) checkBalance(now time.Time) HealthCheck {
+	st := s.Power.GetStatus()
+	c := HealthCheck{
+		Status:  HealthOK,
+		Details: map[string]interface{}{"lastSaved": st.LastSaved},
+	}
+	// The balance is saved on every upload, so allow for two missed uploads
+	due := time.Duration(2*s.GetConfig().Period)*time.Minute + 5*time.Minute
+	switch {
+	case st.SaveError != "":
+		c.Status = HealthDegraded
+		c.Message = "error saving the balance. " + st.SaveError
+	case !s.startTime.IsZero() && now.Sub(s.startTime) > due && now.Sub(st.LastSaved) > due:
+		c.Status = HealthDegraded
+		c.Message = "the balance has not been saved recently"
+	}
+	return c
+}
+
+// checkConfig checks that the configuration was valid when it was applied. The errors
+// are logged, not reported, as they can name files and secret references.
+func (s *Server) checkConfig() HealthCheck {
+	if s.configInvalid.Load() {
+		return HealthCheck{Status: HealthDegraded, Message: "configuration is not valid"}
+	}
+	return HealthCheck{Status: HealthOK}
+}
+
+// checkSinks checks the last upload to each of the enabled destinations
+func (s *Server) checkSinks() map[string]HealthCheck {
+	m := map[string]HealthCheck{}
+	for n, st := range s.Uploader.GetStatus() {
+		c := HealthCheck{
+			Status: HealthOK,
+			Details: map[string]interface{}{
+				"enabled":     st.Enabled,
+				"lastAttempt": st.LastAttempt,
+				"lastSuccess": st.LastSuccess,
+			},
+		}
+		if st.Connected != nil {
+			c.Details["connected"] = *st.Connected
+		}
+		switch {
+		case !st.Enabled:
+			c.Message = "disabled"
+		case st.LastError != "":
+			c.Status = HealthDegraded
+			c.Message = "last upload failed. " + st.LastError
+		case st.Connected != nil && !*st.Connected:
+			c.Status = HealthDegraded
+			c.Message = "not connected"
+		}
+		m[n] = c
+	}
+	return m
+}
+
+// checkClock checks that the clock is synchronized and reports the clock steps
+func (s *Server) checkClock() HealthCheck {
+	st := s.TimeSync.GetStatus()
+	c := HealthCheck{
+		Status: HealthOK,
+		Details: map[string]interface{}{
+			"steps":    st.Steps,
+			"held":     st.Held,
+			"unsynced": st.Unsynced,
+		},
+	}
+	if st.Steps > 0 {
+		c.Details["lastStep"] = st.LastStep
+		c.Details["lastStepAt"] = st.LastStepAt
+	}
+	synced, err := clockSynchronized()
+	if err != nil {
+		c.Message = "synchronization state is unknown. " + err.Error()
+		return c
+	}
+	c.Details["synchronized"] = synced
+	if !synced {
+		c.Status = HealthDegraded
+		c.Message = "clock is not synchronized"
+		if st.Held > 0 {
+			c.Message += fmt.Sprintf(", %d history entries are held until it is", st.Held)
+		}
+		if st.Unsynced {
+			c.Message += ", the history is recorded with the wrong times"
+		}
+	}
+	return c
+}
+
+// checkDisk checks the free space for the log, balance and history files and the system journal
+func checkDisk() HealthCheck {
+	c := HealthCheck{Status: HealthOK, Details: map[string]interface{}{}}
+	paths := map[string]string{"app": "."}
+	if _, err := os.Stat(journalFolder); err == nil {
+		paths["journal"] = journalFolder
+	}
+	for n, p := range paths {
+		free, err := diskFree(p)
+		if err != nil {
+			c.Message = "free space is unknown. " + err.Error()
+			continue
+		}
+		c.Details[n+"Free"] = free
+		status := HealthOK
+		if free < diskCritical {
+			status = HealthFailed
+		} else if free < diskLow {
+			status = HealthDegraded
+		}
+		if healthSeverity[status] > healthSeverity[c.Status] {
+			c.Status = status
+			c.Message = fmt.Sprintf("%s disk space is low, %d MB free", n, free/1024/1024)
+		}
+	}
+	return c
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// Clock states returned by adjtimex
+const (
+	timeError = 5    // TIME_ERROR: the clock is not synchronized
+	staUnsync = 0x40 // STA_UNSYNC: the clock is not synchronized
+)
+
+// clockSynchronized checks if the kernel reports that the clock is synchronized,
+// e.g. by systemd-timesyncd or NTP
+func clockSynchronized() (bool, error) {
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return false, err
+	}
+	return state != timeError && tx.Status&staUnsync == 0, nil
+}
+
+// diskFree returns the space (in bytes) available to the service on the file system of the path
+func diskFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
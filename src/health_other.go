@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// errNotSupported is returned by the checks that are only available on Linux
+var errNotSupported = errors.New("not supported on this platform")
+
+// clockSynchronized checks if the clock is synchronized. Only supported on Linux.
+func clockSynchronized() (bool, error) {
+	return false, errNotSupported
+}
+
+// diskFree returns the space available on the file system of the path. Only supported on Linux.
+func diskFree(path string) (uint64, error) {
+	return 0, errNotSupported
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// HealthController handles the Web Methods used by watchdogs and uptime monitors.
+// They do not need authentication and do not return any configuration values.
+type HealthController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *HealthController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/health").Name("GetHealth").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetHealth)))
+	router.Methods("GET").Path("/ready").Name("GetReady").
+		Handler(Logger(c, http.HandlerFunc(c.handleGetReady)))
+}
+
+// handleGetHealth will return the status of each subsystem.
+// The status code is 503 if a subsystem has failed.
+func (c *HealthController) handleGetHealth(w http.ResponseWriter, r *http.Request) {
+	rep := c.Srv.CheckHealth()
+	code := http.StatusOK
+	if rep.Status == HealthFailed {
+		code = http.StatusServiceUnavailable
+	}
+	c.writeReport(w, rep, code)
+}
+
+// handleGetReady will return the status of each subsystem.
+// The status code is 503 until the service has started and the pulse source is running.
+func (c *HealthController) handleGetReady(w http.ResponseWriter, r *http.Request) {
+	rep := c.Srv.CheckHealth()
+	code := http.StatusOK
+	if !rep.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	c.writeReport(w, rep, code)
+}
+
+// writeReport writes the health report with the status code
+func (c *HealthController) writeReport(w http.ResponseWriter, rep HealthReport, code int) {
+	b, err := json.Marshal(rep)
+	if err != nil {
+		c.LogError("Error serializing health.", err.Error())
+		http.Error(w, "Error serializing health", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *HealthController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("HealthController", a)
+}
+
+// LogError is used to log error messages for this controller.
+func (c *HealthController) LogError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("HealthController", a)
+}
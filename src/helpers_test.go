@@ -0,0 +1,222 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testStart is the time the fake clock of a test server starts at
+var testStart = time.Date(2024, 3, 14, 9, 0, 0, 0, time.UTC)
+
+// newTestServer returns a server with the default configuration running on a fake clock.
+// The test runs in a temporary directory, as the server writes power.dat and history.json.
+func newTestServer(t *testing.T) (*Server, *FakeClock) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+
+	clock := NewFakeClock(testStart)
+	c := &Config{}
+	c.SetDefaults()
+	s := &Server{ConfigPath: "config.json", Clock: clock}
+	s.config.Store(c)
+	s.Uploader.Srv = s
+	s.Power.Srv = s
+	s.PulseSource.Srv = s
+	s.Sensor.Srv = s
+	s.Calibration.Srv = s
+	s.TimeSync.Srv = s
+	s.Power.FlashRate = c.FlashRate
+	s.Power.SetMaxLoad(c.MaxLoad)
+	s.Power.StartTime = s.Now()
+	s.startTime = s.Now()
+	t.Cleanup(func() {
+		s.PulseSource.Stop()
+		s.Uploader.Close()
+		s.Events.Close()
+	})
+	return s, clock
+}
+
+// newTestHTTP starts an HTTP server serving the API of the server
+func newTestHTTP(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+	s.router = mux.NewRouter()
+	s.addController(new(ConfigController))
+	s.addController(new(PowerController))
+	s.addController(new(HealthController))
+	s.addController(new(LogController))
+	s.addController(new(CalibrationController))
+	ts := httptest.NewServer(s.router)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// doRequest sends a JSON request with the optional headers and returns the status code and body
+func doRequest(t *testing.T, method string, url string, body string, header ...string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+// waitFor polls the condition until it is true, failing the test if it takes too long
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// pulsesEvery returns n pulse times, the specified interval apart, starting after the start time
+func pulsesEvery(start time.Time, interval time.Duration, n int) []time.Time {
+	l := []time.Time{}
+	for i := 1; i <= n; i++ {
+		l = append(l, start.Add(time.Duration(i)*interval))
+	}
+	return l
+}
+
+// closeEnough checks if the values are equal, ignoring floating point rounding
+func closeEnough(a float64, b float64) bool {
+	d := a - b
+	return d < 1e-9 && d > -1e-9
+}
+
+// FakeClock only moves when it is advanced, for use in tests
+type FakeClock struct {
+	now    time.Time    // Current time
+	timers []*fakeTimer // Timers and tickers waiting for a time
+	mu     sync.Mutex
+}
+
+// fakeTimer is a timer or ticker of a fake clock
+type fakeTimer struct {
+	at     time.Time      // Time the timer fires
+	period time.Duration  // Time between ticks, or 0 for a timer
+	c      chan time.Time // Channel the time is sent on
+	clock  *FakeClock     // Clock the timer belongs to
+}
+
+// NewFakeClock returns a fake clock set to the specified time
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{now: t}
+}
+
+// Now returns the current time
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After sends the time once the clock has been advanced by the duration
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1), clock: c}
+	if d <= 0 {
+		t.c <- c.now
+		return t.c
+	}
+	c.timers = append(c.timers, t)
+	return t.c
+}
+
+// NewTicker sends the time every time the clock has been advanced by the duration
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{at: c.now.Add(d), period: d, c: make(chan time.Time, 1), clock: c}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Waiters returns the number of timers and tickers waiting for a time.
+// Tests use it to wait for a goroutine to start waiting before advancing the clock.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Advance moves the clock forward by the duration, firing the timers
+// and tickers that are due in order
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to the specified time, firing the timers and tickers that are due in order.
+// The clock can be set back, in which case no timers fire.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].at.Before(c.timers[j].at)
+		})
+		if len(c.timers) == 0 || c.timers[0].at.After(t) {
+			break
+		}
+		ft := c.timers[0]
+		c.now = ft.at
+		select {
+		case ft.c <- ft.at:
+		default:
+			// Like a system ticker, ticks are dropped for slow receivers
+		}
+		if ft.period > 0 {
+			ft.at = ft.at.Add(ft.period)
+		} else {
+			c.timers = c.timers[1:]
+		}
+	}
+	c.now = t
+}
+
+// C returns the channel the time is sent on
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop stops the ticker
+func (t *fakeTimer) Stop() {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, ft := range c.timers {
+		if ft == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
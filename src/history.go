@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// historyDays is the number of days of hourly consumption that is kept
+const historyDays = 31
+
+// historyTopUps is the number of top-ups that is kept
+const historyTopUps = 100
+
+// History holds the consumption history and the top-ups.
+// While the clock is not synchronized the usage and top-ups are held, as their times
+// are wrong, and are added once the clock has been corrected.
+type History struct {
+	Hourly     map[string]float64 `json:"hourly"` // Consumption (Kwh) per hour, keyed by hour
+	TopUps     []TopUp            `json:"topUps"` // Top-ups, oldest first
+	held       bool               // Signals that the usage and top-ups are held
+	heldUsage  []Usage            // Usage held, merged per minute
+	heldTopUps []TopUp            // Top-ups held
+	mu         sync.Mutex
+}
+
+// TopUp holds the details of a top-up
+type TopUp struct {
+	Time  time.Time `json:"time"`  // Time of the top-up
+	Units float64   `json:"units"` // Units (Kwh) added
+}
+
+// Usage holds the consumption for a period
+type Usage struct {
+	Time  time.Time `json:"time"`  // Start of the period
+	Units float64   `json:"units"` // Consumption (Kwh) for the period
+}
+
+// Forecast holds the expected run-out of the balance
+type Forecast struct {
+	Balance       float64   `json:"balance"`       // Remaining power in Kwh
+	DailyAverage  float64   `json:"dailyAverage"`  // Average daily consumption in Kwh
+	DaysRemaining float64   `json:"daysRemaining"` // Number of days until the balance runs out
+	RunOut        time.Time `json:"runOut"`        // Expected time the balance runs out
+}
+
+// HistoryReport holds the consumption history that is reported
+type HistoryReport struct {
+	Today  []Usage `json:"today"`  // Hourly consumption for today
+	Month  []Usage `json:"month"`  // Daily consumption for the last 30 days
+	TopUps []TopUp `json:"topUps"` // Top-ups, newest first
+}
+
+// hourKey is the layout used for the hourly keys
+const hourKey = "2006-01-02T15"
+
+// GetHistoryReport returns the consumption history up to the specified time for return to the calling client
+func (h *History) GetHistoryReport(now time.Time) HistoryReport {
+	return HistoryReport{
+		Today:  h.GetHourly(now),
+		Month:  h.GetDaily(now, 30),
+		TopUps: h.GetTopUps(),
+	}
+}
+
+// AddUsage adds the consumption (in Kwh) at the specified time
+func (h *History) AddUsage(t time.Time, units float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.held {
+		if n := len(h.heldUsage); n > 0 && t.Sub(h.heldUsage[n-1].Time) < time.Minute {
+			h.heldUsage[n-1].Units += units
+		} else {
+			h.heldUsage = append(h.heldUsage, Usage{Time: t, Units: units})
+		}
+		return
+	}
+	h.addUsage(t, units)
+}
+
+// addUsage adds the consumption to the hour containing the time
+func (h *History) addUsage(t time.Time, units float64) {
+	if h.Hourly == nil {
+		h.Hourly = make(map[string]float64)
+	}
+	h.Hourly[t.Format(hourKey)] += units
+}
+
+// ReplaceHours replaces the consumption for the hours from the start time to the end time
+// with the consumption keyed by hour. Hours that have no consumption are cleared.
+func (h *History) ReplaceHours(from, to time.Time, hourly map[string]float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.Hourly == nil {
+		h.Hourly = make(map[string]float64)
+	}
+	for t := time.Date(from.Year(), from.Month(), from.Day(), from.Hour(), 0, 0, 0, from.Location()); !t.After(to); t = t.Add(time.Hour) {
+		k := t.Format(hourKey)
+		if u := hourly[k]; u > 0 {
+			h.Hourly[k] = u
+		} else {
+			delete(h.Hourly, k)
+		}
+	}
+}
+
+// AddTopUp records a top-up
+func (h *History) AddTopUp(t time.Time, units float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.held {
+		h.heldTopUps = append(h.heldTopUps, TopUp{Time: t, Units: units})
+		return
+	}
+	h.addTopUp(TopUp{Time: t, Units: units})
+}
+
+// addTopUp adds the top-up, keeping the latest top-ups
+func (h *History) addTopUp(t TopUp) {
+	h.TopUps = append(h.TopUps, t)
+	if len(h.TopUps) > historyTopUps {
+		h.TopUps = h.TopUps[len(h.TopUps)-historyTopUps:]
+	}
+}
+
+// Hold holds the usage and top-ups until they are released
+func (h *History) Hold() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.held = true
+}
+
+// Restamp moves the times of the held usage and top-ups onto the clock corrected by the step
+func (h *History) Restamp(now time.Time, step time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range h.heldUsage {
+		h.heldUsage[i].Time = shiftWall(h.heldUsage[i].Time, now, step)
+	}
+	for i := range h.heldTopUps {
+		h.heldTopUps[i].Time = shiftWall(h.heldTopUps[i].Time, now, step)
+	}
+}
+
+// Release adds the held usage and top-ups to the history, stops holding them
+// and returns the number of entries added
+func (h *History) Release() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, u := range h.heldUsage {
+		h.addUsage(u.Time, u.Units)
+	}
+	for _, t := range h.heldTopUps {
+		h.addTopUp(t)
+	}
+	n := len(h.heldUsage) + len(h.heldTopUps)
+	h.held = false
+	h.heldUsage = nil
+	h.heldTopUps = nil
+	return n
+}
+
+// Held returns the number of usage and top-up entries held
+func (h *History) Held() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.heldUsage) + len(h.heldTopUps)
+}
+
+// GetHourly returns the hourly consumption for the day containing the specified time
+func (h *History) GetHourly(t time.Time) []Usage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	l := []Usage{}
+	for i := 0; i < 24; i++ {
+		ht := d.Add(time.Duration(i) * time.Hour)
+		l = append(l, Usage{Time: ht, Units: h.Hourly[ht.Format(hourKey)]})
+	}
+	return l
+}
+
+// GetDaily returns the daily consumption for the specified number of days, up to
+// and including the day containing the specified time
+func (h *History) GetDaily(t time.Time, days int) []Usage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	byDay := map[string]float64{}
+	for k, v := range h.Hourly {
+		byDay[k[:10]] += v
+	}
+	d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	l := []Usage{}
+	for i := days - 1; i >= 0; i-- {
+		dt := d.AddDate(0, 0, -i)
+		l = append(l, Usage{Time: dt, Units: byDay[dt.Format("2006-01-02")]})
+	}
+	return l
+}
+
+// GetTopUps returns the recorded top-ups, including the held top-ups, newest first
+func (h *History) GetTopUps() []TopUp {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	all := append(append([]TopUp{}, h.TopUps...), h.heldTopUps...)
+	l := make([]TopUp, len(all))
+	for i, t := range all {
+		l[len(l)-1-i] = t
+	}
+	return l
+}
+
+// GetForecast calculates when the balance will run out, based on the average
+// consumption over the last week
+func (h *History) GetForecast(t time.Time, balance float64) Forecast {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f := Forecast{Balance: balance}
+
+	// Find the total consumption for the last week, and the first hour recorded
+	from := t.Add(-7 * 24 * time.Hour)
+	total := 0.0
+	first := t
+	for k, v := range h.Hourly {
+		ht, err := time.ParseInLocation(hourKey, k, t.Location())
+		if err != nil || ht.Before(from) {
+			continue
+		}
+		total += v
+		if ht.Before(first) {
+			first = ht
+		}
+	}
+	hours := t.Sub(first).Hours()
+	if total <= 0 || hours < 1 {
+		return f
+	}
+	f.DailyAverage = round(total/hours*24, 3)
+	if balance > 0 {
+		f.DaysRemaining = round(balance/f.DailyAverage, 1)
+		f.RunOut = t.Add(time.Duration(balance / total * hours * float64(time.Hour)))
+	}
+	return f
+}
+
+// GetBaseLoad returns the lowest hourly average load (in Watts) over the specified
+// number of days before the specified time, and the number of hours it is based on.
+// Hours without consumption are included from the first hour recorded.
+func (h *History) GetBaseLoad(t time.Time, days int) (float64, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	first := ""
+	for k := range h.Hourly {
+		if first == "" || k < first {
+			first = k
+		}
+	}
+	if first == "" {
+		return 0, 0
+	}
+	end := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	load := 0.0
+	hours := 0
+	for i := 1; i <= days*24; i++ {
+		k := end.Add(-time.Duration(i) * time.Hour).Format(hourKey)
+		if k < first {
+			break
+		}
+		w := h.Hourly[k] * 1000
+		if hours == 0 || w < load {
+			load = w
+		}
+		hours++
+	}
+	return load, hours
+}
+
+// ReadFromFile will read the history from the specified file
+func (h *History) ReadFromFile(path string) error {
+	_, err := os.Stat(path)
+	if !os.IsNotExist(err) {
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			h.mu.Lock()
+			err = json.Unmarshal(b, &h)
+			h.mu.Unlock()
+		}
+		return err
+	}
+	return nil
+}
+
+// WriteToFile will remove the history expired at the specified time and write the history to the specified file.
+// The held usage and top-ups are not written, and nothing expires while they are held, as the time is wrong.
+func (h *History) WriteToFile(path string, now time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.held {
+		h.expire(now)
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0666)
+}
+
+// expire removes the hourly consumption older than the history period
+func (h *History) expire(t time.Time) {
+	oldest := t.AddDate(0, 0, -historyDays).Format(hourKey)
+	for k := range h.Hourly {
+		if k < oldest {
+			delete(h.Hourly, k)
+		}
+	}
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (r *HistoryReport) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (f *Forecast) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestHistoryReport checks the hourly and daily consumption and the top-ups
+func TestHistoryReport(t *testing.T) {
+	h := &History{}
+	h.AddUsage(testStart, 0.5)
+	h.AddUsage(testStart.Add(30*time.Minute), 0.25)
+	h.AddUsage(testStart.Add(2*time.Hour), 1)
+	h.AddUsage(testStart.AddDate(0, 0, -1), 2)
+	h.AddTopUp(testStart.AddDate(0, 0, -2), 50)
+	h.AddTopUp(testStart, 20)
+
+	rep := h.GetHistoryReport(testStart.Add(3 * time.Hour))
+	if len(rep.Today) != 24 || rep.Today[9].Units != 0.75 || rep.Today[11].Units != 1 {
+		t.Errorf("hourly consumption is %v", rep.Today)
+	}
+	if len(rep.Month) != 30 || rep.Month[29].Units != 1.75 || rep.Month[28].Units != 2 {
+		t.Errorf("daily consumption is %v", rep.Month[27:])
+	}
+	if len(rep.TopUps) != 2 || rep.TopUps[0].Units != 20 {
+		t.Errorf("top-ups are not newest first %v", rep.TopUps)
+	}
+}
+
+// TestHistoryForecast checks the run-out forecast from the average consumption
+func TestHistoryForecast(t *testing.T) {
+	h := &History{}
+	if f := h.GetForecast(testStart, 10); f.DailyAverage != 0 || !f.RunOut.IsZero() {
+		t.Errorf("forecast without history is %+v", f)
+	}
+
+	// 0.5 kWh an hour for two days is 12 kWh a day
+	start := testStart.AddDate(0, 0, -2)
+	for i := 0; i < 48; i++ {
+		h.AddUsage(start.Add(time.Duration(i)*time.Hour), 0.5)
+	}
+	f := h.GetForecast(testStart, 24)
+	if f.DailyAverage != 12 || f.DaysRemaining != 2 {
+		t.Errorf("forecast is %+v", f)
+	}
+	if want := testStart.Add(48 * time.Hour); !f.RunOut.Equal(want) {
+		t.Errorf("run-out is %v, want %v", f.RunOut, want)
+	}
+}
+
+// TestHistoryBaseLoad checks the lowest hourly load
+func TestHistoryBaseLoad(t *testing.T) {
+	h := &History{}
+	start := testStart.AddDate(0, 0, -1)
+	for i := 0; i < 24; i++ {
+		units := 0.4
+		if i == 5 {
+			units = 0.1
+		}
+		h.AddUsage(start.Add(time.Duration(i)*time.Hour), units)
+	}
+	load, hours := h.GetBaseLoad(testStart, 7)
+	if !closeEnough(load, 100) || hours != 24 {
+		t.Errorf("base load is %v W over %d hours, want 100 W over 24 hours", load, hours)
+	}
+}
+
+// TestHistoryFile checks that the history survives a restart and that old consumption expires
+func TestHistoryFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	h := &History{}
+	h.AddUsage(testStart, 1.5)
+	h.AddUsage(testStart.AddDate(0, 0, -historyDays-1), 3)
+	h.AddTopUp(testStart, 20)
+	if err := h.WriteToFile("history.json", testStart); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &History{}
+	if err := r.ReadFromFile("history.json"); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Hourly) != 1 || r.Hourly[testStart.Format(hourKey)] != 1.5 {
+		t.Errorf("hourly consumption is %v", r.Hourly)
+	}
+	if len(r.TopUps) != 1 || !r.TopUps[0].Time.Equal(testStart) {
+		t.Errorf("top-ups are %v", r.TopUps)
+	}
+	if err := (&History{}).ReadFromFile("missing.json"); err != nil {
+		t.Errorf("missing history file returned %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+(function () {
+    'use strict';
+
+    var range = 'today';
+    var history = null;
+
+    function $(id) {
+        return document.getElementById(id);
+    }
+
+    // API key given in the page URL (?apikey=...), passed on to the API calls
+    var apiKey = new URLSearchParams(window.location.search).get('apikey');
+
+    function withKey(url) {
+        if (!apiKey) {
+            return url;
+        }
+        return url + (url.indexOf('?') < 0 ? '?' : '&') + 'apikey=' + encodeURIComponent(apiKey);
+    }
+
+    function getJSON(url) {
+        return fetch(withKey(url)).then(function (r) {
+            if (!r.ok) {
+                throw new Error(r.statusText);
+            }
+            return r.json();
+        });
+    }
+
+    function postJSON(url, body) {
+        return fetch(withKey(url), {
+            method: 'POST',
+            headers: { 'content-type': 'application/json' },
+            body: JSON.stringify(body)
+        }).then(function (r) {
+            if (!r.ok) {
+                return r.text().then(function (t) { throw new Error(t || r.statusText); });
+            }
+            return r.json();
+        });
+    }
+
+    function fmtTime(t) {
+        var d = new Date(t);
+        if (d.getFullYear() < 2000) {
+            return '-';
+        }
+        return d.toLocaleString();
+    }
+
+    function showPower(p) {
+        $('balance').textContent = p.currentPower.toFixed(2);
+        $('load').textContent = Math.round(p.currentLoad);
+        $('lastPulse').textContent = fmtTime(p.lastRead);
+    }
+
+    function showForecast(f) {
+        $('average').textContent = f.dailyAverage ? f.dailyAverage.toFixed(2) : '-';
+        if (f.balance <= 0) {
+            $('forecast').textContent = 'Balance has run out';
+        } else if (f.daysRemaining) {
+            $('forecast').textContent = 'Runs out in ' + f.daysRemaining.toFixed(1) +
+                ' days (' + new Date(f.runOut).toLocaleDateString() + ')';
+        } else {
+            $('forecast').textContent = 'Not enough history to forecast';
+        }
+    }
+
+    function showTopUps(l) {
+        var tb = $('topups');
+        tb.innerHTML = '';
+        if (!l || l.length === 0) {
+            tb.innerHTML = '<tr><td colspan="2">No top-ups recorded.</td></tr>';
+            return;
+        }
+        l.forEach(function (t) {
+            var tr = document.createElement('tr');
+            var td1 = document.createElement('td');
+            var td2 = document.createElement('td');
+            td1.textContent = fmtTime(t.time);
+            td2.textContent = t.units.toFixed(1);
+            td2.className = 'num';
+            tr.appendChild(td1);
+            tr.appendChild(td2);
+            tb.appendChild(tr);
+        });
+    }
+
+    function drawChart() {
+        if (!history) {
+            return;
+        }
+        var data, label;
+        if (range === 'today') {
+            data = history.today;
+            label = function (d) { return new Date(d.time).getHours(); };
+        } else {
+            data = range === 'week' ? history.month.slice(-7) : history.month;
+            label = function (d) { return new Date(d.time).getDate(); };
+        }
+
+        var w = 600, h = 220, pad = 20;
+        var max = Math.max.apply(null, data.map(function (d) { return d.units; }).concat([0.001]));
+        var bw = (w - pad) / data.length;
+        var total = 0;
+        var svg = '<svg viewBox="0 0 ' + w + ' ' + h + '" preserveAspectRatio="none">';
+        data.forEach(function (d, i) {
+            var bh = (h - 2 * pad) * d.units / max;
+            var x = pad + i * bw;
+            total += d.units;
+            svg += '<rect x="' + (x + 1) + '" y="' + (h - pad - bh) + '" width="' + Math.max(bw - 2, 1) +
+                '" height="' + bh + '"><title>' + d.units.toFixed(2) + ' kWh</title></rect>';
+            svg += '<text x="' + (x + bw / 2) + '" y="' + (h - 5) + '" text-anchor="middle">' + label(d) + '</text>';
+        });
+        svg += '<text x="0" y="12">' + max.toFixed(2) + '</text>';
+        svg += '</svg>';
+        $('chart').innerHTML = svg;
+        $('chartTotal').textContent = 'Total ' + total.toFixed(2) + ' kWh';
+    }
+
+    function refresh() {
+        getJSON('/power/get').then(showPower).catch(function () {});
+        getJSON('/power/forecast').then(showForecast).catch(function () {});
+        getJSON('/power/history').then(function (h) {
+            history = h;
+            drawChart();
+            showTopUps(h.topUps);
+        }).catch(function () {});
+    }
+
+    function connect() {
+        if (!window.EventSource) {
+            $('status').textContent = 'Polling';
+            setInterval(refresh, 10000);
+            return;
+        }
+        var es = new EventSource(withKey('/power/stream'));
+        es.onopen = function () {
+            $('status').textContent = 'Live';
+        };
+        es.onerror = function () {
+            $('status').textContent = 'Reconnecting...';
+        };
+        es.addEventListener('pulse', function (e) {
+            var p = JSON.parse(e.data);
+            if (p.load) {
+                $('load').textContent = Math.round(p.load);
+            }
+            $('lastPulse').textContent = fmtTime(p.time);
+        });
+        es.addEventListener('balance', function (e) {
+            $('balance').textContent = JSON.parse(e.data).balance.toFixed(2);
+        });
+        es.addEventListener('topup', refresh);
+        es.addEventListener('alert', function (e) {
+            $('status').textContent = JSON.parse(e.data).message;
+        });
+    }
+
+    function bindForm(id, url) {
+        var f = $(id);
+        var msg = f.querySelector('.message');
+        f.addEventListener('submit', function (e) {
+            e.preventDefault();
+            var units = parseFloat(f.units.value);
+            msg.className = 'message';
+            msg.textContent = 'Saving...';
+            postJSON(url, { units: units }).then(function (p) {
+                showPower(p);
+                msg.textContent = 'Saved.';
+                f.reset();
+                refresh();
+            }).catch(function (err) {
+                msg.className = 'message error';
+                msg.textContent = err.message;
+            });
+        });
+    }
+
+    document.querySelectorAll('.tabs button').forEach(function (b) {
+        b.addEventListener('click', function () {
+            document.querySelectorAll('.tabs button').forEach(function (o) { o.classList.remove('active'); });
+            b.classList.add('active');
+            range = b.getAttribute('data-range');
+            drawChart();
+        });
+    });
+
+    bindForm('topupForm', '/power/topup');
+    bindForm('readingForm', '/power/reading');
+    refresh();
+    connect();
+    setInterval(refresh, 5 * 60 * 1000);
+}());
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+// Log levels, in order of severity
+const (
+	LevelDebug   = "debug"
+	LevelInfo    = "info"
+	LevelWarning = "warning"
+	LevelError   = "error"
+)
+
+// logLevels holds the severity of each log level
+var logLevels = map[string]int{LevelDebug: 0, LevelInfo: 1, LevelWarning: 2, LevelError: 3}
+
+const (
+	logRingSize    = 2000    // Number of entries kept in memory
+	logFileMaxSize = 1 << 20 // Size (in bytes) at which the log file is rotated
+)
+
+// logs is the log book used by all the components
+var logs = &LogBook{}
+
+// LogEntry is a structured log record
+type LogEntry struct {
+	Seq       uint64                 `json:"seq"`              // Sequence number
+	Time      time.Time              `json:"time"`             // Time logged
+	Level     string                 `json:"level"`            // Log level
+	Component string                 `json:"component"`        // Component that logged the entry
+	Message   string                 `json:"message"`          // Message
+	Fields    map[string]interface{} `json:"fields,omitempty"` // Structured values
+}
+
+// LogQuery holds the filters used when reading log entries
+type LogQuery struct {
+	Level      string    // Minimum level
+	Components []string  // Components, in any case. All components if empty.
+	Since      time.Time // Earliest time
+	Until      time.Time // Latest time
+	Text       string    // Text the message or fields contain, in any case
+	Limit      int       // Maximum number of entries, keeping the latest
+}
+
+// LogBook keeps the latest log entries in a ring in memory and in a log file that
+// is rotated when it gets too large. Each entry is also written to the service logger.
+type LogBook struct {
+	Sink    service.Logger    // Service logger, such as the system journal
+	entries []LogEntry        // Ring of entries
+	next    int               // Position of the next entry in the ring
+	seq     uint64            // Sequence number of the last entry
+	level   string            // Minimum level logged
+	levels  map[string]string // Minimum level logged for each component, keyed by lower case name
+	secrets []string          // Secret values removed from the messages
+	path    string            // Log file path
+	file    *os.File          // Log file
+	size    int64             // Size of the log file
+	mu      sync.Mutex
+}
+
+// Debug logs a debug message for the component
+func (b *LogBook) Debug(component string, v ...interface{}) {
+	b.Log(LevelDebug, component, fmt.Sprint(v...), nil)
+}
+
+// Info logs an information message for the component
+func (b *LogBook) Info(component string, v ...interface{}) {
+	b.Log(LevelInfo, component, fmt.Sprint(v...), nil)
+}
+
+// Warning logs a warning message for the component
+func (b *LogBook) Warning(component string, v ...interface{}) {
+	b.Log(LevelWarning, component, fmt.Sprint(v...), nil)
+}
+
+// Error logs an error message for the component
+func (b *LogBook) Error(component string, v ...interface{}) {
+	b.Log(LevelError, component, fmt.Sprint(v...), nil)
+}
+
+// Log adds an entry with the structured fields to the log book,
+// if the level is logged for the component
+func (b *LogBook) Log(level string, component string, msg string, fields map[string]interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if logLevels[level] < logLevels[b.minLevel(component)] {
+		return
+	}
+
+	msg = b.redact(msg)
+	for k, v := range fields {
+		if s, ok := v.(string); ok {
+			fields[k] = b.redact(s)
+		}
+	}
+	b.seq++
+	e := LogEntry{
+		Seq:       b.seq,
+		Time:      time.Now(),
+		Level:     level,
+		Component: component,
+		Message:   msg,
+		Fields:    fields,
+	}
+	b.add(e)
+	b.writeFile(e)
+
+	if b.Sink != nil {
+		switch level {
+		case LevelError:
+			b.Sink.Error(e.sinkText())
+		case LevelWarning:
+			b.Sink.Warning(e.sinkText())
+		default:
+			b.Sink.Info(e.sinkText())
+		}
+	}
+}
+
+// minLevel returns the minimum level logged for the component
+func (b *LogBook) minLevel(component string) string {
+	if l, ok := b.levels[strings.ToLower(component)]; ok {
+		return l
+	}
+	if b.level == "" {
+		return LevelInfo
+	}
+	return b.level
+}
+
+// Enabled checks if the level is logged for the component
+func (b *LogBook) Enabled(level string, component string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return logLevels[level] >= logLevels[b.minLevel(component)]
+}
+
+// SetLevels sets the minimum level logged and the levels of the components,
+// replacing the current levels. Levels that are not valid are ignored.
+func (b *LogBook) SetLevels(level string, levels map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.level, _ = parseLogLevel(level)
+	b.levels = map[string]string{}
+	for n, lvl := range levels {
+		if l, err := parseLogLevel(lvl); err == nil {
+			b.levels[strings.ToLower(n)] = l
+		}
+	}
+}
+
+// SetLevel sets the minimum level logged for the component or, if no component is
+// specified, the default level. An empty level removes the level of the component.
+func (b *LogBook) SetLevel(component string, level string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case component == "":
+		b.level = l
+	case l == "":
+		delete(b.levels, strings.ToLower(component))
+	default:
+		if b.levels == nil {
+			b.levels = map[string]string{}
+		}
+		b.levels[strings.ToLower(component)] = l
+	}
+	return nil
+}
+
+// Levels returns the minimum level logged and the levels of the components
+func (b *LogBook) Levels() (string, map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.minLevel(""), copyMap(b.levels)
+}
+
+// parseLogLevel checks the level name, accepting warn for warning, in any case
+func parseLogLevel(level string) (string, error) {
+	l := strings.ToLower(level)
+	if l == "warn" {
+		l = LevelWarning
+	}
+	if _, ok := logLevels[l]; !ok && l != "" {
+		return "", fmt.Errorf("'%s' is not a level. Use debug, info, warning or error", level)
+	}
+	return l, nil
+}
+
+// add adds the entry to the ring
+func (b *LogBook) add(e LogEntry) {
+	if len(b.entries) < logRingSize {
+		b.entries = append(b.entries, e)
+		return
+	}
+	b.entries[b.next] = e
+	b.next = (b.next + 1) % logRingSize
+}
+
+// Open reads the entries in the log file, and the file it was rotated to, into the ring
+// and then appends the new entries to the file. Entries logged before the file was
+// opened are written to it.
+func (b *LogBook) Open(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pending := b.list()
+	b.entries = nil
+	b.next = 0
+	for _, p := range []string{path + ".1", path} {
+		for _, e := range readLogFile(p) {
+			b.add(e)
+			if e.Seq > b.seq {
+				b.seq = e.Seq
+			}
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		for _, e := range pending {
+			b.add(e)
+		}
+		return err
+	}
+	b.path = path
+	b.file = f
+	if fi, err := f.Stat(); err == nil {
+		b.size = fi.Size()
+	}
+	for _, e := range pending {
+		b.seq++
+		e.Seq = b.seq
+		b.add(e)
+		b.writeFile(e)
+	}
+	return nil
+}
+
+// Close closes the log file
+func (b *LogBook) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+}
+
+// writeFile appends the entry to the log file, rotating it if it is too large
+func (b *LogBook) writeFile(e LogEntry) {
+	if b.file == nil {
+		return
+	}
+	if b.size >= logFileMaxSize {
+		b.file.Close()
+		os.Rename(b.path, b.path+".1")
+		f, err := os.OpenFile(b.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			b.file = nil
+			return
+		}
+		b.file = f
+		b.size = 0
+	}
+	l, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	n, _ := b.file.Write(append(l, '\n'))
+	b.size += int64(n)
+}
+
+// readLogFile reads the entries in the log file, skipping any lines that cannot be read
+func readLogFile(path string) []LogEntry {
+	l := []LogEntry{}
+	f, err := os.Open(path)
+	if err != nil {
+		return l
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		e := LogEntry{}
+		if json.Unmarshal(sc.Bytes(), &e) == nil {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// list returns the entries in the ring, oldest first
+func (b *LogBook) list() []LogEntry {
+	l := make([]LogEntry, 0, len(b.entries))
+	l = append(l, b.entries[b.next:]...)
+	return append(l, b.entries[:b.next]...)
+}
+
+// Query returns the entries that match the query, oldest first
+func (b *LogBook) Query(q LogQuery) []LogEntry {
+	b.mu.Lock()
+	all := b.list()
+	b.mu.Unlock()
+
+	min := logLevels[q.Level]
+	text := strings.ToLower(q.Text)
+	l := []LogEntry{}
+	for _, e := range all {
+		if logLevels[e.Level] < min {
+			continue
+		}
+		if !q.Since.IsZero() && e.Time.Before(q.Since) {
+			continue
+		}
+		if !q.Until.IsZero() && e.Time.After(q.Until) {
+			continue
+		}
+		if len(q.Components) != 0 && !containsFold(q.Components, e.Component) {
+			continue
+		}
+		if text != "" && !strings.Contains(strings.ToLower(e.Message+" "+e.fieldText()), text) {
+			continue
+		}
+		l = append(l, e)
+	}
+	if q.Limit > 0 && len(l) > q.Limit {
+		l = l[len(l)-q.Limit:]
+	}
+	return l
+}
+
+// containsFold checks if the list contains the value, ignoring case
+func containsFold(l []string, v string) bool {
+	for _, s := range l {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSecrets sets the secret values that must be removed from the messages
+func (b *LogBook) SetSecrets(secrets []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.secrets = []string{}
+	for _, s := range secrets {
+		// Very short values would remove too much of the messages
+		if len(s) >= 4 {
+			b.secrets = append(b.secrets, s)
+		}
+	}
+}
+
+// redact returns the message with the secrets removed
+func (b *LogBook) redact(msg string) string {
+	for _, s := range b.secrets {
+		msg = strings.Replace(msg, s, redacted, -1)
+	}
+	return msg
+}
+
+// setLogSecrets sets the secrets that must be removed from the log messages
+func setLogSecrets(c *Config) {
+	logs.SetSecrets(c.SecretValues())
+}
+
+// levelTags holds the tag written to the service logger for each level
+var levelTags = map[string]string{LevelDebug: "[Dbg]", LevelInfo: "[Inf]", LevelWarning: "[Wrn]", LevelError: "[Err]"}
+
+// sinkText returns the text written to the service logger
+func (e *LogEntry) sinkText() string {
+	s := e.Component + ": " + levelTags[e.Level] + " " + e.Message
+	if f := e.fieldText(); f != "" {
+		s += " " + f
+	}
+	return s
+}
+
+// fieldText returns the fields as key=value pairs, sorted by key
+func (e *LogEntry) fieldText() string {
+	if len(e.Fields) == 0 {
+		return ""
+	}
+	keys := []string{}
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	l := []string{}
+	for _, k := range keys {
+		l = append(l, fmt.Sprintf("%s=%v", k, e.Fields[k]))
+	}
+	return strings.Join(l, " ")
+}
+
+// WriteText writes the entry as a line of text
+func (e *LogEntry) WriteText(w io.Writer) {
+	s := fmt.Sprintf("%s %-7s %s: %s", e.Time.Format(time.RFC3339), strings.ToUpper(e.Level), e.Component, e.Message)
+	if f := e.fieldText(); f != "" {
+		s += " " + f
+	}
+	fmt.Fprintln(w, s)
+}
+
+// componentLogger is a service logger that writes to the log book as a component,
+// used by libraries that log through a service.Logger
+type componentLogger struct {
+	component string
+}
+
+// Error logs an error message
+func (l componentLogger) Error(v ...interface{}) error {
+	logs.Log(LevelError, l.component, fmt.Sprint(v...), nil)
+	return nil
+}
+
+// Warning logs a warning message
+func (l componentLogger) Warning(v ...interface{}) error {
+	logs.Log(LevelWarning, l.component, fmt.Sprint(v...), nil)
+	return nil
+}
+
+// Info logs an information message
+func (l componentLogger) Info(v ...interface{}) error {
+	logs.Log(LevelInfo, l.component, fmt.Sprint(v...), nil)
+	return nil
+}
+
+// Errorf logs a formatted error message
+func (l componentLogger) Errorf(format string, v ...interface{}) error {
+	logs.Log(LevelError, l.component, fmt.Sprintf(format, v...), nil)
+	return nil
+}
+
+// Warningf logs a formatted warning message
+func (l componentLogger) Warningf(format string, v ...interface{}) error {
+	logs.Log(LevelWarning, l.component, fmt.Sprintf(format, v...), nil)
+	return nil
+}
+
+// Infof logs a formatted information message
+func (l componentLogger) Infof(format string, v ...interface{}) error {
+	logs.Log(LevelInfo, l.component, fmt.Sprintf(format, v...), nil)
+	return nil
+}
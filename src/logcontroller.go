@@ -1,42 +1,164 @@
-package main
-
-import (
-	"fmt"
-	"net/http"
-	"os/exec"
-
-	gopifinder "github.com/brumawen/gopi-finder/src"
-	"github.com/gorilla/mux"
-)
-
-// LogController handles the Web Methods for reading log records.
-type LogController struct {
-	Srv *Server
-}
-
-// AddController adds the controller routes to the router
-func (c *LogController) AddController(router *mux.Router, s *Server) {
-	c.Srv = s
-	router.Methods("GET").Path("/log/get").Name("GetLogs").
-		Handler(Logger(c, http.HandlerFunc(c.handleGetLogs)))
-}
-
-func (c *LogController) handleGetLogs(w http.ResponseWriter, r *http.Request) {
-	myInfo, err := gopifinder.NewDeviceInfo()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	if myInfo.OS != "Linux" {
-		http.Error(w, "Not supported.", 500)
-		return
-	}
-	out, _ := exec.Command("journalctl", "--no-pager", "-u", "PowerMonitor", "-S", "1 hour ago").CombinedOutput()
-	w.Write([]byte(out))
-}
-
-// LogInfo is used to log information messages for this controller.
-func (c *LogController) LogInfo(v ...interface{}) {
-	a := fmt.Sprint(v...)
-	logger.Info("LogController: ", a)
-}
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// LogController handles the Web Methods for reading log records.
+type LogController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *LogController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/log/get").Name("GetLogs").
+		Handler(Logger(c, Authorize(s, RoleAdmin, http.HandlerFunc(c.handleGetLogs))))
+	router.Methods("GET").Path("/log/level").Name("GetLogLevel").
+		Handler(Logger(c, Authorize(s, RoleRead, http.HandlerFunc(c.handleGetLogLevel))))
+	router.Methods("PUT").Path("/log/level").Name("SetLogLevel").
+		Handler(Logger(c, Authorize(s, RoleAdmin, http.HandlerFunc(c.handleSetLogLevel))))
+}
+
+// logLevelRequest holds the log level to set
+type logLevelRequest struct {
+	Component string `json:"component"` // Component, or empty for the default level
+	Level     string `json:"level"`     // Level, or empty to remove the level of the component
+}
+
+// logLevelReport holds the log levels in use
+type logLevelReport struct {
+	Level      string            `json:"level"`      // Minimum level logged
+	Components map[string]string `json:"components"` // Minimum level logged for each component
+}
+
+// handleGetLogs will return the log entries matching the query parameters:
+//
+//	level      minimum level (debug, info, warning or error)
+//	component  comma separated list of components, e.g. Power,Mqtt
+//	since      RFC3339 time, or a duration before now such as 1h (default 1h)
+//	until      RFC3339 time, or a duration before now
+//	q          text the entries contain
+//	limit      maximum number of entries, keeping the latest (default 1000)
+//	format     text (default) or json
+func (c *LogController) handleGetLogs(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	q := LogQuery{
+		Level: strings.ToLower(v.Get("level")),
+		Text:  v.Get("q"),
+		Limit: 1000,
+	}
+	if q.Level != "" {
+		if _, ok := logLevels[q.Level]; !ok {
+			http.Error(w, "Invalid level. Use debug, info, warning or error.", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := v.Get("component"); s != "" {
+		q.Components = strings.Split(s, ",")
+	}
+	since := v.Get("since")
+	if since == "" {
+		since = "1h"
+	}
+	var err error
+	if q.Since, err = parseLogTime(since); err != nil {
+		http.Error(w, "Invalid since. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = parseLogTime(s); err != nil {
+			http.Error(w, "Invalid until. "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 {
+			http.Error(w, "Invalid limit.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	l := logs.Query(q)
+	if v.Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		b, err := json.Marshal(l)
+		if err != nil {
+			http.Error(w, "Error serializing log entries", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(b)
+		return
+	}
+	w.Header().Set("content-type", "text/plain; charset=utf-8")
+	for _, e := range l {
+		e.WriteText(w)
+	}
+}
+
+// handleGetLogLevel will return the log levels in use
+func (c *LogController) handleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	c.writeLevels(w)
+}
+
+// handleSetLogLevel will set the default log level or the log level of a component.
+// The level is kept until the service restarts or the logging configuration changes.
+func (c *LogController) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	req := logLevelRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Component == "" && req.Level == "" {
+		http.Error(w, "Invalid request. The level is required.", http.StatusBadRequest)
+		return
+	}
+	if err := logs.SetLevel(req.Component, req.Level); err != nil {
+		http.Error(w, "Invalid level. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Component == "" {
+		c.LogInfo("Log level set to ", req.Level)
+	} else {
+		c.LogInfo("Log level of ", req.Component, " set to '", req.Level, "'")
+	}
+	c.writeLevels(w)
+}
+
+// writeLevels writes the log levels in use to the response
+func (c *LogController) writeLevels(w http.ResponseWriter) {
+	rep := logLevelReport{}
+	rep.Level, rep.Components = logs.Levels()
+	b, err := json.Marshal(rep)
+	if err != nil {
+		http.Error(w, "Error serializing log levels", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+}
+
+// parseLogTime parses an RFC3339 time or a duration before now
+func parseLogTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("use an RFC3339 time or a duration such as 1h")
+	}
+	return t, nil
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *LogController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("LogController", a)
+}
@@ -1,15 +1,33 @@
-package main
-
-import (
-	"net/http"
-	"time"
-)
-
-// Logger will create a Logger Handler wrapper for the specified handler.
-func Logger(c Controller, inner http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		inner.ServeHTTP(w, r)
-		c.LogInfo(r.Method, r.RequestURI, "from", r.RemoteAddr, "tool", time.Since(start))
-	})
-}
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// Logger will create a Logger Handler wrapper for the specified handler.
+// The request is logged with the name of the controller as the component.
+func Logger(c Controller, inner http.Handler) http.Handler {
+	component := reflect.TypeOf(c).Elem().Name()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		inner.ServeHTTP(w, r)
+		logs.Log(LevelInfo, component, r.Method+" "+logURI(r), map[string]interface{}{
+			"remote":   r.RemoteAddr,
+			"duration": time.Since(start).String(),
+		})
+	})
+}
+
+// logURI returns the request URI with any API key sent as a query parameter removed
+func logURI(r *http.Request) string {
+	q := r.URL.Query()
+	if _, ok := q["apikey"]; !ok {
+		return r.RequestURI
+	}
+	q.Set("apikey", redacted)
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
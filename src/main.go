@@ -1,69 +1,421 @@
-package main
-
-import (
-	"flag"
-	"fmt"
-	"log"
-	"strings"
-
-	"github.com/kardianos/service"
-)
-
-var logger service.Logger
-
-func main() {
-	port := flag.Int("p", 20518, "Port Number to listen on.")
-	svcFlag := flag.String("service", "", "Service action.  Valid actions are: 'start', 'stop', 'restart', 'install' and 'uninstall'")
-	flag.Parse()
-
-	// Create a new server
-	s := &Server{
-		PortNo: *port,
-	}
-
-	// Create the service
-	svcConfig := &service.Config{
-		Name:        "PowerMonitor",
-		DisplayName: "PowerMonitor",
-		Description: "Monitors power usage.",
-	}
-	v, err := service.New(s, svcConfig)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Set up the logger
-	errs := make(chan error, 5)
-	logger, err = v.Logger(errs)
-	if err != nil {
-		log.Fatal(err)
-	}
-	go func() {
-		for {
-			err := <-errs
-			if err != nil {
-				log.Print(err)
-			}
-		}
-	}()
-
-	// Start the service
-	if *svcFlag != "" {
-		// Service control request
-		if err := service.Control(v, *svcFlag); err != nil {
-			e := err.Error()
-			if strings.Contains(e, "Unknown action") {
-				fmt.Println(*svcFlag, "is an invalid action.")
-				fmt.Println("Valid actions are", service.ControlAction)
-			} else {
-				fmt.Println(err.Error())
-			}
-		}
-	} else {
-		// Start the service in debug if we are running in a terminal
-		s.VerboseLogging = service.Interactive()
-		if err := v.Run(); err != nil {
-			log.Fatal(err)
-		}
-	}
-}
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+func main() {
+	port := flag.Int("p", 20518, "Port Number to listen on.")
+	svcFlag := flag.String("service", "", "Service action.  Valid actions are: 'start', 'stop', 'restart', 'install' and 'uninstall'")
+	checkFlag := flag.Bool("check-config", false, "Check the configuration file and exit.")
+	configFlag := flag.String("config", os.Getenv("POWER_CONFIG"), "Path to the configuration file. Defaults to config.json in the application directory.")
+	addKeyFlag := flag.String("add-key", "", "Add an API key, in the form name[:role], to the configuration file and print it. The role is 'read' (default) or 'admin'.")
+	removeKeyFlag := flag.String("remove-key", "", "Remove the named API key from the configuration file.")
+	addUserFlag := flag.String("add-user", "", "Add a user, in the form name[:role], to the configuration file. The password is read from the standard input.")
+	removeUserFlag := flag.String("remove-user", "", "Remove the named user from the configuration file.")
+	listAuthFlag := flag.Bool("list-auth", false, "List the API keys and users in the configuration file.")
+	calibrateFlag := flag.String("calibrate", "", "Calibrate the flash rate of the running service. Valid actions are: 'start:<reading>', 'finish:<reading>', 'status', 'apply' and 'cancel', where the reading is the units shown on the meter keypad.")
+	apiKeyFlag := flag.String("api-key", os.Getenv("POWER_API_KEY"), "Admin API key used by -calibrate, if access is restricted.")
+	configValues := map[string]string{}
+	AddConfigFlags(flag.CommandLine, configValues)
+	flag.Parse()
+
+	// The service runs in the application directory, so make the path absolute
+	configPath := *configFlag
+	if configPath != "" {
+		if p, err := filepath.Abs(configPath); err == nil {
+			configPath = p
+		}
+	}
+
+	if *checkFlag {
+		os.Exit(checkConfig(configPath, configValues))
+	}
+	switch {
+	case *addKeyFlag != "":
+		os.Exit(manageAuth(configPath, "add-key", *addKeyFlag))
+	case *removeKeyFlag != "":
+		os.Exit(manageAuth(configPath, "remove-key", *removeKeyFlag))
+	case *addUserFlag != "":
+		os.Exit(manageAuth(configPath, "add-user", *addUserFlag))
+	case *removeUserFlag != "":
+		os.Exit(manageAuth(configPath, "remove-user", *removeUserFlag))
+	case *listAuthFlag:
+		os.Exit(manageAuth(configPath, "list", ""))
+	case *calibrateFlag != "":
+		os.Exit(calibrate(configPath, *port, *apiKeyFlag, *calibrateFlag))
+	}
+
+	// Create a new server
+	s := &Server{
+		PortNo:      *port,
+		ConfigPath:  configPath,
+		ConfigFlags: configValues,
+	}
+
+	// Create the service
+	svcConfig := &service.Config{
+		Name:        "PowerMonitor",
+		DisplayName: "PowerMonitor",
+		Description: "Monitors power usage.",
+		Option: service.KeyValue{
+			"SystemdScript": systemdScript,
+			"ReloadSignal":  "HUP",
+		},
+	}
+	v, err := service.New(s, svcConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Set up the logger
+	errs := make(chan error, 5)
+	l, err := v.Logger(errs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logs.Sink = l
+	go func() {
+		for {
+			err := <-errs
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}()
+
+	// Start the service
+	if *svcFlag != "" {
+		// Service control request
+		if err := service.Control(v, *svcFlag); err != nil {
+			e := err.Error()
+			if strings.Contains(e, "Unknown action") {
+				fmt.Println(*svcFlag, "is an invalid action.")
+				fmt.Println("Valid actions are", service.ControlAction)
+			} else {
+				fmt.Println(err.Error())
+			}
+		}
+	} else {
+		// Start the service in debug if we are running in a terminal
+		s.VerboseLogging = service.Interactive()
+		if err := v.Run(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// checkConfig validates the configuration, with the environment variable and command
+// line flag overrides applied, prints any problems found and returns the exit code
+func checkConfig(path string, flags map[string]string) int {
+	path = appConfigPath(path)
+	c, err := LoadConfig(path, flags)
+	if err == nil {
+		err = c.Validate()
+	}
+	if err != nil {
+		fmt.Println("Configuration file", path, "is not valid:")
+		if errs, ok := err.(ConfigErrors); ok {
+			for _, e := range errs {
+				fmt.Println(" ", e.Error())
+			}
+		} else {
+			fmt.Println(" ", err.Error())
+		}
+		return 1
+	}
+	fmt.Println("Configuration file", path, "is valid.")
+	return 0
+}
+
+// appConfigPath returns the configuration file path, defaulting to
+// config.json in the application directory
+func appConfigPath(path string) string {
+	if path == "" {
+		path = "config.json"
+		if app, err := os.Executable(); err == nil {
+			path = filepath.Join(filepath.Dir(app), path)
+		}
+	}
+	return path
+}
+
+// manageAuth adds, removes or lists the API keys and users in the configuration
+// file and returns the exit code. A running service reloads the changed file.
+func manageAuth(path string, action string, arg string) int {
+	path = appConfigPath(path)
+	c := &Config{}
+	if err := c.ReadFromFile(path); err != nil {
+		fmt.Println("Error reading configuration file", path, "-", err.Error())
+		return 1
+	}
+
+	name, role := arg, RoleRead
+	if i := strings.LastIndex(arg, ":"); i >= 0 {
+		name, role = arg[:i], arg[i+1:]
+	}
+	if action == "add-key" || action == "add-user" {
+		if name == "" || (role != RoleRead && role != RoleAdmin) {
+			fmt.Println("Specify the name and, optionally, the role 'read' or 'admin' as name[:role].")
+			return 1
+		}
+	}
+
+	newKey := ""
+	switch action {
+	case "list":
+		for _, k := range c.APIKeys {
+			fmt.Println("key ", k.Name, k.Role)
+		}
+		for _, u := range c.Users {
+			fmt.Println("user", u.Username, u.Role)
+		}
+		if !c.AuthEnabled() {
+			fmt.Println("No API keys or users are configured, so access is not restricted.")
+		}
+		return 0
+	case "add-key":
+		for _, k := range c.APIKeys {
+			if k.Name == name {
+				fmt.Println("An API key named", name, "already exists.")
+				return 1
+			}
+		}
+		key, hash, err := NewAPIKey()
+		if err != nil {
+			fmt.Println("Error generating API key.", err.Error())
+			return 1
+		}
+		c.APIKeys = append(c.APIKeys, APIKey{Name: name, Key: hash, Role: role})
+		newKey = key
+	case "remove-key":
+		l := []APIKey{}
+		for _, k := range c.APIKeys {
+			if k.Name != name {
+				l = append(l, k)
+			}
+		}
+		if len(l) == len(c.APIKeys) {
+			fmt.Println("There is no API key named", name)
+			return 1
+		}
+		c.APIKeys = l
+	case "add-user":
+		for _, u := range c.Users {
+			if u.Username == name {
+				fmt.Println("A user named", name, "already exists.")
+				return 1
+			}
+		}
+		fmt.Print("Password for ", name, ": ")
+		pw, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		pw = strings.TrimRight(pw, "\r\n")
+		if err != nil && pw == "" {
+			fmt.Println("Error reading password.", err.Error())
+			return 1
+		}
+		if len(pw) < 8 {
+			fmt.Println("The password must be at least 8 characters.")
+			return 1
+		}
+		hash, err := HashPassword(pw)
+		if err != nil {
+			fmt.Println("Error hashing password.", err.Error())
+			return 1
+		}
+		c.Users = append(c.Users, APIUser{Username: name, Password: hash, Role: role})
+	case "remove-user":
+		l := []APIUser{}
+		for _, u := range c.Users {
+			if u.Username != name {
+				l = append(l, u)
+			}
+		}
+		if len(l) == len(c.Users) {
+			fmt.Println("There is no user named", name)
+			return 1
+		}
+		c.Users = l
+	}
+
+	if err := c.WriteToFile(path); err != nil {
+		fmt.Println("Error saving configuration file", path, "-", err.Error())
+		return 1
+	}
+	fmt.Println("Configuration file", path, "updated.")
+	if newKey != "" {
+		fmt.Println("API key for", name, "("+role+"). It cannot be shown again:")
+		fmt.Println(newKey)
+	}
+	return 0
+}
+
+// calibrate runs a calibration action against the running service, prints the
+// progress or results and returns the exit code. After finishing, it offers to
+// save the suggested flash rate and sensor threshold to the configuration.
+func calibrate(path string, port int, apiKey string, arg string) int {
+	action, value := arg, ""
+	if i := strings.Index(arg, ":"); i >= 0 {
+		action, value = arg[:i], arg[i+1:]
+	}
+
+	c := &Config{}
+	if err := c.ReadFromFile(appConfigPath(path)); err != nil {
+		fmt.Println("Error reading configuration file -", err.Error())
+		return 1
+	}
+	api := calibrationClient{URL: fmt.Sprintf("http://localhost:%d/calibrate", port), Key: apiKey}
+	if c.EnableTLS {
+		// The service usually has a self-signed certificate
+		api.URL = fmt.Sprintf("https://localhost:%d/calibrate", port)
+		api.Client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+
+	var body interface{}
+	switch action {
+	case "start", "finish":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			fmt.Println("Specify the units shown on the meter keypad as", action+":<reading>.")
+			return 1
+		}
+		body = readingRequest{Reading: &v}
+	case "status", "apply", "cancel":
+	default:
+		fmt.Println(action, "is an invalid action.")
+		fmt.Println("Valid actions are start:<reading>, finish:<reading>, status, apply and cancel")
+		return 1
+	}
+
+	rep := CalibrationReport{}
+	var err error
+	switch action {
+	case "start", "finish":
+		err = api.do("POST", "/"+action, body, &rep)
+	case "status":
+		err = api.do("GET", "", nil, &rep)
+	case "cancel":
+		err = api.do("DELETE", "", nil, &rep)
+	case "apply":
+		return applyCalibration(api)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	printCalibration(rep)
+	if action != "finish" {
+		return 0
+	}
+
+	fmt.Print("Save a flash rate of ", rep.SuggestedFlashRate)
+	if rep.Light.SuggestedThreshold > 0 {
+		fmt.Print(" and a sensor threshold of ", rep.Light.SuggestedThreshold)
+	}
+	fmt.Print(" to the configuration? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		fmt.Println("Configuration not changed. Run with -calibrate apply to save it later.")
+		return 0
+	}
+	return applyCalibration(api)
+}
+
+// applyCalibration saves the suggested values of the finished calibration and returns the exit code
+func applyCalibration(api calibrationClient) int {
+	nc := Config{}
+	if err := api.do("POST", "/apply", nil, &nc); err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Println("Configuration updated. Flash rate is", nc.FlashRate, "and sensor threshold is", nc.SensorThreshold)
+	return 0
+}
+
+// printCalibration prints the progress or results of the calibration
+func printCalibration(r CalibrationReport) {
+	fmt.Println("Calibration is", r.State)
+	if r.Start != nil {
+		fmt.Printf("  First reading:  %.1f units at %s\n", r.Start.Reading, r.Start.Time.Local().Format(time.RFC1123))
+	}
+	if r.End != nil {
+		fmt.Printf("  Second reading: %.1f units at %s\n", r.End.Reading, r.End.Time.Local().Format(time.RFC1123))
+	}
+	if r.State != CalibrationIdle {
+		fmt.Println("  Pulses counted:", r.Pulses, "accepted,", r.Rejected, "rejected")
+	}
+	if r.State == CalibrationFinished {
+		fmt.Printf("  Units used:     %.3f (%.1f topped up)\n", r.Used, r.TopUps)
+		fmt.Printf("  Measured rate:  %.1f impulses per kWh (±%.1f%%)\n", r.MeasuredRate, r.Uncertainty)
+		fmt.Println("  Flash rate:    ", r.FlashRate, "configured,", r.SuggestedFlashRate, "suggested")
+		fmt.Printf("  Accuracy:       %.1f%% of the expected pulses detected\n", r.Accuracy)
+	}
+	l := r.Light
+	if l.Reports > 0 {
+		fmt.Printf("  Light levels:   %.3f dark, %.3f lit, from %d reports\n", l.Dark, l.Lit, l.Reports)
+	}
+	if l.SuggestedThreshold > 0 {
+		fmt.Println("  Threshold:     ", l.Threshold, "configured,", l.SuggestedThreshold, "suggested")
+	} else {
+		fmt.Println("  Threshold:     ", l.Threshold, "configured")
+	}
+}
+
+// calibrationClient calls the calibration API of the running service
+type calibrationClient struct {
+	URL    string      // Calibration API URL
+	Key    string      // API key
+	Client http.Client // HTTP client
+}
+
+// do sends the request and decodes the response into the result
+func (a *calibrationClient) do(method string, path string, body interface{}, result interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, a.URL+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	if a.Key != "" {
+		req.Header.Set("X-API-Key", a.Key)
+	}
+	a.Client.Timeout = 30 * time.Second
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot connect to the service, is it running? %s", err.Error())
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return json.Unmarshal(b, result)
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+	mqttBadLogin    = 4 // CONNACK return code for a bad username or password
+	mqttProtocol311 = 4 // Protocol level of MQTT 3.1.1
+)
+
+// brokerMessage is a message published to the fake broker
+type brokerMessage struct {
+	Topic    string
+	Payload  string
+	QoS      byte
+	Retained bool
+}
+
+// fakeBroker is an in-process MQTT 3.1.1 broker that keeps the messages published to it.
+// It handles CONNECT, PUBLISH, SUBSCRIBE, PINGREQ and DISCONNECT, which is enough for the
+// paho client, and forwards the messages to the clients that subscribed to the exact topic.
+type fakeBroker struct {
+	Username string // Username the clients must connect with
+	Password string // Password the clients must connect with
+	ln       net.Listener
+	conns    map[net.Conn]bool
+	subs     map[string][]net.Conn
+	messages []brokerMessage
+	retained map[string]brokerMessage
+	connects int
+	mu       sync.Mutex
+}
+
+// newFakeBroker starts a broker on a local port that accepts the username and password
+func newFakeBroker(t *testing.T, username string, password string) *fakeBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{
+		Username: username,
+		Password: password,
+		ln:       ln,
+		conns:    map[net.Conn]bool{},
+		subs:     map[string][]net.Conn{},
+		retained: map[string]brokerMessage{},
+	}
+	go b.accept()
+	t.Cleanup(b.Close)
+	return b
+}
+
+// URL returns the address the clients connect to
+func (b *fakeBroker) URL() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+// Close stops the broker and drops the connections
+func (b *fakeBroker) Close() {
+	b.ln.Close()
+	b.Drop()
+}
+
+// Drop drops the client connections, as if the network failed
+func (b *fakeBroker) Drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		c.Close()
+	}
+}
+
+// Connects returns the number of successful connections
+func (b *fakeBroker) Connects() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.connects
+}
+
+// Messages returns the messages published to the topic, oldest first
+func (b *fakeBroker) Messages(topic string) []brokerMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l := []brokerMessage{}
+	for _, m := range b.messages {
+		if m.Topic == topic {
+			l = append(l, m)
+		}
+	}
+	return l
+}
+
+// Retained returns the retained message of the topic
+func (b *fakeBroker) Retained(topic string) (brokerMessage, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := b.retained[topic]
+	return m, ok
+}
+
+// WaitMessages waits until n messages have been published to the topic and returns them
+func (b *fakeBroker) WaitMessages(t *testing.T, topic string, n int) []brokerMessage {
+	t.Helper()
+	waitFor(t, "messages on "+topic, func() bool { return len(b.Messages(topic)) >= n })
+	return b.Messages(topic)
+}
+
+// accept serves the client connections until the broker is closed
+func (b *fakeBroker) accept() {
+	for {
+		c, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conns[c] = true
+		b.mu.Unlock()
+		go b.serve(c)
+	}
+}
+
+// serve handles the packets sent by a client until it disconnects
+func (b *fakeBroker) serve(c net.Conn) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, c)
+		for topic, l := range b.subs {
+			for i, sc := range l {
+				if sc == c {
+					b.subs[topic] = append(l[:i], l[i+1:]...)
+					break
+				}
+			}
+		}
+		b.mu.Unlock()
+		c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	connected := false
+	for {
+		typ, flags, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		if !connected && typ != mqttConnect {
+			return
+		}
+		switch typ {
+		case mqttConnect:
+			code := b.checkConnect(body)
+			b.write(c, mqttConnack<<4, []byte{0, code})
+			if code != 0 {
+				return
+			}
+			connected = true
+			b.mu.Lock()
+			b.connects++
+			b.mu.Unlock()
+		case mqttPublish:
+			m, id, err := parsePublish(flags, body)
+			if err != nil {
+				return
+			}
+			if m.QoS > 0 {
+				b.write(c, mqttPuback<<4, id)
+			}
+			b.publish(m)
+		case mqttSubscribe:
+			ack, retained, err := b.subscribe(c, body)
+			if err != nil {
+				return
+			}
+			b.write(c, mqttSuback<<4, ack)
+			for _, m := range retained {
+				b.send(c, m)
+			}
+		case mqttPingreq:
+			b.write(c, mqttPingresp<<4, nil)
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+// checkConnect checks the CONNECT packet and returns the CONNACK return code
+func (b *fakeBroker) checkConnect(body []byte) byte {
+	p := &packetReader{b: body}
+	if p.string() != "MQTT" || p.byte() != mqttProtocol311 {
+		return 1 // Unacceptable protocol version
+	}
+	flags := p.byte()
+	p.uint16() // Keep alive
+	p.string() // Client identifier
+	if flags&0x04 != 0 {
+		p.string() // Will topic
+		p.string() // Will message
+	}
+	username, password := "", ""
+	if flags&0x80 != 0 {
+		username = p.string()
+	}
+	if flags&0x40 != 0 {
+		password = p.string()
+	}
+	if p.err != nil || username != b.Username || password != b.Password {
+		return mqttBadLogin
+	}
+	return 0
+}
+
+// subscribe registers the topics of the SUBSCRIBE packet and returns the SUBACK body
+// and the retained messages of the topics
+func (b *fakeBroker) subscribe(c net.Conn, body []byte) ([]byte, []brokerMessage, error) {
+	p := &packetReader{b: body}
+	ack := p.next(2)
+	retained := []brokerMessage{}
+	b.mu.Lock()
+	for p.err == nil && len(p.b) > 0 {
+		topic := p.string()
+		ack = append(ack, p.byte()&0x03)
+		b.subs[topic] = append(b.subs[topic], c)
+		if m, ok := b.retained[topic]; ok {
+			retained = append(retained, m)
+		}
+	}
+	b.mu.Unlock()
+	if p.err != nil {
+		return nil, nil, p.err
+	}
+	return ack, retained, nil
+}
+
+// publish keeps the message and forwards it to the subscribers
+func (b *fakeBroker) publish(m brokerMessage) {
+	b.mu.Lock()
+	b.messages = append(b.messages, m)
+	if m.Retained {
+		b.retained[m.Topic] = m
+	}
+	subs := append([]net.Conn(nil), b.subs[m.Topic]...)
+	b.mu.Unlock()
+	for _, c := range subs {
+		b.send(c, brokerMessage{Topic: m.Topic, Payload: m.Payload})
+	}
+}
+
+// send sends a message to a subscriber at QoS 0
+func (b *fakeBroker) send(c net.Conn, m brokerMessage) {
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(m.Topic)))
+	body = append(body, m.Topic...)
+	body = append(body, m.Payload...)
+	var flags byte
+	if m.Retained {
+		flags = 0x01
+	}
+	b.write(c, mqttPublish<<4|flags, body)
+}
+
+// write writes a packet to the client
+func (b *fakeBroker) write(c net.Conn, header byte, body []byte) {
+	p := []byte{header}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		p = append(p, d)
+		if n == 0 {
+			break
+		}
+	}
+	c.Write(append(p, body...))
+}
+
+// readPacket reads a control packet and returns its type, flags and body
+func readPacket(r *bufio.Reader) (byte, byte, []byte, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	n, mul := 0, 1
+	for i := 0; ; i++ {
+		d, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if i == 4 {
+			return 0, 0, nil, errors.New("malformed remaining length")
+		}
+		n += int(d&0x7f) * mul
+		mul *= 128
+		if d&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return h >> 4, h & 0x0f, body, nil
+}
+
+// parsePublish returns the message and packet identifier of a PUBLISH packet
+func parsePublish(flags byte, body []byte) (brokerMessage, []byte, error) {
+	p := &packetReader{b: body}
+	m := brokerMessage{QoS: (flags >> 1) & 0x03, Retained: flags&0x01 != 0}
+	m.Topic = p.string()
+	var id []byte
+	if m.QoS > 0 {
+		id = p.next(2)
+	}
+	m.Payload = string(p.b)
+	return m, id, p.err
+}
+
+// packetReader reads the fields of a packet body
+type packetReader struct {
+	b   []byte
+	err error
+}
+
+// next returns the next n bytes
+func (p *packetReader) next(n int) []byte {
+	if p.err != nil || len(p.b) < n {
+		p.err = errors.New("packet is too short")
+		return make([]byte, n)
+	}
+	v := append([]byte(nil), p.b[:n]...)
+	p.b = p.b[n:]
+	return v
+}
+
+// byte returns the next byte
+func (p *packetReader) byte() byte {
+	return p.next(1)[0]
+}
+
+// uint16 returns the next two byte integer
+func (p *packetReader) uint16() int {
+	return int(binary.BigEndian.Uint16(p.next(2)))
+}
+
+// string returns the next length prefixed string
+func (p *packetReader) string() string {
+	return string(p.next(p.uint16()))
+}
+
+// newMqttServer returns a test server that publishes to the broker
+func newMqttServer(t *testing.T, b *fakeBroker) *Server {
+	s, _ := newTestServer(t)
+	s.GetConfig().EnableMqtt = true
+	s.GetConfig().MqttHost = b.URL()
+	s.GetConfig().MqttUsername = "power"
+	s.GetConfig().MqttPassword = "secret"
+	return s
+}
+
+// TestMqttTelemetry checks that the balance and sensor state are published and retained
+func TestMqttTelemetry(t *testing.T) {
+	b := newFakeBroker(t, "power", "secret")
+	s := newMqttServer(t, b)
+	s.Power.SetReading(12.3456)
+
+	m := &Mqtt{Srv: s}
+	if err := m.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err := m.SendTelemetry(); err != nil {
+		t.Fatal(err)
+	}
+
+	l := b.WaitMessages(t, "home/power/current", 1)
+	if l[0].Payload != "12.346" || !l[0].Retained {
+		t.Errorf("current power message is %+v", l[0])
+	}
+	if r, ok := b.Retained("home/power/sensor"); !ok || r.Payload != "ok" {
+		t.Errorf("sensor state message is %+v", r)
+	}
+	if !m.LastUpdate.Equal(testStart) {
+		t.Errorf("last update is %v, want %v", m.LastUpdate, testStart)
+	}
+	if st := s.Uploader.GetStatus()["mqtt"]; st.Connected == nil || !*st.Connected {
+		t.Errorf("connection status is %+v", st)
+	}
+
+	// The sensor fault is published
+	s.Sensor.state = SensorFault{Fault: FaultSilence}
+	if err := m.SendTelemetry(); err != nil {
+		t.Fatal(err)
+	}
+	if l := b.WaitMessages(t, "home/power/sensor", 2); l[1].Payload != FaultSilence {
+		t.Errorf("sensor state message is %+v", l[1])
+	}
+}
+
+// TestMqttSubscriber checks that a subscriber receives the retained balance
+func TestMqttSubscriber(t *testing.T) {
+	b := newFakeBroker(t, "power", "secret")
+	s := newMqttServer(t, b)
+	s.Power.SetReading(5)
+	m := &Mqtt{Srv: s}
+	if err := m.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err := m.SendTelemetry(); err != nil {
+		t.Fatal(err)
+	}
+	b.WaitMessages(t, "home/power/current", 1)
+
+	// Subscribe with a second client to read the retained message
+	sub := &Mqtt{Srv: s}
+	if err := sub.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	got := make(chan string, 1)
+	token := sub.client.Subscribe("home/power/current", 0, func(_ MQTT.Client, msg MQTT.Message) {
+		got <- string(msg.Payload())
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	select {
+	case p := <-got:
+		if p != "5.000" {
+			t.Errorf("subscriber received %q, want 5.000", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber did not receive the retained balance")
+	}
+}
+
+// TestMqttConfiguration checks that MQTT is disabled when it is not configured
+func TestMqttConfiguration(t *testing.T) {
+	b := newFakeBroker(t, "power", "secret")
+	s := newMqttServer(t, b)
+	s.GetConfig().MqttUsername = ""
+	m := &Mqtt{Srv: s}
+	if err := m.Initialize(); err == nil || !strings.Contains(err.Error(), "username") {
+		t.Errorf("missing username returned %v", err)
+	}
+	if m.enabled {
+		t.Error("MQTT was not disabled")
+	}
+	if err := m.SendTelemetry(); err != nil {
+		t.Errorf("disabled MQTT returned %v", err)
+	}
+
+	s = newMqttServer(t, b)
+	s.GetConfig().MqttPassword = "wrong"
+	m = &Mqtt{Srv: s}
+	if err := m.Initialize(); err == nil {
+		m.Close()
+		t.Error("connected with the wrong password")
+	}
+	if b.Connects() != 0 {
+		t.Errorf("broker accepted %d connections", b.Connects())
+	}
+}
+
+// TestMqttReconnect checks that the connection is restored after it is lost
+func TestMqttReconnect(t *testing.T) {
+	b := newFakeBroker(t, "power", "secret")
+	s := newMqttServer(t, b)
+	s.Power.SetReading(7)
+	m := &Mqtt{Srv: s}
+	if err := m.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	b.Drop()
+	waitFor(t, "the reconnection", func() bool {
+		st := s.Uploader.GetStatus()["mqtt"]
+		return b.Connects() == 2 && st.Connected != nil && *st.Connected
+	})
+	if err := m.SendTelemetry(); err != nil {
+		t.Fatal(err)
+	}
+	if l := b.WaitMessages(t, "home/power/current", 1); l[0].Payload != "7.000" {
+		t.Errorf("current power message is %+v", l[0])
+	}
+}
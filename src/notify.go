@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// systemdScript is the systemd unit installed for the service. It is the kardianos/service
+// default with the notify type, so that systemd waits for READY=1, and a watchdog.
+const systemdScript = `[Unit]
+Description={{Description}}
+ConditionFileIsExecutable={{Path | cmdEscape}}
+{{range Dependencies}}{{.}}
+{{end}}
+[Service]
+Type=notify
+NotifyAccess=main
+WatchdogSec=90
+StartLimitInterval=5
+StartLimitBurst=10
+ExecStart={{Path | cmdEscape}}{{range Arguments}} {{. | cmd}}{{end}}
+{{if ChRoot}}RootDirectory={{ChRoot | cmd}}
+{{end}}{{if WorkingDirectory}}WorkingDirectory={{WorkingDirectory | cmdEscape}}
+{{end}}{{if UserName}}User={{UserName}}
+{{end}}{{if ReloadSignal}}ExecReload=/bin/kill -{{ReloadSignal}} "$MAINPID"
+{{end}}{{if PIDFile}}PIDFile={{PIDFile | cmd}}
+{{end}}{{if OutputFileSupport}}StandardOutput=file:{{LogDirectory}}/{{Name}}.out
+StandardError=file:{{LogDirectory}}/{{Name}}.err
+{{end}}{{if LimitNOFILE}}LimitNOFILE={{LimitNOFILE}}
+{{end}}{{if Restart}}Restart={{Restart}}
+{{end}}{{if SuccessExitStatus}}SuccessExitStatus={{SuccessExitStatus}}
+{{end}}RestartSec=120
+EnvironmentFile=-/etc/sysconfig/{{Name}}
+
+{{range EnvVars}}{{.}}
+{{end}}[Install]
+WantedBy=multi-user.target
+`
+
+// Notifier sends the service state to systemd using the sd_notify protocol
+// and, if the systemd watchdog is enabled, pings it while the service is healthy
+type Notifier struct {
+	Srv      *Server        // Server instance
+	Socket   string         // Notification socket. Read from $NOTIFY_SOCKET if not set.
+	Interval time.Duration  // Watchdog ping interval. Half of $WATCHDOG_USEC if not set.
+	done     chan struct{}  // Closed to stop the watchdog
+	wg       sync.WaitGroup // Waits for the watchdog to stop
+	mu       sync.Mutex
+}
+
+// Start reads the systemd environment and starts pinging the watchdog, if it is enabled
+func (n *Notifier) Start() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.done != nil {
+		return
+	}
+	if n.Socket == "" {
+		n.Socket = os.Getenv("NOTIFY_SOCKET")
+	}
+	if n.Interval == 0 {
+		n.Interval = watchdogInterval()
+	}
+	if n.Socket == "" || n.Interval <= 0 {
+		return
+	}
+	n.logInfo("Pinging the systemd watchdog every ", n.Interval)
+	n.done = make(chan struct{})
+	n.wg.Add(1)
+	go n.run(n.done)
+}
+
+// Stop stops pinging the watchdog and waits for the last ping to be sent,
+// so that the watchdog is not pinged while the service shuts down
+func (n *Notifier) Stop() {
+	n.mu.Lock()
+	if n.done != nil {
+		close(n.done)
+		n.done = nil
+	}
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+// Ready tells systemd that the service has started
+func (n *Notifier) Ready(status string) {
+	n.notify("READY=1\nSTATUS=" + status)
+}
+
+// Stopping tells systemd that the service is stopping
+func (n *Notifier) Stopping() {
+	n.notify("STOPPING=1\nSTATUS=Stopping")
+}
+
+// Status sets the status shown by systemctl status
+func (n *Notifier) Status(status string) {
+	n.notify("STATUS=" + status)
+}
+
+// run pings the watchdog while the service is alive and updates the status
+func (n *Notifier) run(done chan struct{}) {
+	defer n.wg.Done()
+	t := time.NewTicker(n.Interval)
+	defer t.Stop()
+	last := ""
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			status, err := n.Srv.CheckAlive()
+			if err != nil {
+				// Let systemd restart the service if it does not recover
+				status = "Unhealthy. " + err.Error()
+				if status != last {
+					n.logError("Watchdog ping skipped. ", err.Error())
+				}
+			} else {
+				n.notify("WATCHDOG=1")
+			}
+			if status != last {
+				n.Status(status)
+				last = status
+			}
+		}
+	}
+}
+
+// notify sends the state to the systemd notification socket
+func (n *Notifier) notify(state string) error {
+	socket := n.Socket
+	if socket == "" {
+		socket = os.Getenv("NOTIFY_SOCKET")
+	}
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// Abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		n.logError("Error connecting to the systemd notification socket. ", err.Error())
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		n.logError("Error notifying systemd. ", err.Error())
+		return err
+	}
+	return nil
+}
+
+// watchdogInterval returns half the watchdog timeout set by systemd,
+// or zero if the watchdog is not enabled for this process
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// CheckAlive checks that the pulse source is supervised and the scheduler is running and
+// returns a short status for systemd. A failing pulse source is restarted by its
+// supervisor, so it does not stop the watchdog pings.
+func (s *Server) CheckAlive() (string, error) {
+	if s.PulseSource.GetStatus().State == SourceStopped {
+		return "", errors.New("the pulse source is not being supervised")
+	}
+
+	// The scheduler runs an upload every period, so allow for a missed run
+	// and an upload that is slow to complete
+	due := time.Duration(2*s.GetConfig().Period)*time.Minute + 2*time.Minute
+	last := s.Uploader.LastRun()
+	if last.IsZero() {
+		last = s.startTime
+	}
+	if since := s.Now().Sub(last); since > due {
+		return "", fmt.Errorf("the scheduler has not completed a run for %s", since.Round(time.Second))
+	}
+
+	return fmt.Sprintf("Balance %.2f kWh, load %.0f W", s.Power.GetCurrentPower(), s.Power.GetCurrentLoad()), nil
+}
+
+// logInfo logs an information message to the logger
+func (n *Notifier) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("Notifier", a)
+}
+
+// logError logs an error message to the logger
+func (n *Notifier) logError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("Notifier", a)
+}
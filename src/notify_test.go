@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestNotifier checks the notifications sent to a fake systemd notification socket,
+// and that the watchdog is not pinged once the notifier is stopped
+func TestNotifier(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unixgram sockets are not supported")
+	}
+	s, _ := newTestServer(t)
+	s.GetConfig().PulseSource = SourceSimulator
+	s.PulseSource.Start()
+
+	// Socket paths are limited to about 100 characters, so a short temporary path is used
+	dir, err := os.MkdirTemp("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msgs := make(chan string, 100)
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				return
+			}
+			msgs <- string(b[:n])
+		}
+	}()
+	next := func(what string) string {
+		t.Helper()
+		select {
+		case m := <-msgs:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no notification waiting for %s", what)
+			return ""
+		}
+	}
+
+	n := &Notifier{Srv: s, Socket: path, Interval: 10 * time.Millisecond}
+	n.Ready("Listening on port 20080")
+	n.Start()
+	if m := next("ready"); m != "READY=1\nSTATUS=Listening on port 20080" {
+		t.Errorf("ready notification is %q", m)
+	}
+	if m := next("the watchdog"); m != "WATCHDOG=1" {
+		t.Errorf("watchdog notification is %q", m)
+	}
+	if m := next("the status"); !strings.HasPrefix(m, "STATUS=Balance") {
+		t.Errorf("status notification is %q", m)
+	}
+
+	n.Stop()
+	n.Stopping()
+	for m := next("stopping"); m != "STOPPING=1\nSTATUS=Stopping"; m = next("stopping") {
+		if m != "WATCHDOG=1" {
+			t.Errorf("notification %q while stopping", m)
+		}
+	}
+	select {
+	case m := <-msgs:
+		t.Errorf("notification %q after stopping", m)
+	case <-time.After(10 * n.Interval):
+	}
+}
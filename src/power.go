@@ -1,159 +1,412 @@
-package main
-
-import (
-	"bufio"
-	"bytes"
-	"encoding/binary"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"net/http"
-	"os"
-	"os/exec"
-	"time"
-)
-
-// Power holds the information about the power meter
-type Power struct {
-	FlashRate  int64     // Number of flashes per KWh
-	StartTime  time.Time // Start time
-	StartPower float64   // Start power in Kwh
-	PulseCount int64     // Number of pulses since start
-	LastPulse  time.Time // Time of last pulse
-}
-
-// PowerReport holds details about the power that are reported
-type PowerReport struct {
-	StartTime    time.Time `json:"startTime"`    // Start time
-	StartPower   float64   `json:"startPower"`   // Start power in Kwh
-	CurrentPower float64   `json:"currentPower"` // Current power in Kwh
-	PulseCount   int64     `json:"temp"`         // Number of pulses since start
-	LastPulse    time.Time `json:"lastRead"`     // Time of last pulse
-}
-
-// GetPowerReport returns a sanitised version of the power data for return to the calling client
-func (p *Power) GetPowerReport() PowerReport {
-	return PowerReport{
-		StartTime:    p.StartTime,
-		StartPower:   p.StartPower,
-		PulseCount:   p.PulseCount,
-		LastPulse:    p.LastPulse,
-		CurrentPower: p.GetCurrentPower(),
-	}
-}
-
-// GetCurrentPower gets the current amount of power left
-func (p *Power) GetCurrentPower() float64 {
-	// Get amount of power consumed since start
-	consumed := float64(p.PulseCount) / float64(p.FlashRate)
-	current := p.StartPower - consumed
-	return current
-}
-
-// LoadCurrentPower reads the current power from the specified file on disk
-func (p *Power) LoadCurrentPower(path string) error {
-	_, err := os.Stat(path)
-	if !os.IsNotExist(err) {
-		b, err := ioutil.ReadFile(path)
-		if err == nil {
-			var current float64
-			buf := bytes.NewReader(b)
-			err = binary.Read(buf, binary.LittleEndian, &current)
-			if err == nil {
-				p.StartPower = current
-			}
-		}
-	}
-	p.StartTime = time.Now()
-	p.PulseCount = 0
-	return err
-}
-
-// SaveCurrentPower saves the current power to the specified file
-func (p *Power) SaveCurrentPower(path string) error {
-	current := p.GetCurrentPower()
-	b := new(bytes.Buffer)
-	if err := binary.Write(b, binary.LittleEndian, current); err != nil {
-		return err
-	}
-	return ioutil.WriteFile(path, b.Bytes(), 0666)
-}
-
-// StartPulseMonitor starts the python program that detects pulses
-// and monitors the output
-func (p *Power) StartPulseMonitor() {
-	go func() {
-		p.logInfo("Starting Pulse Monitor")
-		cmd := exec.Command("python", "-u", "detectpulse.py")
-
-		stdOut, err := cmd.StdoutPipe()
-		if err != nil {
-			p.logError("Error creating StdoutPipe. ", err.Error())
-			return
-		}
-		defer stdOut.Close()
-
-		scanner := bufio.NewScanner(stdOut)
-		go func() {
-			for scanner.Scan() {
-				p.PulseCount = p.PulseCount + 1
-				p.LastPulse = time.Now()
-				go p.pulseLED()
-			}
-		}()
-
-		err = cmd.Start()
-		if err != nil {
-			p.logError("Error starting cmd. ", err.Error())
-			return
-		}
-
-		err = cmd.Wait()
-		if err != nil {
-			p.logError("Error waiting for Pulse Monitor to end. ", err.Error())
-		}
-
-		p.logInfo("Pulse Monitor has ended.")
-	}()
-}
-
-func (p *Power) pulseLED() {
-	cmd := exec.Command("python", "pulse.py")
-	if err := cmd.Run(); err != nil {
-		p.logError("Error pulsing LED. ", err.Error())
-	}
-}
-
-// WriteTo serializes the entity and writes it to the http response
-func (p *Power) WriteTo(w http.ResponseWriter) error {
-	b, err := json.Marshal(p)
-	if err != nil {
-		return err
-	}
-	w.Header().Set("content-type", "application/json")
-	w.Write(b)
-	return nil
-}
-
-// logInfo logs an information message to the logger
-func (p *Power) logInfo(v ...interface{}) {
-	a := fmt.Sprint(v...)
-	logger.Info("Power: [Inf] ", a)
-}
-
-// logError logs an error message to the logger
-func (p *Power) logError(v ...interface{}) {
-	a := fmt.Sprint(v...)
-	logger.Error("Power [Err] ", a)
-}
-
-// WriteTo serializes the entity and writes it to the http response
-func (p *PowerReport) WriteTo(w http.ResponseWriter) error {
-	b, err := json.Marshal(p)
-	if err != nil {
-		return err
-	}
-	w.Header().Set("content-type", "application/json")
-	w.Write(b)
-	return nil
-}
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Power holds the information about the power meter
+type Power struct {
+	Srv          *Server       `json:"-"` // Server instance
+	FlashRate    int64         // Number of flashes per KWh
+	StartTime    time.Time     // Start time
+	StartPower   float64       // Start power in Kwh
+	PulseCount   int64         // Number of pulses since start
+	LastPulse    time.Time     // Time of last pulse
+	lastInterval time.Duration // Time between the last two pulses
+	total        float64       // Power consumed since the service started in Kwh, which the balance changes do not reset
+	day          string        // Date (yyyymmdd) of the last pulse
+	dayStart     float64       // Power consumed since the service started at the start of the day of the last pulse
+	lowBalance   bool          // Signals that the low balance alert has been raised
+	maxLoad      float64       // Maximum possible load in Watts
+	filter       PulseFilter   // Rejects bounce and stray light
+	litSince     time.Time     // Time the sensor last saw light, if it has not seen dark since
+	darkSeen     bool          // Signals that the pulse source reports when the light goes off
+	lastDark     time.Time     // Time the sensor last stopped seeing light
+	lastSaved    time.Time     // Last time the balance was saved
+	saveErr      string        // Error saving the balance, if the last save failed
+	mu           sync.Mutex
+}
+
+// PowerStatus holds the state of the pulses and the balance checkpoint
+type PowerStatus struct {
+	LastPulse  time.Time `json:"lastPulse"`  // Time of the last pulse
+	PulseCount int64     `json:"pulseCount"` // Number of pulses since start
+	LitSince   time.Time `json:"litSince"`   // Time the sensor has been seeing light since, if it is known
+	LastSaved  time.Time `json:"lastSaved"`  // Last time the balance was saved
+	SaveError  string    `json:"saveError"`  // Error saving the balance, if the last save failed
+}
+
+// PowerReport holds details about the power that are reported
+type PowerReport struct {
+	StartTime    time.Time `json:"startTime"`    // Start time
+	StartPower   float64   `json:"startPower"`   // Start power in Kwh
+	CurrentPower float64   `json:"currentPower"` // Current power in Kwh
+	CurrentLoad  float64   `json:"currentLoad"`  // Current load in Watts
+	PulseCount   int64     `json:"temp"`         // Number of pulses since start
+	LastPulse    time.Time `json:"lastRead"`     // Time of last pulse
+}
+
+// GetPowerReport returns a sanitised version of the power data for return to the calling client
+func (p *Power) GetPowerReport() PowerReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PowerReport{
+		StartTime:    p.StartTime,
+		StartPower:   p.StartPower,
+		PulseCount:   p.PulseCount,
+		LastPulse:    p.LastPulse,
+		CurrentPower: p.currentPower(),
+		CurrentLoad:  p.currentLoad(),
+	}
+}
+
+// GetCurrentPower gets the current amount of power left
+func (p *Power) GetCurrentPower() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.currentPower()
+}
+
+// GetConsumed gets the amount of power consumed since the service started in Kwh.
+// Setting the reading or the flash rate does not reset it, so it never goes backwards.
+func (p *Power) GetConsumed() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.total
+}
+
+// GetDayConsumed gets the amount of power consumed in Kwh on the day of the specified time,
+// since the service started
+func (p *Power) GetDayConsumed(now time.Time) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Format("20060102") != p.day {
+		return 0
+	}
+	return p.total - p.dayStart
+}
+
+// GetCurrentLoad gets the current load in Watts
+func (p *Power) GetCurrentLoad() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.currentLoad()
+}
+
+// SetFlashRate changes the number of flashes per Kwh. The pulses counted so far
+// are settled at the previous rate, so the balance and the consumed total are not changed.
+func (p *Power) SetFlashRate(rate int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rate == p.FlashRate {
+		return
+	}
+	if p.FlashRate > 0 {
+		p.StartPower = p.currentPower()
+		p.StartTime = p.Srv.Now()
+		p.PulseCount = 0
+	}
+	p.FlashRate = rate
+	p.filter.MinInterval = minPulseInterval(p.FlashRate, p.maxLoad)
+}
+
+// SetMaxLoad changes the maximum possible load (in Watts), which sets the
+// minimum time between pulses
+func (p *Power) SetMaxLoad(load float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxLoad = load
+	p.filter.MinInterval = minPulseInterval(p.FlashRate, p.maxLoad)
+	p.logInfo("Pulses less than ", p.filter.MinInterval.Round(time.Millisecond), " apart are rejected")
+}
+
+// filterSettings returns the number of flashes per Kwh and the minimum time between pulses
+func (p *Power) filterSettings() (int64, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.FlashRate, p.filter.MinInterval
+}
+
+// GetFilterReport returns the number of pulses accepted and rejected by the filter
+func (p *Power) GetFilterReport() PulseFilterReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.filter.Report()
+}
+
+// TopUp adds the purchased units (in Kwh) to the balance
+func (p *Power) TopUp(units float64) {
+	p.mu.Lock()
+	p.StartPower = p.StartPower + units
+	bal := round(p.currentPower(), 3)
+	p.mu.Unlock()
+
+	p.logInfo("Topped up ", units, " units")
+	p.Srv.History.AddTopUp(p.Srv.Now(), units)
+	p.Srv.Events.Publish(EventTopUp, TopUpEvent{Units: units, Balance: bal})
+	p.Srv.Events.Publish(EventBalance, BalanceEvent{Balance: bal})
+	p.checkBalance(bal)
+}
+
+// SetReading sets the balance to the units (in Kwh) read from the meter
+func (p *Power) SetReading(units float64) {
+	p.mu.Lock()
+	p.StartPower = units
+	p.StartTime = p.Srv.Now()
+	p.PulseCount = 0
+	p.mu.Unlock()
+
+	p.logInfo("Meter reading set to ", units, " units")
+	p.Srv.Events.Publish(EventBalance, BalanceEvent{Balance: units})
+	p.checkBalance(units)
+}
+
+// recordPulse records a pulse detected at the specified time and returns
+// false if the filter rejected it
+func (p *Power) recordPulse(t time.Time) bool {
+	p.mu.Lock()
+	if p.darkSeen && p.litSince.IsZero() && t.After(p.lastDark) {
+		p.litSince = t
+	}
+	if reason := p.filter.Accept(t); reason != "" {
+		p.mu.Unlock()
+		p.logDebug("Pulse rejected as ", reason)
+		return false
+	}
+	ev := PulseEvent{Time: t}
+	if !p.LastPulse.IsZero() {
+		p.lastInterval = t.Sub(p.LastPulse)
+		ev.Interval = p.lastInterval.Seconds()
+		ev.Load = round(averageLoad(1/float64(p.FlashRate), p.lastInterval), 1)
+	}
+	p.PulseCount = p.PulseCount + 1
+	if d := t.Format("20060102"); d != p.day {
+		p.day = d
+		p.dayStart = p.total
+	}
+	p.total += 1 / float64(p.FlashRate)
+	p.LastPulse = t
+	bal := round(p.currentPower(), 3)
+	p.mu.Unlock()
+
+	if logs.Enabled(LevelDebug, "Power") {
+		logs.Log(LevelDebug, "Power", "Pulse recorded", map[string]interface{}{
+			"interval": ev.Interval,
+			"load":     ev.Load,
+			"balance":  bal,
+		})
+	}
+
+	p.Srv.History.AddUsage(t, 1/float64(p.FlashRate))
+	p.Srv.Events.Publish(EventPulse, ev)
+	p.Srv.Events.Publish(EventBalance, BalanceEvent{Balance: bal})
+	p.checkBalance(bal)
+	return true
+}
+
+// recordDark records that the sensor stopped seeing light at the specified time.
+// A dark reported before the light was seen does not end it.
+func (p *Power) recordDark(t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.darkSeen = true
+	if t.After(p.lastDark) {
+		p.lastDark = t
+	}
+	if !t.Before(p.litSince) {
+		p.litSince = time.Time{}
+	}
+}
+
+// restamp moves the times of the pulses and the balance onto the clock corrected by the step
+func (p *Power) restamp(now time.Time, step time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.StartTime = shiftWall(p.StartTime, now, step)
+	p.LastPulse = shiftWall(p.LastPulse, now, step)
+	p.litSince = shiftWall(p.litSince, now, step)
+	p.lastDark = shiftWall(p.lastDark, now, step)
+	p.lastSaved = shiftWall(p.lastSaved, now, step)
+}
+
+// resetSensor forgets the light state when the pulse source is restarted
+func (p *Power) resetSensor() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.darkSeen = false
+	p.lastDark = time.Time{}
+	p.litSince = time.Time{}
+}
+
+// checkBalance raises an alert when the balance drops below the configured level
+func (p *Power) checkBalance(bal float64) {
+	level := p.Srv.GetConfig().AlertBalance
+	if level <= 0 {
+		return
+	}
+	p.mu.Lock()
+	raise := bal < level && !p.lowBalance
+	p.lowBalance = bal < level
+	p.mu.Unlock()
+	if raise {
+		p.logInfo("Balance is below ", level, " units")
+		p.Srv.Events.Publish(EventAlert, AlertEvent{
+			Source:  "Power",
+			Message: fmt.Sprintf("Balance is low, %.2f units remaining", bal),
+		})
+	}
+}
+
+// currentPower returns the current amount of power left
+func (p *Power) currentPower() float64 {
+	return p.StartPower - p.consumed()
+}
+
+// consumed returns the amount of power consumed since the start of the balance in Kwh
+func (p *Power) consumed() float64 {
+	return float64(p.PulseCount) / float64(p.FlashRate)
+}
+
+// currentLoad returns the current load in Watts, based on the time between
+// the last two pulses. If the next pulse is overdue the load must be lower,
+// so the time since the last pulse is used instead.
+func (p *Power) currentLoad() float64 {
+	if p.lastInterval <= 0 {
+		return 0
+	}
+	d := p.lastInterval
+	if since := p.Srv.Now().Sub(p.LastPulse); since > d {
+		d = since
+	}
+	return round(averageLoad(1/float64(p.FlashRate), d), 1)
+}
+
+// averageLoad returns the average load in Watts for the amount of power (in Kwh)
+// consumed over the specified duration
+func averageLoad(kwh float64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return kwh * 1000 / d.Hours()
+}
+
+// round rounds the value to the specified number of decimal places
+func round(v float64, places int) float64 {
+	f := math.Pow(10, float64(places))
+	return math.Round(v*f) / f
+}
+
+// LoadCurrentPower reads the current power from the specified file on disk
+func (p *Power) LoadCurrentPower(path string) error {
+	_, err := os.Stat(path)
+	if !os.IsNotExist(err) {
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			var current float64
+			buf := bytes.NewReader(b)
+			err = binary.Read(buf, binary.LittleEndian, &current)
+			if err == nil {
+				p.mu.Lock()
+				p.StartPower = current
+				p.mu.Unlock()
+			}
+		}
+	}
+	p.mu.Lock()
+	p.StartTime = p.Srv.Now()
+	p.PulseCount = 0
+	p.mu.Unlock()
+	return err
+}
+
+// SaveCurrentPower saves the current power to the specified file
+func (p *Power) SaveCurrentPower(path string) error {
+	current := p.GetCurrentPower()
+	b := new(bytes.Buffer)
+	err := binary.Write(b, binary.LittleEndian, current)
+	if err == nil {
+		err = ioutil.WriteFile(path, b.Bytes(), 0666)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.saveErr = err.Error()
+	} else {
+		p.saveErr = ""
+		p.lastSaved = p.Srv.Now()
+	}
+	return err
+}
+
+// GetStatus returns the state of the pulses and the balance checkpoint
+func (p *Power) GetStatus() PowerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PowerStatus{
+		LastPulse:  p.LastPulse,
+		PulseCount: p.PulseCount,
+		LitSince:   p.litSince,
+		LastSaved:  p.lastSaved,
+		SaveError:  p.saveErr,
+	}
+}
+
+// pulseLED flashes the LED to show that a pulse was detected
+func (p *Power) pulseLED() {
+	cmd := exec.Command("python", "pulse.py", "-n", strconv.Itoa(p.Srv.GetConfig().LedPin))
+	if err := cmd.Run(); err != nil {
+		p.logError("Error pulsing LED. ", err.Error())
+	}
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (p *Power) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// logDebug logs a debug message to the logger
+func (p *Power) logDebug(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Debug("Power", a)
+}
+
+// logInfo logs an information message to the logger
+func (p *Power) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("Power", a)
+}
+
+// logError logs an error message to the logger
+func (p *Power) logError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("Power", a)
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (p *PowerReport) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestPowerPulses checks that each pulse consumes one flash of power and sets the load
+func TestPowerPulses(t *testing.T) {
+	s, clock := newTestServer(t)
+	s.Power.SetReading(100)
+
+	// A pulse every 3.6 seconds at 1000 flashes per kWh is a 1 kW load
+	for _, pt := range pulsesEvery(testStart, 3600*time.Millisecond, 10) {
+		clock.Set(pt)
+		if !s.Power.recordPulse(pt) {
+			t.Fatalf("pulse at %v was rejected", pt)
+		}
+	}
+	if got := s.Power.GetCurrentPower(); !closeEnough(got, 99.99) {
+		t.Errorf("balance is %v, want 99.99", got)
+	}
+	if got := s.Power.GetConsumed(); !closeEnough(got, 0.01) {
+		t.Errorf("consumed is %v, want 0.01", got)
+	}
+	if got := s.Power.GetCurrentLoad(); got != 1000 {
+		t.Errorf("load is %v, want 1000", got)
+	}
+
+	// The load drops when the next pulse is overdue
+	clock.Advance(7200 * time.Millisecond)
+	if got := s.Power.GetCurrentLoad(); got != 500 {
+		t.Errorf("load is %v after an overdue pulse, want 500", got)
+	}
+
+	if u := s.History.GetHourly(clock.Now()); len(u) == 0 || !closeEnough(u[9].Units, 0.01) {
+		t.Errorf("hourly history is %v", u)
+	}
+}
+
+// TestPowerTopUp checks that top-ups and meter readings set the balance
+func TestPowerTopUp(t *testing.T) {
+	s, clock := newTestServer(t)
+	s.Power.SetReading(10)
+	for _, pt := range pulsesEvery(testStart, time.Minute, 500) {
+		s.Power.recordPulse(pt)
+	}
+	clock.Set(testStart.Add(time.Hour))
+	s.Power.TopUp(50)
+	if got := s.Power.GetCurrentPower(); !closeEnough(got, 59.5) {
+		t.Errorf("balance is %v, want 59.5", got)
+	}
+	if l := s.History.GetTopUps(); len(l) != 1 || l[0].Units != 50 || !l[0].Time.Equal(clock.Now()) {
+		t.Errorf("top-ups are %v", l)
+	}
+
+	s.Power.SetReading(42)
+	if got := s.Power.GetCurrentPower(); got != 42 {
+		t.Errorf("balance is %v after the reading, want 42", got)
+	}
+	if rep := s.Power.GetPowerReport(); rep.PulseCount != 0 || !rep.StartTime.Equal(clock.Now()) {
+		t.Errorf("reading did not restart the count %+v", rep)
+	}
+}
+
+// TestPowerFlashRate checks that changing the flash rate does not change the balance
+func TestPowerFlashRate(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.Power.SetReading(10)
+	for _, pt := range pulsesEvery(testStart, time.Minute, 100) {
+		s.Power.recordPulse(pt)
+	}
+	s.Power.SetFlashRate(500)
+	if got := s.Power.GetCurrentPower(); !closeEnough(got, 9.9) {
+		t.Errorf("balance is %v after the rate change, want 9.9", got)
+	}
+	if got := s.Power.GetConsumed(); !closeEnough(got, 0.1) {
+		t.Errorf("consumed is %v after the rate change, want 0.1", got)
+	}
+	s.Power.recordPulse(testStart.Add(2 * time.Hour))
+	if got := s.Power.GetCurrentPower(); !closeEnough(got, 9.898) {
+		t.Errorf("balance is %v, want 9.898", got)
+	}
+	if got := s.Power.GetConsumed(); !closeEnough(got, 0.102) {
+		t.Errorf("consumed is %v, want 0.102", got)
+	}
+}
+
+// TestPowerFilter checks that pulses faster than the maximum load are rejected
+func TestPowerFilter(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.Power.SetReading(10)
+
+	s.Power.recordPulse(testStart)
+	if s.Power.recordPulse(testStart.Add(10 * time.Millisecond)) {
+		t.Error("bounce was accepted")
+	}
+	if !s.Power.recordPulse(testStart.Add(time.Second)) {
+		t.Error("pulse at 3.6 kW was rejected")
+	}
+	rep := s.Power.GetFilterReport()
+	if rep.Accepted != 2 || rep.Bounced != 1 {
+		t.Errorf("filter report is %+v", rep)
+	}
+	if got := s.Power.GetCurrentPower(); !closeEnough(got, 9.998) {
+		t.Errorf("balance is %v, want 9.998", got)
+	}
+}
+
+// TestPowerLowBalance checks that the low balance alert is raised once
+func TestPowerLowBalance(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.GetConfig().AlertBalance = 5
+	s.Power.SetReading(5.002)
+	for _, pt := range pulsesEvery(testStart, time.Minute, 5) {
+		s.Power.recordPulse(pt)
+	}
+	if n := countEvents(s, EventAlert, 0); n != 1 {
+		t.Errorf("%d alerts were raised, want 1", n)
+	}
+
+	last := s.Events.Since(0)
+	s.Power.TopUp(10)
+	s.Power.recordPulse(testStart.Add(time.Hour))
+	if n := countEvents(s, EventAlert, last[len(last)-1].ID); n != 0 {
+		t.Errorf("%d alerts were raised after the top-up", n)
+	}
+}
+
+// TestPowerSaveLoad checks that the balance survives a restart
+func TestPowerSaveLoad(t *testing.T) {
+	s, clock := newTestServer(t)
+	s.Power.SetReading(12.5)
+	s.Power.recordPulse(testStart.Add(time.Second))
+	if err := s.Power.SaveCurrentPower("power.dat"); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Power.GetStatus(); !st.LastSaved.Equal(clock.Now()) || st.SaveError != "" {
+		t.Errorf("save status is %+v", st)
+	}
+
+	clock.Advance(time.Hour)
+	p := &Power{Srv: s, FlashRate: 1000}
+	if err := p.LoadCurrentPower("power.dat"); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.GetCurrentPower(); !closeEnough(got, 12.499) {
+		t.Errorf("loaded balance is %v, want 12.499", got)
+	}
+	if !p.StartTime.Equal(clock.Now()) {
+		t.Errorf("start time is %v, want %v", p.StartTime, clock.Now())
+	}
+
+	p = &Power{Srv: s, FlashRate: 1000}
+	if err := p.LoadCurrentPower("missing.dat"); !os.IsNotExist(err) || p.GetCurrentPower() != 0 {
+		t.Errorf("missing balance file returned %v", err)
+	}
+}
+
+// countEvents returns the number of events of the type published after the event ID
+func countEvents(s *Server, typ string, after int64) int {
+	n := 0
+	for _, e := range s.Events.Since(after) {
+		if e.Type == typ {
+			n++
+		}
+	}
+	return n
+}
+
+// TestPowerLitSince checks that the time the sensor has been seeing light is bounded by the dark reports
+func TestPowerLitSince(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.Power.recordPulse(testStart)
+	if st := s.Power.GetStatus(); !st.LitSince.IsZero() {
+		t.Errorf("lit since %v before a dark was reported", st.LitSince)
+	}
+
+	s.Power.recordDark(testStart.Add(time.Second))
+	s.Power.recordPulse(testStart.Add(500 * time.Millisecond))
+	if st := s.Power.GetStatus(); !st.LitSince.IsZero() {
+		t.Errorf("pulse before the dark set lit since %v", st.LitSince)
+	}
+
+	lit := testStart.Add(10 * time.Second)
+	s.Power.recordPulse(lit)
+	s.Power.recordDark(testStart.Add(2 * time.Second))
+	if st := s.Power.GetStatus(); !st.LitSince.Equal(lit) {
+		t.Errorf("lit since %v after an earlier dark, want %v", st.LitSince, lit)
+	}
+	s.Power.recordDark(lit.Add(100 * time.Millisecond))
+	if st := s.Power.GetStatus(); !st.LitSince.IsZero() {
+		t.Errorf("lit since %v after the dark", st.LitSince)
+	}
+}
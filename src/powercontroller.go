@@ -1,42 +1,201 @@
-package main
-
-import (
-	"fmt"
-	"net/http"
-
-	"github.com/gorilla/mux"
-)
-
-// PowerController handles the Web Methods for the room being monitored
-type PowerController struct {
-	Srv *Server
-}
-
-// AddController adds the controller routes to the router
-func (c *PowerController) AddController(router *mux.Router, s *Server) {
-	c.Srv = s
-	router.Methods("GET").Path("/power/get").Name("GetPower").
-		Handler(Logger(c, http.HandlerFunc(c.handleGetPower)))
-}
-
-// handleGetPower will return the current power status
-func (c *PowerController) handleGetPower(w http.ResponseWriter, r *http.Request) {
-	rep := c.Srv.Power.GetPowerReport()
-
-	if err := rep.WriteTo(w); err != nil {
-		c.LogError("Error serializing power.", err.Error())
-		http.Error(w, "Error serializing power", http.StatusInternalServerError)
-	}
-}
-
-// LogInfo is used to log information messages for this controller.
-func (c *PowerController) LogInfo(v ...interface{}) {
-	a := fmt.Sprint(v...)
-	logger.Info("PowerController: [Inf] ", a)
-}
-
-// LogError is used to log information messages for this controller.
-func (c *PowerController) LogError(v ...interface{}) {
-	a := fmt.Sprint(v...)
-	logger.Info("PowerController: [Err] ", a)
-}
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PowerController handles the Web Methods for the room being monitored
+type PowerController struct {
+	Srv *Server
+}
+
+// AddController adds the controller routes to the router
+func (c *PowerController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/power/get").Name("GetPower").
+		Handler(Logger(c, Authorize(s, RoleRead, http.HandlerFunc(c.handleGetPower))))
+	router.Methods("GET").Path("/power/filter").Name("GetFilter").
+		Handler(Logger(c, Authorize(s, RoleRead, http.HandlerFunc(c.handleGetFilter))))
+	router.Methods("GET").Path("/power/history").Name("GetHistory").
+		Handler(Logger(c, Authorize(s, RoleRead, http.HandlerFunc(c.handleGetHistory))))
+	router.Methods("GET").Path("/power/forecast").Name("GetForecast").
+		Handler(Logger(c, Authorize(s, RoleRead, http.HandlerFunc(c.handleGetForecast))))
+	router.Methods("GET").Path("/power/stream").Name("StreamPower").
+		Handler(Logger(c, Authorize(s, RoleRead, http.HandlerFunc(c.handleStreamPower))))
+	router.Methods("POST").Path("/power/topup").Name("TopUpPower").
+		Handler(Logger(c, Authorize(s, RoleAdmin, http.HandlerFunc(c.handleTopUp))))
+	router.Methods("POST").Path("/power/reading").Name("SetReading").
+		Handler(Logger(c, Authorize(s, RoleAdmin, http.HandlerFunc(c.handleSetReading))))
+}
+
+// unitsRequest holds the number of units sent with a top-up or meter reading
+type unitsRequest struct {
+	Units float64 `json:"units"` // Number of units (Kwh)
+}
+
+// handleGetPower will return the current power status
+func (c *PowerController) handleGetPower(w http.ResponseWriter, r *http.Request) {
+	rep := c.Srv.Power.GetPowerReport()
+
+	if err := rep.WriteTo(w); err != nil {
+		c.LogError("Error serializing power.", err.Error())
+		http.Error(w, "Error serializing power", http.StatusInternalServerError)
+	}
+}
+
+// handleGetFilter will return the number of pulses accepted and rejected,
+// which is used to tune the sensor
+func (c *PowerController) handleGetFilter(w http.ResponseWriter, r *http.Request) {
+	rep := c.Srv.Power.GetFilterReport()
+
+	if err := rep.WriteTo(w); err != nil {
+		c.LogError("Error serializing filter.", err.Error())
+		http.Error(w, "Error serializing filter", http.StatusInternalServerError)
+	}
+}
+
+// handleGetHistory will return the consumption and top-up history
+func (c *PowerController) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	rep := c.Srv.History.GetHistoryReport(c.Srv.Now())
+
+	if err := rep.WriteTo(w); err != nil {
+		c.LogError("Error serializing history.", err.Error())
+		http.Error(w, "Error serializing history", http.StatusInternalServerError)
+	}
+}
+
+// handleGetForecast will return when the balance is expected to run out
+func (c *PowerController) handleGetForecast(w http.ResponseWriter, r *http.Request) {
+	f := c.Srv.History.GetForecast(c.Srv.Now(), c.Srv.Power.GetCurrentPower())
+
+	if err := f.WriteTo(w); err != nil {
+		c.LogError("Error serializing forecast.", err.Error())
+		http.Error(w, "Error serializing forecast", http.StatusInternalServerError)
+	}
+}
+
+// handleStreamPower streams the live pulse, balance, top-up and alert events
+// to the client as Server-Sent Events
+func (c *PowerController) handleStreamPower(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before replaying, so that no events are missed in between
+	ch := c.Srv.Events.Subscribe()
+	defer c.Srv.Events.Unsubscribe(ch)
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	// Resume from the last event the client received
+	var lastID int64
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		id = r.URL.Query().Get("lastEventId")
+	}
+	if id != "" {
+		if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+			for _, e := range c.Srv.Events.Since(n) {
+				if err := e.WriteStream(w); err != nil {
+					return
+				}
+				lastID = e.ID
+			}
+		}
+	}
+	f.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			f.Flush()
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if e.ID <= lastID {
+				continue
+			}
+			if err := e.WriteStream(w); err != nil {
+				return
+			}
+			lastID = e.ID
+			f.Flush()
+		}
+	}
+}
+
+// handleTopUp adds the purchased units to the balance
+func (c *PowerController) handleTopUp(w http.ResponseWriter, r *http.Request) {
+	req := unitsRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Units <= 0 {
+		http.Error(w, "Units must be greater than zero", http.StatusBadRequest)
+		return
+	}
+
+	c.Srv.Power.TopUp(req.Units)
+	c.saveAndReturn(w)
+}
+
+// handleSetReading sets the balance to the units read from the meter
+func (c *PowerController) handleSetReading(w http.ResponseWriter, r *http.Request) {
+	req := unitsRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Units < 0 {
+		http.Error(w, "Units cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	c.Srv.Power.SetReading(req.Units)
+	c.saveAndReturn(w)
+}
+
+// saveAndReturn saves the balance and returns the current power status
+func (c *PowerController) saveAndReturn(w http.ResponseWriter) {
+	if err := c.Srv.Power.SaveCurrentPower("power.dat"); err != nil {
+		c.LogError("Error saving current power.", err.Error())
+	}
+
+	rep := c.Srv.Power.GetPowerReport()
+	if err := rep.WriteTo(w); err != nil {
+		c.LogError("Error serializing power.", err.Error())
+		http.Error(w, "Error serializing power", http.StatusInternalServerError)
+	}
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *PowerController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("PowerController", a)
+}
+
+// LogError is used to log information messages for this controller.
+func (c *PowerController) LogError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("PowerController", a)
+}
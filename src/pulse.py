@@ -1,7 +1,12 @@
 from gpiozero import LED
 from time import sleep
+import argparse
 
-led = LED(26)
+parser = argparse.ArgumentParser(description='Pulse the LED.')
+parser.add_argument('-n', default='26', type=int, help='The number of the GPIO pin of the LED.')
+args = parser.parse_args()
+
+led = LED(args.n)
 
 led.on()
 sleep(0.1)
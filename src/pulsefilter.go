@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Reasons a pulse is rejected
+const (
+	RejectBounce = "bounce" // Detected too soon after the last pulse
+	RejectBurst  = "burst"  // Part of a burst of detections faster than the meter can flash
+)
+
+const (
+	burstPulses = 5 // Number of pulses at the maximum load that make up the burst window
+	burstFactor = 2 // Detections in the burst window, as a multiple of burstPulses, that make up a burst
+)
+
+// PulseFilter rejects pulses that are closer together than the meter can flash
+// at the maximum load, such as LED bounce and stray light
+type PulseFilter struct {
+	MinInterval time.Duration     // Minimum time between pulses at the maximum load. 0 disables the filter.
+	last        time.Time         // Time of the last accepted pulse
+	recent      []time.Time       // Times of the detections in the burst window, accepted or not
+	burstUntil  time.Time         // Detections are rejected until this time after a burst
+	stats       PulseFilterReport // Number of pulses accepted and rejected
+}
+
+// PulseFilterReport holds the number of pulses accepted and rejected by the filter
+type PulseFilterReport struct {
+	MinInterval      float64   `json:"minInterval"`      // Minimum time between pulses (in seconds)
+	Accepted         int64     `json:"accepted"`         // Number of pulses accepted
+	Bounced          int64     `json:"bounced"`          // Number of pulses rejected as bounce
+	Burst            int64     `json:"burst"`            // Number of pulses rejected as part of a burst
+	LastRejected     time.Time `json:"lastRejected"`     // Time of the last rejected pulse
+	ShortestInterval float64   `json:"shortestInterval"` // Shortest time between two detections (in seconds)
+}
+
+// minPulseInterval returns the time between pulses at the maximum load (in Watts)
+func minPulseInterval(flashRate int64, maxLoad float64) time.Duration {
+	if flashRate <= 0 || maxLoad <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Hour) * 1000 / (float64(flashRate) * maxLoad))
+}
+
+// Accept checks the pulse detected at the specified time and returns
+// an empty string if it is accepted, or the reason it is rejected
+func (f *PulseFilter) Accept(t time.Time) string {
+	if n := len(f.recent); n != 0 {
+		if d := t.Sub(f.recent[n-1]).Seconds(); f.stats.ShortestInterval == 0 || d < f.stats.ShortestInterval {
+			f.stats.ShortestInterval = d
+		}
+	}
+	if f.MinInterval <= 0 {
+		f.recent = append(f.recent[:0], t)
+		f.accept(t)
+		return ""
+	}
+
+	// Keep the detections in the burst window
+	window := burstPulses * f.MinInterval
+	f.recent = append(f.recent, t)
+	i := 0
+	for i < len(f.recent) && t.Sub(f.recent[i]) > window {
+		i++
+	}
+	f.recent = f.recent[i:]
+
+	switch {
+	case len(f.recent) > burstPulses*burstFactor || t.Before(f.burstUntil):
+		// Keep rejecting until the detections have stopped for a full window
+		f.burstUntil = t.Add(window)
+		f.stats.Burst++
+		f.stats.LastRejected = t
+		return RejectBurst
+	case !f.last.IsZero() && t.Sub(f.last) < f.MinInterval:
+		f.stats.Bounced++
+		f.stats.LastRejected = t
+		return RejectBounce
+	}
+	f.accept(t)
+	return ""
+}
+
+// accept records an accepted pulse
+func (f *PulseFilter) accept(t time.Time) {
+	f.last = t
+	f.stats.Accepted++
+}
+
+// Report returns the number of pulses accepted and rejected
+func (f *PulseFilter) Report() PulseFilterReport {
+	r := f.stats
+	r.MinInterval = f.MinInterval.Seconds()
+	return r
+}
+
+// WriteTo serializes the entity and writes it to the http response
+func (r *PulseFilterReport) WriteTo(w http.ResponseWriter) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMinPulseInterval checks the time between pulses at the maximum load
+func TestMinPulseInterval(t *testing.T) {
+	if d := minPulseInterval(1000, 3600); d != time.Second {
+		t.Errorf("interval is %v, want 1s", d)
+	}
+	if d := minPulseInterval(0, 3600); d != 0 {
+		t.Errorf("interval without a flash rate is %v, want 0", d)
+	}
+}
+
+// TestPulseFilterBurst checks that a burst is rejected until the detections stop for a window
+func TestPulseFilterBurst(t *testing.T) {
+	f := &PulseFilter{MinInterval: time.Second}
+	if r := f.Accept(testStart); r != "" {
+		t.Fatalf("first pulse was rejected as %s", r)
+	}
+
+	// Stray light flickering every 100ms
+	var burst time.Time
+	for i := 1; i <= 30; i++ {
+		burst = testStart.Add(time.Duration(i) * 100 * time.Millisecond)
+		f.Accept(burst)
+	}
+	if r := f.Accept(burst.Add(2 * time.Second)); r != RejectBurst {
+		t.Errorf("pulse in the burst window was %q, want %q", r, RejectBurst)
+	}
+	if r := f.Accept(burst.Add(10 * time.Second)); r != "" {
+		t.Errorf("pulse after the burst was rejected as %s", r)
+	}
+
+	rep := f.Report()
+	if rep.Accepted != 2 || rep.Bounced == 0 || rep.Burst == 0 || rep.Bounced+rep.Burst != 31 {
+		t.Errorf("filter report is %+v", rep)
+	}
+	if rep.ShortestInterval != 0.1 || rep.MinInterval != 1 {
+		t.Errorf("intervals are %v and %v", rep.ShortestInterval, rep.MinInterval)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Pulse sources
+const (
+	SourceSensor = "sensor" // Light sensor on the meter, read by detectpulse.py
+	SourceReplay = "replay" // Pulses recorded to a file
+)
+
+// sensorStopWait is the time allowed for detectpulse.py to end before it is killed
+const sensorStopWait = 5 * time.Second
+
+// errSourceDone is returned by a pulse source that has no more pulses
+var errSourceDone = errors.New("no more pulses")
+
+// Source produces the pulses counted by Power
+type Source interface {
+	// Name returns the name of the pulse source
+	Name() string
+	// Run produces pulses until the stop channel is closed.
+	// It returns errSourceDone if it has no more pulses.
+	Run(s *Supervisor, stop <-chan struct{}) error
+}
+
+// newSource creates the pulse source set in the configuration
+func newSource(c *Config) Source {
+	switch c.PulseSource {
+	case SourceReplay:
+		return &ReplaySource{Path: c.ReplayFile, Speed: c.ReplaySpeed}
+	case SourceSimulator:
+		return &SimulatorSource{
+			Profile:     defaultLoadProfile,
+			ProfileFile: c.SimProfile,
+			Seed:        c.SimSeed,
+		}
+	default:
+		return &SensorSource{Pin: c.SensorPin, Threshold: c.SensorThreshold}
+	}
+}
+
+// SensorSource runs detectpulse.py, which reports the flashes of the meter LED
+type SensorSource struct {
+	Pin       int              // GPIO number of the light sensor
+	Threshold float64          // Light level, between 0 and 1, above which a pulse is detected
+	Command   func() *exec.Cmd // Creates the pulse detector command. Runs detectpulse.py if not set.
+}
+
+// Name returns the name of the pulse source
+func (d *SensorSource) Name() string {
+	return SourceSensor
+}
+
+// Run starts the pulse detector and waits for it to end, or to be stopped
+func (d *SensorSource) Run(s *Supervisor, stop <-chan struct{}) error {
+	cmd := d.command()
+	stdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("error creating stdout pipe. %v", err)
+	}
+	stdErr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("error creating stderr pipe. %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting pulse source. %v", err)
+	}
+
+	// Both pipes must be read to the end before waiting for the command
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		d.readPulses(s.Srv, stdOut)
+	}()
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(stdErr)
+		for scanner.Scan() {
+			s.addStderr(scanner.Text())
+		}
+	}()
+
+	ended := make(chan error, 1)
+	go func() {
+		wg.Wait()
+		ended <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-ended:
+		return err
+	case <-stop:
+	}
+
+	// Ask the pulse detector to end and kill it if it does not end in time
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		cmd.Process.Kill()
+	}
+	select {
+	case err = <-ended:
+	case <-time.After(sensorStopWait):
+		s.logError("Pulse source did not end in time. Killing it.")
+		cmd.Process.Kill()
+		err = <-ended
+	}
+	return err
+}
+
+// readPulses records a pulse for each line the pulse detector writes to stdout,
+// except for the lines reporting that the light went off and the light levels
+func (d *SensorSource) readPulses(srv *Server, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		t := srv.Now()
+		srv.Power.logDebug("Pulse detector output: ", scanner.Text())
+		if strings.HasPrefix(scanner.Text(), "levels ") {
+			d.readLevels(srv, scanner.Text())
+			continue
+		}
+		if scanner.Text() == "dark" {
+			srv.Recorder.Record(t, true)
+			srv.Power.recordDark(t)
+			continue
+		}
+		srv.Recorder.Record(t, false)
+		if srv.Power.recordPulse(t) {
+			go srv.Power.pulseLED()
+		}
+	}
+}
+
+// readLevels records the light levels reported by the pulse detector, in the form
+// "levels <lowest> <highest> <pulses>", for tuning the threshold
+func (d *SensorSource) readLevels(srv *Server, l string) {
+	f := strings.Fields(l)
+	if len(f) != 4 {
+		return
+	}
+	low, err1 := strconv.ParseFloat(f[1], 64)
+	high, err2 := strconv.ParseFloat(f[2], 64)
+	n, err3 := strconv.Atoi(f[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		srv.Power.logError("Invalid light levels from the pulse detector: ", l)
+		return
+	}
+	srv.Calibration.addLevels(low, high, n)
+}
+
+// command creates the pulse detector command
+func (d *SensorSource) command() *exec.Cmd {
+	if d.Command != nil {
+		return d.Command()
+	}
+	args := []string{"-u", "detectpulse.py", "-n", strconv.Itoa(d.Pin)}
+	if d.Threshold > 0 {
+		args = append(args, "-t", strconv.FormatFloat(d.Threshold, 'f', -1, 64))
+	}
+	return exec.Command("python", args...)
+}
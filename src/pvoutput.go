@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// PVOutput publishes the telemetry to the PVOutput add-status API.
+//
+// PVOutput expects the energy consumption (v3) to be the cumulative total for the
+// day in Wh, and the power consumption (v4) to be the average load in Watts
+// over the status interval. The daily total starts from the first pulse of the day.
+type PVOutput struct {
+	Srv               *Server      // Server instance
+	LastUpdateAttempt time.Time    // Last time an update was attempted
+	LastUpdate        time.Time    // Last time an update was published
+	client            *http.Client // HTTP client
+	enabled           bool         // Signals that PVOutput is enabled and configured
+	lastConsumed      float64      // Power consumed (in Kwh) at the last update
+	lastTime          time.Time    // Time of the last update
+}
+
+// Initialize initializes the PVOutput client
+func (p *PVOutput) Initialize() error {
+	p.client = &http.Client{Timeout: 30 * time.Second}
+	c := p.Srv.GetConfig()
+	p.enabled = c.EnablePVOutput
+	if !c.EnablePVOutput {
+		p.logInfo("PVOutput has been disabled")
+		return nil
+	}
+	if c.PVOutputAPIKey == "" {
+		p.logError("PVOutput API Key has not been configured.")
+		p.enabled = false
+		return errors.New("api key has not been configured")
+	}
+	if c.PVOutputSystemID == "" {
+		p.logError("PVOutput System ID has not been configured.")
+		p.enabled = false
+		return errors.New("system id has not been configured")
+	}
+	p.lastTime = p.Srv.Power.StartTime
+	return nil
+}
+
+// SendTelemetry posts the consumption for the day and the current load to PVOutput
+func (p *PVOutput) SendTelemetry() error {
+	if !p.enabled {
+		return nil
+	}
+
+	c := p.Srv.GetConfig()
+	p.logInfo("Publishing power to PVOutput")
+	now := p.Srv.Now()
+	p.LastUpdateAttempt = now
+
+	consumed := p.Srv.Power.GetConsumed()
+	load := 0.0
+	if !p.lastTime.IsZero() {
+		load = averageLoad(consumed-p.lastConsumed, now.Sub(p.lastTime))
+	}
+
+	v := url.Values{}
+	v.Set("d", now.Format("20060102"))
+	v.Set("t", now.Format("15:04"))
+	v.Set("v3", fmt.Sprintf("%.0f", p.Srv.Power.GetDayConsumed(now)*1000))
+	v.Set("v4", fmt.Sprintf("%.0f", load))
+
+	req, err := http.NewRequest("POST", strings.TrimRight(c.PVOutputURL, "/")+"/service/r2/addstatus.jsp", strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Pvoutput-Apikey", c.PVOutputAPIKey)
+	req.Header.Set("X-Pvoutput-SystemId", c.PVOutputSystemID)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.logError("Error posting to PVOutput.", err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		p.logError("PVOutput returned status ", resp.Status)
+		return fmt.Errorf("PVOutput returned status %s", resp.Status)
+	}
+
+	p.lastConsumed = consumed
+	p.lastTime = now
+	p.LastUpdate = now
+
+	return nil
+}
+
+// logInfo logs an information message to the logger
+func (p *PVOutput) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("PVOutput", a)
+}
+
+// logError logs an error message to the logger
+func (p *PVOutput) logError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("PVOutput", a)
+}
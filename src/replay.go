@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Pulse recordings start with pulseFileMagic, followed by a uvarint for each record.
+// The low two bits of the uvarint hold the record type and the rest holds the value.
+const pulseFileMagic = "PWRPULSE1\n"
+
+// Pulse recording record types
+const (
+	recPulse = 0 // Pulse. The value is the milliseconds since the previous record.
+	recDark  = 1 // The light went off. The value is the milliseconds since the previous record.
+	recTime  = 2 // Sets the time of the next record. The value is the Unix time in milliseconds.
+)
+
+// PulseRecord holds a pulse read from a recording
+type PulseRecord struct {
+	Time time.Time // Time the pulse was detected
+	Dark bool      // Signals that the light went off, rather than a pulse
+}
+
+// PulseRecorder writes the time of every raw pulse, before it is filtered, to a file
+type PulseRecorder struct {
+	path string    // Path of the recording
+	file *os.File  // Open recording
+	last time.Time // Time of the last record written
+	mu   sync.Mutex
+}
+
+// Open starts recording to the specified file, appending to it if it exists.
+// An empty path stops recording.
+func (r *PulseRecorder) Open(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if path == r.path && r.file != nil {
+		return nil
+	}
+	r.close()
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.Size() == 0 {
+		_, err = f.Write([]byte(pulseFileMagic))
+	} else if err == nil {
+		magic := make([]byte, len(pulseFileMagic))
+		if _, err = f.ReadAt(magic, 0); err != nil || string(magic) != pulseFileMagic {
+			err = fmt.Errorf("%s is not a pulse recording", path)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.path = path
+	r.file = f
+	r.last = time.Time{}
+	r.logInfo("Recording pulses to ", path)
+	return nil
+}
+
+// Close stops recording
+func (r *PulseRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.close()
+}
+
+// close closes the recording
+func (r *PulseRecorder) close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	r.path = ""
+	return err
+}
+
+// Record writes a pulse, or the light going off, detected at the specified time
+func (r *PulseRecorder) Record(t time.Time, dark bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return
+	}
+
+	b := make([]byte, 0, 2*binary.MaxVarintLen64)
+	if r.last.IsZero() || t.Before(r.last) {
+		// Start of the recording, or the clock went back
+		b = binary.AppendUvarint(b, uint64(t.UnixMilli())<<2|recTime)
+		r.last = time.UnixMilli(t.UnixMilli())
+	}
+	typ := uint64(recPulse)
+	if dark {
+		typ = recDark
+	}
+	d := t.Sub(r.last).Milliseconds()
+	b = binary.AppendUvarint(b, uint64(d)<<2|typ)
+	r.last = r.last.Add(time.Duration(d) * time.Millisecond)
+
+	if _, err := r.file.Write(b); err != nil {
+		r.logError("Error recording pulse. ", err.Error())
+	}
+}
+
+// PulseFileReader reads the pulses from a recording
+type PulseFileReader struct {
+	r    *bufio.Reader // Recording
+	last time.Time     // Time of the last record read
+}
+
+// NewPulseFileReader checks that the reader holds a pulse recording
+// and returns a PulseFileReader that reads the pulses from it
+func NewPulseFileReader(r io.Reader) (*PulseFileReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(pulseFileMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != pulseFileMagic {
+		return nil, errors.New("not a pulse recording")
+	}
+	return &PulseFileReader{r: br}, nil
+}
+
+// Next returns the next pulse in the recording, or io.EOF at the end of the recording
+func (p *PulseFileReader) Next() (PulseRecord, error) {
+	for {
+		v, err := binary.ReadUvarint(p.r)
+		if err == io.ErrUnexpectedEOF {
+			// The last record was not written completely
+			err = io.EOF
+		}
+		if err != nil {
+			return PulseRecord{}, err
+		}
+		switch v & 3 {
+		case recTime:
+			p.last = time.UnixMilli(int64(v >> 2))
+		case recPulse, recDark:
+			if p.last.IsZero() {
+				return PulseRecord{}, errors.New("pulse recording does not start with a time")
+			}
+			p.last = p.last.Add(time.Duration(v>>2) * time.Millisecond)
+			return PulseRecord{Time: p.last, Dark: v&3 == recDark}, nil
+		default:
+			return PulseRecord{}, fmt.Errorf("unknown pulse record type %d", v&3)
+		}
+	}
+}
+
+// ReplaySource feeds the pulses from a recording into Power, or backfills the history with them.
+// An accelerated replay runs the server on a clock at the replay speed (see Config.ClockSpeed).
+type ReplaySource struct {
+	Path  string  // Path of the recording
+	Speed float64 // Speed of the replay, e.g. 1 for real time or 60 for an hour per minute. 0 backfills the history instantly.
+}
+
+// Name returns the name of the pulse source
+func (p *ReplaySource) Name() string {
+	return SourceReplay
+}
+
+// Run replays the pulses at the recorded intervals on the server clock, stamping them with
+// the current time. Replaying instantly backfills the history instead.
+func (p *ReplaySource) Run(s *Supervisor, stop <-chan struct{}) error {
+	f, err := os.Open(p.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := NewPulseFileReader(f)
+	if err != nil {
+		return fmt.Errorf("%s is %v", p.Path, err)
+	}
+	if p.Speed <= 0 {
+		return p.backfill(s, r, stop)
+	}
+
+	clock := s.Srv.clock()
+	var first, start time.Time
+	n := 0
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			s.logInfo("Replayed ", n, " pulses from ", p.Path)
+			return errSourceDone
+		}
+		if err != nil {
+			return err
+		}
+
+		if first.IsZero() {
+			first = rec.Time
+			start = clock.Now()
+		}
+		due := start.Add(rec.Time.Sub(first))
+		select {
+		case <-stop:
+			return nil
+		case <-clock.After(due.Sub(clock.Now())):
+		}
+		t := clock.Now()
+
+		if rec.Dark {
+			s.Srv.Power.recordDark(t)
+		} else {
+			s.Srv.Power.recordPulse(t)
+			n++
+		}
+	}
+}
+
+// backfill replaces the history for the hours the recording covers with the recorded pulses.
+// The pulses were counted when they were detected, so the balance and the pulse filter are
+// not changed. The pulses are filtered separately, with the current settings.
+func (p *ReplaySource) backfill(s *Supervisor, r *PulseFileReader, stop <-chan struct{}) error {
+	rate, interval := s.Srv.Power.filterSettings()
+	if rate <= 0 {
+		return errors.New("flash rate is not set")
+	}
+	filter := PulseFilter{MinInterval: interval}
+	hourly := make(map[string]float64)
+	var from, to time.Time
+	n := 0
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		if from.IsZero() || rec.Time.Before(from) {
+			from = rec.Time
+		}
+		if rec.Time.After(to) {
+			to = rec.Time
+		}
+		if rec.Dark || filter.Accept(rec.Time) != "" {
+			continue
+		}
+		hourly[rec.Time.Format(hourKey)] += 1 / float64(rate)
+		n++
+	}
+
+	if from.IsZero() {
+		s.logInfo("No pulses to backfill from ", p.Path)
+		return errSourceDone
+	}
+	s.Srv.History.ReplaceHours(from, to, hourly)
+	s.logInfo("Backfilled the history from ", from.Format(time.RFC3339), " to ", to.Format(time.RFC3339), " with ", n, " pulses from ", p.Path)
+	return errSourceDone
+}
+
+// logInfo logs an information message to the logger
+func (r *PulseRecorder) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("Recorder", a)
+}
+
+// logError logs an error message to the logger
+func (r *PulseRecorder) logError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("Recorder", a)
+}
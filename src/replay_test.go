@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestPulseRecording checks that the recorded pulses read back with millisecond precision
+func TestPulseRecording(t *testing.T) {
+	t.Chdir(t.TempDir())
+	want := []PulseRecord{
+		{Time: testStart.Add(1500 * time.Millisecond)},
+		{Time: testStart.Add(1600 * time.Millisecond), Dark: true},
+		{Time: testStart.Add(time.Hour)},
+		{Time: testStart.Add(-time.Minute)}, // The clock went back
+		{Time: testStart},
+	}
+
+	r := &PulseRecorder{}
+	if err := r.Open("pulses.rec"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range want[:2] {
+		r.Record(p.Time, p.Dark)
+	}
+	r.Close()
+
+	// Recording appends to the file
+	if err := r.Open("pulses.rec"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range want[2:] {
+		r.Record(p.Time.Add(123*time.Microsecond), p.Dark)
+	}
+	r.Close()
+
+	f, err := os.Open("pulses.rec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pr, err := NewPulseFileReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, w := range want {
+		p, err := pr.Next()
+		if err != nil {
+			t.Fatalf("record %d returned %v", i, err)
+		}
+		if !p.Time.Equal(w.Time) || p.Dark != w.Dark {
+			t.Errorf("record %d is %+v, want %+v", i, p, w)
+		}
+	}
+	if _, err := pr.Next(); err != io.EOF {
+		t.Errorf("end of the recording returned %v", err)
+	}
+}
+
+// TestPulseRecordingInvalid checks that other files are not recorded to or read
+func TestPulseRecordingInvalid(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("config.json", []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := &PulseRecorder{}
+	if err := r.Open("config.json"); err == nil {
+		r.Close()
+		t.Error("recording to a file that is not a recording")
+	}
+	if _, err := NewPulseFileReader(bytes.NewReader([]byte("{}"))); err == nil {
+		t.Error("read a file that is not a recording")
+	}
+
+	// A record that was not written completely ends the recording
+	pr, err := NewPulseFileReader(bytes.NewReader([]byte(pulseFileMagic + "\x82")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.Next(); err != io.EOF {
+		t.Errorf("partial record returned %v", err)
+	}
+}
+
+// TestReplayAccelerated checks that an accelerated replay stamps the pulses with the
+// time of the server clock, which runs at the replay speed, so they are not in the future
+func TestReplayAccelerated(t *testing.T) {
+	s, clock := newTestServer(t)
+	r := &PulseRecorder{}
+	if err := r.Open("pulses.rec"); err != nil {
+		t.Fatal(err)
+	}
+	rec := testStart.Add(-24 * time.Hour)
+	for i := 0; i < 3; i++ {
+		r.Record(rec.Add(time.Duration(i)*10*time.Second), false)
+	}
+	r.Close()
+
+	s.Power.SetReading(10)
+	s.GetConfig().PulseSource = SourceReplay
+	s.GetConfig().ReplayFile = "pulses.rec"
+	s.GetConfig().ReplaySpeed = 60
+	if sp := s.GetConfig().ClockSpeed(); sp != 60 {
+		t.Errorf("clock speed is %v, want 60", sp)
+	}
+	s.PulseSource.Start()
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			clock.Advance(10 * time.Second)
+		}
+		want := testStart.Add(time.Duration(i) * 10 * time.Second)
+		waitFor(t, "the pulse", func() bool { return s.Power.GetStatus().PulseCount == int64(i+1) })
+		if st := s.Power.GetStatus(); !st.LastPulse.Equal(want) || st.LastPulse.After(clock.Now()) {
+			t.Errorf("pulse %d is at %v, want %v", i, st.LastPulse, want)
+		}
+	}
+	waitFor(t, "the replay", func() bool { return s.PulseSource.GetStatus().State == SourceFinished })
+	if got := s.Power.GetCurrentLoad(); got != 360 {
+		t.Errorf("load is %v, want 360", got)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "time"
+
+// Job is run by the scheduler
+type Job interface {
+	Run()
+}
+
+// Scheduler runs a job every period of the server clock
+type Scheduler struct {
+	Clock  Clock         // Clock the period is measured on
+	Period time.Duration // Time between runs
+	Job    Job           // Job to run
+	done   chan struct{} // Closed to stop the scheduler
+}
+
+// Start starts running the job every period
+func (s *Scheduler) Start() {
+	s.done = make(chan struct{})
+	done := s.done
+	t := s.Clock.NewTicker(s.Period)
+	go func() {
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C():
+				s.Job.Run()
+			}
+		}
+	}()
+}
+
+// Stop stops the scheduler. A run that is in progress is not waited for.
+func (s *Scheduler) Stop() {
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Sensor faults
+const (
+	FaultNone      = ""          // Sensor is working
+	FaultSilence   = "silence"   // No pulses for longer than the load allows, e.g. the sensor fell off the meter
+	FaultStuckHigh = "stuckHigh" // Sensor has been seeing light for longer than a flash lasts
+)
+
+const (
+	faultCheckInterval = time.Minute     // Time between sensor checks
+	faultStuckHigh     = 5 * time.Minute // Time the sensor can see light before it is reported as stuck
+	faultBaseLoadDays  = 7               // Number of days of history the base load is taken from
+	faultBaseLoadHours = 24              // Minimum number of hours of history needed for the base load
+)
+
+// SensorFault holds the state of the light sensor
+type SensorFault struct {
+	Fault   string    `json:"fault"`             // Sensor fault, or empty if the sensor is working
+	Message string    `json:"message,omitempty"` // Description of the fault
+	Since   time.Time `json:"since"`             // Time the fault was raised or cleared
+}
+
+// SensorMonitor checks the pulses for signs that the light sensor is faulty
+type SensorMonitor struct {
+	Srv   *Server       // Server instance
+	state SensorFault   // Current state of the sensor
+	done  chan struct{} // Closed to stop checking
+	mu    sync.Mutex
+}
+
+// Start starts checking the sensor
+func (m *SensorMonitor) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done != nil {
+		return
+	}
+	m.done = make(chan struct{})
+	go m.run(m.done)
+}
+
+// Stop stops checking the sensor
+func (m *SensorMonitor) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done != nil {
+		close(m.done)
+		m.done = nil
+	}
+}
+
+// GetFault returns the state of the sensor
+func (m *SensorMonitor) GetFault() SensorFault {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// run checks the sensor until it is stopped
+func (m *SensorMonitor) run(done chan struct{}) {
+	t := m.Srv.clock().NewTicker(faultCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-t.C():
+			m.Check(now)
+		}
+	}
+}
+
+// Check checks the sensor at the specified time and raises or clears the fault
+func (m *SensorMonitor) Check(now time.Time) SensorFault {
+	if !m.Srv.PulseSource.GetStatus().Running {
+		// The pulse source is reported by its own health check
+		return m.GetFault()
+	}
+	fault, msg := m.detect(now)
+
+	m.mu.Lock()
+	prev := m.state
+	if fault == prev.Fault {
+		m.state.Message = msg
+		m.mu.Unlock()
+		return m.GetFault()
+	}
+	m.state = SensorFault{Fault: fault, Message: msg, Since: now}
+	m.mu.Unlock()
+
+	if fault != FaultNone {
+		m.logError("Sensor fault. ", msg)
+		m.Srv.Events.Publish(EventAlert, AlertEvent{Source: "Sensor", Message: "Sensor fault. " + msg})
+	} else {
+		m.logInfo("Sensor fault cleared")
+		m.Srv.Events.Publish(EventAlert, AlertEvent{Source: "Sensor", Message: "Sensor fault cleared"})
+	}
+	return m.GetFault()
+}
+
+// detect returns the fault the pulses point to, and its description
+func (m *SensorMonitor) detect(now time.Time) (string, string) {
+	st := m.Srv.Power.GetStatus()
+	src := m.Srv.PulseSource.GetStatus()
+	if !st.LitSince.IsZero() && now.Sub(st.LitSince) > faultStuckHigh {
+		return FaultStuckHigh, fmt.Sprintf("the sensor has been seeing light since %s", st.LitSince.Format(time.RFC3339))
+	}
+
+	// No pulses can be expected until the pulse source has been running for a while
+	silence := time.Duration(m.Srv.GetConfig().FaultSilence) * time.Hour
+	last := st.LastPulse
+	if last.Before(src.Started) {
+		last = src.Started
+	}
+	if now.Sub(last) <= silence {
+		return FaultNone, ""
+	}
+	base, hours := m.Srv.History.GetBaseLoad(last, faultBaseLoadDays)
+	if hours < faultBaseLoadHours || base < m.Srv.GetConfig().FaultBaseLoad {
+		return FaultNone, ""
+	}
+	return FaultSilence, fmt.Sprintf("no pulses for %s, but the load did not drop below %.0f W in the %d hours before",
+		now.Sub(last).Round(time.Minute), base, hours)
+}
+
+// logInfo logs an information message to the logger
+func (m *SensorMonitor) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("Sensor", a)
+}
+
+// logError logs an error message to the logger
+func (m *SensorMonitor) logError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("Sensor", a)
+}
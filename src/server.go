@@ -1,230 +1,572 @@
-package main
-
-import (
-	"fmt"
-	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
-	"time"
-
-	gopifinder "github.com/brumawen/gopi-finder/src"
-	"github.com/gorilla/mux"
-	"github.com/kardianos/service"
-	"github.com/onatm/clockwerk"
-)
-
-// Server defines the Garage web service
-type Server struct {
-	PortNo         int                  // Port number the server will listen on
-	VerboseLogging bool                 // Verbose logging on/off
-	Config         *Config              // Configuration settings
-	Finder         gopifinder.Finder    // Finder client - used to find other devices
-	Uploader       Uploader             // Uploader
-	Power          Power                // Power information
-	exit           chan struct{}        // Exit flag
-	shutdown       chan struct{}        // Shutdown complete flag
-	http           *http.Server         // HTTP server
-	router         *mux.Router          // HTTP router
-	cw             *clockwerk.Clockwerk // Clockwerk scheduler
-	isregistering  bool                 // Indicates that a registration is currently ongoing
-}
-
-// Start initializes and starts the server running
-func (s *Server) Start(v service.Service) error {
-	s.logInfo("Service starting")
-	app, err := os.Executable()
-	if err != nil {
-		s.logError("Error getting current executable directory.", err.Error())
-	} else {
-		wd, err := os.Getwd()
-		if err != nil {
-			s.logError("Error getting current working directory.", err.Error())
-		} else {
-			ad := filepath.Dir(app)
-			s.logInfo("Current application path is", ad)
-			if ad != wd {
-				if err := os.Chdir(ad); err != nil {
-					s.logError("Error changing working directory.", err.Error())
-				}
-			}
-		}
-	}
-
-	// Create a channel that will be used to block until the Stop signal is received
-	s.exit = make(chan struct{})
-	go s.run()
-	return nil
-}
-
-// Stop shuts the server down
-func (s *Server) Stop(v service.Service) error {
-	s.logInfo("Service stopping")
-	// Close the channel, this will automatically release the block
-	s.shutdown = make(chan struct{})
-	close(s.exit)
-	// Wait for the shutdown to complete
-	_ = <-s.shutdown
-	return nil
-}
-
-// run will start up and run the service and wait for a Stop signal
-func (s *Server) run() {
-	if s.PortNo < 0 {
-		s.PortNo = 20515
-	}
-
-	s.logInfo("Using port no", s.PortNo)
-
-	s.Uploader.Srv = s
-	s.Finder.Logger = logger
-	s.Finder.VerboseLogging = service.Interactive()
-
-	s.logInfo("Loading Configuration")
-
-	// Get the configuration
-	if s.Config == nil {
-		s.Config = &Config{}
-	}
-	s.Config.ReadFromFile("config.json")
-	s.Power.FlashRate = s.Config.FlashRate
-
-	s.logInfo("Configuration loaded successfully")
-
-	// Create a router
-	s.router = mux.NewRouter().StrictSlash(true)
-	s.router.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", http.FileServer(http.Dir("./html/assets"))))
-
-	s.logInfo("Router created")
-
-	// Add the controllers
-	s.addController(new(PowerController))
-	s.addController(new(LogController))
-
-	s.logInfo("Controllers loaded")
-
-	// Create an HTTP server
-	s.http = &http.Server{
-		Addr:    fmt.Sprintf(":%d", s.PortNo),
-		Handler: s.router,
-	}
-
-	// Start the web server
-	go func() {
-		s.logInfo("Server listening on port", s.PortNo)
-		if err := s.http.ListenAndServe(); err != nil {
-			msg := err.Error()
-			if !strings.Contains(msg, "http: Server closed") {
-				s.logError("Error starting Web Server.", msg)
-			}
-		}
-	}()
-
-	go func() {
-		// Register service with the Finder server
-		go s.RegisterService()
-
-		// Start the scheduler
-		s.logInfo("Starting schedule")
-		s.startSchedule()
-	}()
-
-	// Wait for an exit signal
-	_ = <-s.exit
-
-	// Shutdown the HTTP server
-	s.http.Shutdown(nil)
-
-	// Shutdown the uploader
-	s.Uploader.Close()
-
-	s.logInfo("Shutdown complete")
-	close(s.shutdown)
-}
-
-func (s *Server) startSchedule() {
-	if s.Config.Period <= 0 {
-		s.Config.Period = 5
-	}
-	if s.cw != nil {
-		s.cw.Stop()
-		s.cw = nil
-	}
-	s.cw = clockwerk.New()
-	s.cw.Every(time.Duration(s.Config.Period) * time.Minute).Do(&s.Uploader)
-
-	s.cw.Start()
-
-	s.logDebug("Schedule set.")
-
-	// Run immedietely
-	s.Uploader.Run()
-}
-
-func (s *Server) addController(c Controller) {
-	c.AddController(s.router, s)
-}
-
-// RegisterService will register the service with the devices on the network
-func (s *Server) RegisterService() {
-	if s.isregistering {
-		return
-	}
-	s.isregistering = true
-	isReg := false
-	s.logDebug("Starting service registration.")
-	for !isReg {
-		s.logDebug("RegisterService: Getting device info")
-		d, err := gopifinder.NewDeviceInfo()
-		if err != nil {
-			s.logError("Error getting device info.", err.Error())
-		}
-		s.logDebug("RegisterService: Creating service")
-		sv := d.CreateService("Temperature")
-		sv.PortNo = s.PortNo
-
-		if sv.IPAddress == "" {
-			s.logDebug("RegisterService: No IP address found.")
-		} else {
-			s.logDebug("RegisterService: Using IP address", sv.IPAddress)
-		}
-
-		s.logDebug("Reg: Finding devices")
-		_, err = s.Finder.FindDevices()
-		if err != nil {
-			s.logError("RegisterService: Error getting list of devices.", err.Error())
-		} else {
-			if len(s.Finder.Devices) == 0 {
-				s.logDebug("RegisterService: Sleeping")
-				time.Sleep(15 * time.Second)
-			} else {
-				// Register the services with the devices
-				s.logDebug("RegisterService: Registering the service.")
-				s.Finder.RegisterServices([]gopifinder.ServiceInfo{sv})
-				isReg = true
-			}
-		}
-	}
-	s.logDebug("Completed service registration.")
-	s.isregistering = false
-}
-
-// logDebug logs a debug message to the logger
-func (s *Server) logDebug(v ...interface{}) {
-	if s.VerboseLogging {
-		a := fmt.Sprint(v...)
-		logger.Info("Server: [Dbg] ", a)
-	}
-}
-
-// logInfo logs an information message to the logger
-func (s *Server) logInfo(v ...interface{}) {
-	a := fmt.Sprint(v...)
-	logger.Info("Server: [Inf] ", a)
-}
-
-// logError logs an error message to the logger
-func (s *Server) logError(v ...interface{}) {
-	a := fmt.Sprint(v...)
-	logger.Error("Server [Err] ", a)
-}
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gopifinder "github.com/brumawen/gopi-finder/src"
+	"github.com/gorilla/mux"
+	"github.com/kardianos/service"
+)
+
+// Server defines the Garage web service
+type Server struct {
+	PortNo         int                    // Port number the server will listen on
+	VerboseLogging bool                   // Verbose logging on/off
+	ConfigPath     string                 // Path to the configuration file
+	ConfigFlags    map[string]string      // Configuration values set by command line flags
+	Finder         gopifinder.Finder      // Finder client - used to find other devices
+	Uploader       Uploader               // Uploader
+	Power          Power                  // Power information
+	PulseSource    Supervisor             // Runs the pulse detector
+	Sensor         SensorMonitor          // Checks for a faulty light sensor
+	Recorder       PulseRecorder          // Records the raw pulses
+	Events         EventBroker            // Live events
+	History        History                // Consumption and top-up history
+	Calibration    Calibration            // Measures the flash rate and light levels
+	TimeSync       ClockMonitor           // Watches the system clock for steps
+	Clock          Clock                  // Clock used for the pulses and the schedule. The system clock if not set.
+	exit           chan struct{}          // Exit flag
+	shutdown       chan struct{}          // Shutdown complete flag
+	http           *http.Server           // HTTP server
+	redirect       *http.Server           // HTTP server that redirects to HTTPS
+	router         *mux.Router            // HTTP router
+	sched          *Scheduler             // Upload scheduler
+	schedLock      sync.Mutex             // Lock used when changing the scheduler
+	configWatcher  ConfigWatcher          // Watches for configuration changes
+	notifier       Notifier               // Notifies systemd of the service state
+	isregistering  bool                   // Indicates that a registration is currently ongoing
+	startTime      time.Time              // Time the service started
+	config         atomic.Pointer[Config] // Active configuration. It is replaced, never changed, when the configuration changes.
+	configLock     sync.Mutex             // Serializes the configuration changes
+	configInvalid  atomic.Bool            // Signals that the active configuration did not pass validation when it was applied
+	restartLock    sync.Mutex             // Serializes the upload restarts after configuration changes
+	ready          atomic.Bool            // Signals that the service has started and is serving requests
+}
+
+// Start initializes and starts the server running
+func (s *Server) Start(v service.Service) error {
+	s.logInfo("Service starting")
+	app, err := os.Executable()
+	if err != nil {
+		s.logError("Error getting current executable directory.", err.Error())
+	} else {
+		wd, err := os.Getwd()
+		if err != nil {
+			s.logError("Error getting current working directory.", err.Error())
+		} else {
+			ad := filepath.Dir(app)
+			s.logInfo("Current application path is", ad)
+			if ad != wd {
+				if err := os.Chdir(ad); err != nil {
+					s.logError("Error changing working directory.", err.Error())
+				}
+			}
+		}
+	}
+
+	// Do not run with a configuration that cannot be used
+	if err := s.loadConfig(); err != nil {
+		s.logError(err.Error())
+		return err
+	}
+
+	// Create a channel that will be used to block until the Stop signal is received
+	s.exit = make(chan struct{})
+	go s.run()
+	return nil
+}
+
+// loadConfig reads and validates the configuration file and makes it the active configuration.
+// The defaults are used if there is no configuration file.
+func (s *Server) loadConfig() error {
+	s.logInfo("Loading Configuration")
+	if s.ConfigPath == "" {
+		s.ConfigPath = "config.json"
+	}
+	s.migrateConfig()
+	c, err := LoadConfig(s.ConfigPath, s.ConfigFlags)
+	if err == nil {
+		err = c.Validate()
+	}
+	if err != nil {
+		return fmt.Errorf("configuration file %s is invalid. Fix it, or check it with -check-config, and start the service again. %s", s.ConfigPath, err.Error())
+	}
+	s.logInfo("Configuration loaded successfully")
+	s.config.Store(c)
+	return nil
+}
+
+// Stop shuts the server down
+func (s *Server) Stop(v service.Service) error {
+	s.logInfo("Service stopping")
+	// Close the channel, this will automatically release the block
+	s.shutdown = make(chan struct{})
+	close(s.exit)
+	// Wait for the shutdown to complete
+	_ = <-s.shutdown
+	return nil
+}
+
+// run will start up and run the service and wait for a Stop signal
+func (s *Server) run() {
+	// Keep the log in the application directory, so that it survives restarts
+	if err := logs.Open("log.jsonl"); err != nil {
+		s.logError("Error opening log file.", err.Error())
+	}
+
+	if s.PortNo < 0 {
+		s.PortNo = 20515
+	}
+
+	s.logInfo("Using port no", s.PortNo)
+
+	s.Uploader.Srv = s
+	s.Power.Srv = s
+	s.Finder.Logger = componentLogger{component: "Finder"}
+	s.Finder.VerboseLogging = service.Interactive()
+
+	c := s.GetConfig()
+	setLogSecrets(c)
+	s.setLogLevels(c)
+	s.Power.FlashRate = c.FlashRate
+	s.Power.SetMaxLoad(c.MaxLoad)
+
+	// The simulator and accelerated replays run the whole service on an accelerated clock
+	if speed := c.ClockSpeed(); s.Clock == nil && speed != 1 {
+		s.Clock = NewScaledClock(speed)
+		s.logInfo("Running on a clock ", speed, " times faster than real time")
+	}
+	s.startTime = s.Now()
+	if !c.AuthEnabled() {
+		s.logInfo("API authentication is disabled. Add API keys or users to the configuration to restrict access.")
+	} else if !c.EnableTLS {
+		s.logInfo("API credentials are sent in clear text. Set enableTls in the configuration to use HTTPS.")
+	}
+
+	// The configuration file can hold secrets, so make sure only the owner can read it
+	if fi, err := os.Stat(s.ConfigPath); err == nil && fi.Mode().Perm()&0077 != 0 {
+		s.logInfo("Restricting the permissions of ", s.ConfigPath)
+		if err := os.Chmod(s.ConfigPath, 0600); err != nil {
+			s.logError("Error changing the permissions of ", s.ConfigPath, ". ", err.Error())
+		}
+	}
+
+	// Watch for changes to the configuration
+	s.configWatcher.Srv = s
+	if err := s.configWatcher.Start(); err != nil {
+		s.logError("Error watching configuration file.", err.Error())
+	}
+
+	// Restore the balance and start monitoring pulses
+	if err := s.Power.LoadCurrentPower("power.dat"); err != nil && !os.IsNotExist(err) {
+		s.logError("Error loading current power.", err.Error())
+	}
+	if err := s.History.ReadFromFile("history.json"); err != nil {
+		s.logError("Error loading history.", err.Error())
+	}
+	s.TimeSync.Srv = s
+	s.TimeSync.Start()
+	if err := s.Recorder.Open(c.RecordFile); err != nil {
+		s.logError("Error opening pulse recording.", err.Error())
+	}
+	s.PulseSource.Srv = s
+	s.PulseSource.Start()
+	s.Sensor.Srv = s
+	s.Sensor.Start()
+	s.Calibration.Srv = s
+
+	// Create a router
+	s.router = mux.NewRouter().StrictSlash(true)
+
+	s.logInfo("Router created")
+
+	// Add the controllers
+	s.addController(new(PowerController))
+	s.addController(new(LogController))
+	s.addController(new(ConfigController))
+	s.addController(new(WsController))
+	s.addController(new(DashboardController))
+	s.addController(new(HealthController))
+	s.addController(new(CalibrationController))
+
+	s.logInfo("Controllers loaded")
+
+	// Create an HTTP server
+	s.http = &http.Server{
+		Addr:    fmt.Sprintf(":%d", s.PortNo),
+		Handler: s.router,
+	}
+	if c.EnableTLS {
+		s.http.TLSConfig = s.tlsConfig()
+	}
+
+	// Start the web server
+	go func() {
+		var err error
+		if s.http.TLSConfig != nil {
+			s.logInfo("Server listening for HTTPS on port", s.PortNo)
+			err = s.http.ListenAndServeTLS("", "")
+		} else {
+			s.logInfo("Server listening on port", s.PortNo)
+			err = s.http.ListenAndServe()
+		}
+		if err != nil {
+			msg := err.Error()
+			if !strings.Contains(msg, "http: Server closed") {
+				s.logError("Error starting Web Server.", msg)
+			}
+		}
+	}()
+
+	// Redirect HTTP to HTTPS, if required
+	if s.http.TLSConfig != nil && c.HTTPRedirectPort != 0 && c.HTTPRedirectPort != s.PortNo {
+		s.redirect = &http.Server{
+			Addr:    fmt.Sprintf(":%d", c.HTTPRedirectPort),
+			Handler: redirectHandler(s.PortNo),
+		}
+		go func() {
+			s.logInfo("Redirecting HTTP on port ", c.HTTPRedirectPort, " to HTTPS")
+			if err := s.redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				s.logError("Error starting HTTP redirect server.", err.Error())
+			}
+		}()
+	}
+
+	s.ready.Store(true)
+	s.notifier.Srv = s
+	s.notifier.Ready(fmt.Sprintf("Listening on port %d", s.PortNo))
+	s.notifier.Start()
+
+	go func() {
+		// Register service with the Finder server
+		go s.RegisterService()
+
+		// Start the scheduler
+		s.logInfo("Starting schedule")
+		s.startSchedule()
+	}()
+
+	// Wait for an exit signal
+	_ = <-s.exit
+	s.ready.Store(false)
+	s.notifier.Stop()
+	s.notifier.Stopping()
+
+	// Close the live event streams and shutdown the HTTP server
+	s.Events.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	s.http.Shutdown(ctx)
+	if s.redirect != nil {
+		s.redirect.Shutdown(ctx)
+	}
+	cancel()
+
+	// Stop counting pulses and save the balance
+	s.Sensor.Stop()
+	s.PulseSource.Stop()
+	s.Recorder.Close()
+	s.TimeSync.Stop()
+	if err := s.Power.SaveCurrentPower("power.dat"); err != nil {
+		s.logError("Error saving current power.", err.Error())
+	}
+	if n := s.History.Release(); n > 0 {
+		s.logInfo("The clock was not synchronized, so ", n, " held history entries are saved with the unsynchronized times")
+	}
+	if err := s.History.WriteToFile("history.json", s.Now()); err != nil {
+		s.logError("Error saving history.", err.Error())
+	}
+
+	// Stop watching the configuration
+	s.configWatcher.Stop()
+
+	// Shutdown the uploader
+	s.Uploader.Close()
+
+	s.logInfo("Shutdown complete")
+	logs.Close()
+	close(s.shutdown)
+}
+
+func (s *Server) startSchedule() {
+	s.schedLock.Lock()
+	defer s.schedLock.Unlock()
+	period := s.GetConfig().Period
+	if period <= 0 {
+		period = 5
+	}
+	if s.sched != nil {
+		s.sched.Stop()
+		s.sched = nil
+	}
+	s.sched = &Scheduler{
+		Clock:  s.clock(),
+		Period: time.Duration(period) * time.Minute,
+		Job:    &s.Uploader,
+	}
+	s.sched.Start()
+
+	s.logDebug("Schedule set.")
+
+	// Run immedietely
+	s.Uploader.Run()
+}
+
+// GetConfig returns the active configuration. It is shared, so it must not be changed.
+func (s *Server) GetConfig() *Config {
+	return s.config.Load()
+}
+
+// ApplyConfig makes the specified configuration the active configuration
+// and re-initializes the services that depend on it
+func (s *Server) ApplyConfig(c *Config) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	s.applyConfig(c)
+}
+
+// applyConfig applies the configuration. The configuration lock must be held.
+func (s *Server) applyConfig(c *Config) {
+	old := s.config.Swap(c)
+	setLogSecrets(c)
+	err := c.Validate()
+	s.configInvalid.Store(err != nil)
+	if err != nil {
+		s.logError("The applied configuration is not valid. ", err.Error())
+	}
+	if reflect.DeepEqual(old, c) {
+		s.logInfo("Configuration has not changed")
+		return
+	}
+
+	changes := old.Changes(c)
+	if len(changes) == 0 {
+		s.logInfo("Configuration updated")
+		return
+	}
+	s.logInfo("Applying configuration changes to ", strings.Join(changes, ", "))
+	reset := []string{}
+	schedule := false
+	for _, n := range changes {
+		switch n {
+		case "power":
+			s.Power.SetFlashRate(c.FlashRate)
+			s.Power.SetMaxLoad(c.MaxLoad)
+		case "schedule":
+			schedule = true
+		case "sensor":
+			s.PulseSource.Restart()
+		case "recording":
+			if err := s.Recorder.Open(c.RecordFile); err != nil {
+				s.logError("Error opening pulse recording.", err.Error())
+			}
+		case "logging":
+			s.setLogLevels(c)
+		case "clock":
+			s.logInfo("The clock speed change will take effect when the service is restarted")
+		case "https":
+			s.logInfo("The HTTPS change will take effect when the service is restarted")
+		case "auth":
+			// The credentials are read from the configuration on each request
+		default:
+			reset = append(reset, n)
+		}
+	}
+	if len(reset) == 0 && !schedule {
+		return
+	}
+	go func() {
+		s.restartLock.Lock()
+		defer s.restartLock.Unlock()
+		if len(reset) != 0 {
+			s.Uploader.Reset(reset...)
+		}
+		if schedule {
+			s.startSchedule()
+		} else {
+			s.Uploader.Run()
+		}
+	}()
+}
+
+// UpdateConfigFile changes the values in the configuration file and, if the configuration
+// with the overrides applied is valid, saves and applies it
+func (s *Server) UpdateConfigFile(update func(c *Config) error) (*Config, error) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	fc := &Config{}
+	if err := fc.ReadFromFile(s.ConfigPath); err != nil {
+		return nil, err
+	}
+	if err := update(fc); err != nil {
+		return nil, err
+	}
+
+	nc, err := fc.WithOverrides(s.ConfigFlags)
+	if err == nil {
+		err = nc.Validate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := fc.WriteToFile(s.ConfigPath); err != nil {
+		return nil, err
+	}
+	s.logInfo("Configuration file ", s.ConfigPath, " updated")
+	s.applyConfig(nc)
+	return nc, nil
+}
+
+// ReloadConfig reads the configuration file and, if it is valid, applies it.
+// If it is not valid, the current configuration is kept.
+func (s *Server) ReloadConfig() {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	s.logInfo("Reloading configuration from ", s.ConfigPath)
+	if _, err := os.Stat(s.ConfigPath); err != nil {
+		s.logError("Error reading configuration file ", s.ConfigPath, ". Keeping the current configuration. ", err.Error())
+		return
+	}
+	s.migrateConfig()
+	c, err := LoadConfig(s.ConfigPath, s.ConfigFlags)
+	if err != nil {
+		s.logError("Error reading configuration file ", s.ConfigPath, ". Keeping the current configuration. ", err.Error())
+		return
+	}
+	if err := c.Validate(); err != nil {
+		s.logError("Configuration file ", s.ConfigPath, " is invalid. Keeping the current configuration. ", err.Error())
+		return
+	}
+	s.applyConfig(c)
+}
+
+// migrateConfig upgrades the configuration file to the current layout, if required
+func (s *Server) migrateConfig() {
+	from, err := MigrateConfigFile(s.ConfigPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logError("Error upgrading configuration file ", s.ConfigPath, ". ", err.Error())
+		}
+		return
+	}
+	if from != 0 {
+		s.logInfo("Configuration file upgraded from version ", from, " to ", configVersion, ". The original was saved as ", s.ConfigPath, ".v", from, ".bak")
+	}
+}
+
+// setLogLevels sets the log levels from the configuration. When running in a
+// terminal, debug messages are logged unless a level has been configured.
+func (s *Server) setLogLevels(c *Config) {
+	level := c.LogLevel
+	if s.VerboseLogging && c.sources["logLevel"] == "" {
+		level = LevelDebug
+	}
+	logs.SetLevels(level, c.LogLevels)
+}
+
+// tlsConfig loads the HTTPS certificate and returns the TLS configuration. If the
+// configured certificate cannot be loaded, the self-signed certificate is used,
+// so that credentials are never sent in clear text.
+func (s *Server) tlsConfig() *tls.Config {
+	cfg := s.GetConfig()
+	cert, self, err := loadCertificate(cfg)
+	if err != nil && !self {
+		s.logError("Error loading the HTTPS certificate ", cfg.TLSCertFile, ". Using a self-signed certificate. ", err.Error())
+		c := cfg.clone()
+		c.TLSCertFile = ""
+		cert, self, err = loadCertificate(c)
+	}
+	if err != nil {
+		s.logError("Error creating the self-signed HTTPS certificate. HTTPS is not available. ", err.Error())
+		return &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return nil, errors.New("no certificate")
+			},
+		}
+	}
+	if self {
+		s.logInfo("Using the self-signed HTTPS certificate ", selfSignedCertFile, ". SHA-256 fingerprint ", certFingerprint(cert))
+	} else {
+		s.logInfo("Using the HTTPS certificate ", cfg.TLSCertFile, ". SHA-256 fingerprint ", certFingerprint(cert))
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+}
+
+func (s *Server) addController(c Controller) {
+	c.AddController(s.router, s)
+}
+
+// RegisterService will register the service with the devices on the network
+func (s *Server) RegisterService() {
+	if s.isregistering {
+		return
+	}
+	s.isregistering = true
+	isReg := false
+	s.logDebug("Starting service registration.")
+	for !isReg {
+		s.logDebug("RegisterService: Getting device info")
+		d, err := gopifinder.NewDeviceInfo()
+		if err != nil {
+			s.logError("Error getting device info.", err.Error())
+		}
+		s.logDebug("RegisterService: Creating service")
+		sv := d.CreateService("Temperature")
+		sv.PortNo = s.PortNo
+
+		if sv.IPAddress == "" {
+			s.logDebug("RegisterService: No IP address found.")
+		} else {
+			s.logDebug("RegisterService: Using IP address", sv.IPAddress)
+		}
+
+		s.logDebug("Reg: Finding devices")
+		_, err = s.Finder.FindDevices()
+		if err != nil {
+			s.logError("RegisterService: Error getting list of devices.", err.Error())
+		} else {
+			if len(s.Finder.Devices) == 0 {
+				s.logDebug("RegisterService: Sleeping")
+				time.Sleep(15 * time.Second)
+			} else {
+				// Register the services with the devices
+				s.logDebug("RegisterService: Registering the service.")
+				s.Finder.RegisterServices([]gopifinder.ServiceInfo{sv})
+				isReg = true
+			}
+		}
+	}
+	s.logDebug("Completed service registration.")
+	s.isregistering = false
+}
+
+// logDebug logs a debug message to the logger
+func (s *Server) logDebug(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Debug("Server", a)
+}
+
+// logInfo logs an information message to the logger
+func (s *Server) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("Server", a)
+}
+
+// logError logs an error message to the logger
+func (s *Server) logError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("Server", a)
+}
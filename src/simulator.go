@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// SourceSimulator is the pulse source that generates pulses from a load profile
+const SourceSimulator = "simulator"
+
+const (
+	simStep       = 10 * time.Second // Simulated time the load is held constant for
+	kettleBoiling = 3 * time.Minute  // Time a kettle is on for
+)
+
+// LoadProfile describes the load generated by the simulator
+type LoadProfile struct {
+	BaseLoad      float64 `json:"baseLoad"`      // Load that is always on (in Watts)
+	DayLoad       float64 `json:"dayLoad"`       // Load added at the evening peak (in Watts). Half of it is added at the morning peak.
+	GeyserLoad    float64 `json:"geyserLoad"`    // Load of the geyser element (in Watts)
+	GeyserOn      float64 `json:"geyserOn"`      // Time the geyser element is on in each cycle (in minutes)
+	GeyserCycle   float64 `json:"geyserCycle"`   // Time between the geyser element switching on (in minutes)
+	KettleLoad    float64 `json:"kettleLoad"`    // Load of the kettle (in Watts)
+	KettlesPerDay float64 `json:"kettlesPerDay"` // Average number of times the kettle is boiled per day
+	Noise         float64 `json:"noise"`         // Random variation of the load, as a fraction of the load
+}
+
+// defaultLoadProfile is the load profile used when no profile file is configured
+var defaultLoadProfile = LoadProfile{
+	BaseLoad:      150,
+	DayLoad:       600,
+	GeyserLoad:    3000,
+	GeyserOn:      20,
+	GeyserCycle:   120,
+	KettleLoad:    2200,
+	KettlesPerDay: 6,
+	Noise:         0.1,
+}
+
+// ReadLoadProfile reads the load profile from the specified file,
+// or returns the default load profile if the path is empty
+func ReadLoadProfile(path string) (LoadProfile, error) {
+	if path == "" {
+		return defaultLoadProfile, nil
+	}
+	p := LoadProfile{}
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(b, &p)
+	}
+	if err == nil {
+		err = p.Validate()
+	}
+	return p, err
+}
+
+// Validate checks that the load profile values are possible
+func (p *LoadProfile) Validate() error {
+	if p.BaseLoad < 0 || p.DayLoad < 0 || p.GeyserLoad < 0 || p.KettleLoad < 0 {
+		return fmt.Errorf("loads cannot be negative")
+	}
+	if p.GeyserOn < 0 || p.GeyserCycle < 0 || p.GeyserOn > p.GeyserCycle {
+		return fmt.Errorf("geyserOn must be between 0 and geyserCycle minutes")
+	}
+	if p.KettlesPerDay < 0 || p.Noise < 0 || p.Noise > 1 {
+		return fmt.Errorf("kettlesPerDay cannot be negative and noise must be between 0 and 1")
+	}
+	return nil
+}
+
+// load returns the load (in Watts) at the specified time, excluding the kettle and the noise
+func (p *LoadProfile) load(t time.Time, start time.Time) float64 {
+	l := p.BaseLoad
+
+	// Morning and evening peaks
+	h := float64(t.Hour()) + float64(t.Minute())/60
+	l += p.DayLoad * (0.5*peak(h, 7, 1.5) + peak(h, 19, 2))
+
+	// The geyser element switches on at the start of every cycle
+	if p.GeyserCycle > 0 {
+		cycle := time.Duration(p.GeyserCycle * float64(time.Minute))
+		if t.Sub(start)%cycle < time.Duration(p.GeyserOn*float64(time.Minute)) {
+			l += p.GeyserLoad
+		}
+	}
+	return l
+}
+
+// peak returns the height, between 0 and 1, of a daily peak at the specified hour
+func peak(h float64, at float64, width float64) float64 {
+	d := math.Abs(h - at)
+	if d > 12 {
+		d = 24 - d
+	}
+	return math.Exp(-d * d / (2 * width * width))
+}
+
+// SimulatorSource generates pulses from a load profile, for use without a meter
+type SimulatorSource struct {
+	Profile     LoadProfile // Load profile, used if there is no profile file
+	ProfileFile string      // File the load profile is read from
+	Seed        int64       // Seed of the random numbers. 0 uses a random seed.
+}
+
+// Name returns the name of the pulse source
+func (m *SimulatorSource) Name() string {
+	return SourceSimulator
+}
+
+// Run generates the pulses on the server clock until it is stopped. The server
+// runs on an accelerated clock when the simulator speed is set. The meter flashes
+// at the flash rate Power counts at, which is read for each step as it can be changed.
+func (m *SimulatorSource) Run(s *Supervisor, stop <-chan struct{}) error {
+	if m.ProfileFile != "" {
+		p, err := ReadLoadProfile(m.ProfileFile)
+		if err != nil {
+			return fmt.Errorf("error reading load profile %s. %v", m.ProfileFile, err)
+		}
+		m.Profile = p
+	}
+	seed := m.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rnd := rand.New(rand.NewSource(seed))
+
+	clock := s.Srv.clock()
+	start := clock.Now()
+	t := start
+	energy := 0.0 // Energy used since the last pulse (in Wh)
+	kettleOff := time.Time{}
+
+	for {
+		rate, _ := s.Srv.Power.filterSettings()
+		if rate <= 0 {
+			return fmt.Errorf("flash rate must be greater than 0")
+		}
+		pulse := 1000 / float64(rate) // Energy of a pulse (in Wh)
+
+		// Boil the kettle at random times
+		if t.After(kettleOff) && rnd.Float64() < m.Profile.KettlesPerDay*simStep.Hours()/24 {
+			kettleOff = t.Add(kettleBoiling)
+		}
+		l := m.Profile.load(t, start)
+		if t.Before(kettleOff) {
+			l += m.Profile.KettleLoad
+		}
+		if m.Profile.Noise > 0 {
+			l = math.Max(0, l*(1+m.Profile.Noise*rnd.NormFloat64()))
+		}
+
+		// Generate the pulses for this step, with the load held constant
+		end := t.Add(simStep)
+		for l > 0 {
+			pt := t.Add(time.Duration((pulse - energy) / l * float64(time.Hour)))
+			if pt.After(end) {
+				break
+			}
+			if !wait(clock, pt, stop) {
+				return nil
+			}
+			s.Srv.Power.recordPulse(pt)
+			energy = 0
+			t = pt
+		}
+		energy += l * end.Sub(t).Hours()
+		t = end
+		if !wait(clock, t, stop) {
+			return nil
+		}
+	}
+}
+
+// wait waits until the clock reaches the specified time and returns false if it is stopped first
+func wait(clock Clock, t time.Time, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	case <-clock.After(t.Sub(clock.Now())):
+		return true
+	}
+}
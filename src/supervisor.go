@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Supervisor states
+const (
+	SourceStarting = "starting" // Starting the pulse source
+	SourceRunning  = "running"  // Pulse source is running
+	SourceBackoff  = "backoff"  // Waiting to restart the pulse source after it ended
+	SourceFailed   = "failed"   // Pulse source keeps failing, but restarts are still attempted
+	SourceFinished = "finished" // Pulse source has no more pulses, e.g. a replay has ended
+	SourceStopped  = "stopped"  // Not supervising the pulse source
+)
+
+const (
+	sourceMinBackoff = time.Second     // Delay before the first restart
+	sourceMaxBackoff = 5 * time.Minute // Maximum delay between restarts
+	sourceStableTime = time.Minute     // Run time after which the pulse source is considered stable
+	sourceFailLimit  = 5               // Consecutive failures after which the pulse source is marked as failed
+	sourceStderrSize = 20              // Number of stderr lines kept for the status
+)
+
+// Supervisor runs the pulse source and restarts it, with an exponential backoff, when it ends
+type Supervisor struct {
+	Srv       *Server       // Server instance
+	Source    Source        // Produces the pulses. Created from the configuration if not set.
+	state     string        // Supervisor state
+	started   time.Time     // Time the pulse source was last started
+	restarts  int           // Number of times the pulse source has been restarted
+	failures  int           // Number of consecutive failures
+	lastExit  time.Time     // Time the pulse source last ended
+	lastError string        // Reason the pulse source last ended
+	stderr    []string      // Last lines written to stderr
+	restart   chan struct{} // Signals the pulse source must be restarted
+	stop      chan struct{} // Closed to stop supervising
+	done      chan struct{} // Closed when supervising has stopped
+	mu        sync.Mutex
+}
+
+// SupervisorStatus holds the state of the pulse source
+type SupervisorStatus struct {
+	State     string    `json:"state"`               // Supervisor state
+	Running   bool      `json:"running"`             // Signals that the pulse source is running
+	Started   time.Time `json:"started"`             // Time the pulse source was last started
+	Restarts  int       `json:"restarts"`            // Number of times the pulse source has been restarted
+	Failures  int       `json:"failures"`            // Number of consecutive failures
+	LastExit  time.Time `json:"lastExit"`            // Time the pulse source last ended
+	LastError string    `json:"lastError,omitempty"` // Reason the pulse source last ended
+	Stderr    []string  `json:"stderr,omitempty"`    // Last lines written to stderr
+}
+
+// Start starts the pulse source and supervises it until Stop is called
+func (s *Supervisor) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done != nil {
+		return
+	}
+	s.state = SourceStarting
+	s.restart = make(chan struct{}, 1)
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(s.stop, s.done)
+}
+
+// Stop stops the pulse source and waits for it to end
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mu.Unlock()
+	if done == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// Restart stops the pulse source and starts it again immediately,
+// for example to pick up a new sensor pin
+func (s *Supervisor) Restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done == nil {
+		return
+	}
+	select {
+	case s.restart <- struct{}{}:
+	default:
+	}
+}
+
+// GetStatus returns the state of the pulse source
+func (s *Supervisor) GetStatus() SupervisorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := SupervisorStatus{
+		State:     s.state,
+		Running:   s.state == SourceRunning,
+		Started:   s.started,
+		Restarts:  s.restarts,
+		Failures:  s.failures,
+		LastExit:  s.lastExit,
+		LastError: s.lastError,
+		Stderr:    append([]string(nil), s.stderr...),
+	}
+	if st.State == "" {
+		st.State = SourceStopped
+	}
+	return st
+}
+
+// restamp moves the start and exit times onto the clock corrected by the step
+func (s *Supervisor) restamp(now time.Time, step time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = shiftWall(s.started, now, step)
+	s.lastExit = shiftWall(s.lastExit, now, step)
+}
+
+// run starts the pulse source, waits for it to end and restarts it
+func (s *Supervisor) run(stop, done chan struct{}) {
+	defer close(done)
+	backoff := sourceMinBackoff
+	for {
+		start := time.Now()
+		err := s.runOnce(stop)
+
+		select {
+		case <-stop:
+			s.setState(SourceStopped)
+			s.logInfo("Pulse source stopped")
+			return
+		default:
+		}
+
+		if err == errSourceDone {
+			// Wait for the pulse source to be changed
+			s.mu.Lock()
+			s.lastExit = s.Srv.Now()
+			s.lastError = ""
+			s.state = SourceFinished
+			s.mu.Unlock()
+			s.logInfo("Pulse source has no more pulses")
+			select {
+			case <-stop:
+				s.setState(SourceStopped)
+				s.logInfo("Pulse source stopped")
+				return
+			case <-s.restart:
+				backoff = sourceMinBackoff
+				continue
+			}
+		}
+
+		restart := false
+		select {
+		case <-s.restart:
+			restart = true
+		default:
+		}
+
+		s.mu.Lock()
+		s.lastExit = s.Srv.Now()
+		if err != nil {
+			s.lastError = err.Error()
+		} else {
+			s.lastError = "ended"
+		}
+		if restart || time.Since(start) >= sourceStableTime {
+			// The pulse source ran long enough, so this is not a repeated failure
+			s.failures = 0
+			backoff = sourceMinBackoff
+		}
+		if !restart {
+			s.failures++
+		}
+		failures := s.failures
+		s.mu.Unlock()
+
+		if restart {
+			s.logInfo("Restarting pulse source")
+			backoff = 0
+		} else {
+			s.logError("Pulse source has ended. ", s.GetStatus().LastError, ". Restarting in ", backoff)
+			if failures == sourceFailLimit {
+				s.logError("Pulse source has failed ", failures, " times in a row")
+				s.Srv.Events.Publish(EventAlert, AlertEvent{
+					Source:  "Power",
+					Message: fmt.Sprintf("Pulse source keeps failing. %s", s.GetStatus().LastError),
+				})
+			}
+		}
+		if failures >= sourceFailLimit {
+			s.setState(SourceFailed)
+		} else {
+			s.setState(SourceBackoff)
+		}
+
+		select {
+		case <-stop:
+			s.setState(SourceStopped)
+			s.logInfo("Pulse source stopped")
+			return
+		case <-s.restart:
+		case <-time.After(backoff):
+		}
+		if backoff == 0 {
+			backoff = sourceMinBackoff
+		} else if backoff = backoff * 2; backoff > sourceMaxBackoff {
+			backoff = sourceMaxBackoff
+		}
+
+		s.mu.Lock()
+		s.restarts++
+		s.mu.Unlock()
+	}
+}
+
+// runOnce runs the pulse source until it ends, or is stopped or restarted
+func (s *Supervisor) runOnce(stop chan struct{}) error {
+	src := s.Source
+	if src == nil {
+		src = newSource(s.Srv.GetConfig())
+	}
+	s.logInfo("Starting ", src.Name(), " pulse source")
+	s.Srv.Power.resetSensor()
+	s.mu.Lock()
+	s.state = SourceRunning
+	s.started = s.Srv.Now()
+	s.mu.Unlock()
+
+	end := make(chan struct{})
+	ended := make(chan error, 1)
+	go func() {
+		ended <- src.Run(s, end)
+	}()
+
+	select {
+	case err := <-ended:
+		return err
+	case <-stop:
+	case <-s.restart:
+		// Put the signal back, so that the pulse source is restarted without a delay
+		select {
+		case s.restart <- struct{}{}:
+		default:
+		}
+	}
+	close(end)
+	return <-ended
+}
+
+// addStderr logs a line the pulse source wrote to stderr and keeps it for the status
+func (s *Supervisor) addStderr(l string) {
+	logs.Warning("Supervisor", "Pulse source: ", l)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stderr = append(s.stderr, l)
+	if len(s.stderr) > sourceStderrSize {
+		s.stderr = s.stderr[len(s.stderr)-sourceStderrSize:]
+	}
+}
+
+// setState sets the supervisor state
+func (s *Supervisor) setState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+// logInfo logs an information message to the logger
+func (s *Supervisor) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("Supervisor", a)
+}
+
+// logError logs an error message to the logger
+func (s *Supervisor) logError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("Supervisor", a)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Files holding the self-signed certificate generated when no certificate is configured
+const (
+	selfSignedCertFile = "selfsigned.crt"
+	selfSignedKeyFile  = "selfsigned.key"
+)
+
+// loadCertificate loads the configured certificate or, if none is configured, the
+// self-signed certificate. The self-signed certificate is generated on the first run
+// and again when it is about to expire. It also returns whether it is self-signed.
+func loadCertificate(c *Config) (tls.Certificate, bool, error) {
+	if c.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		return cert, false, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(selfSignedCertFile, selfSignedKeyFile)
+	if err == nil {
+		if x, perr := x509.ParseCertificate(cert.Certificate[0]); perr != nil || time.Until(x.NotAfter) < 30*24*time.Hour {
+			err = errors.New("certificate has expired")
+		}
+	}
+	if err != nil {
+		if err := generateCertificate(selfSignedCertFile, selfSignedKeyFile); err != nil {
+			return cert, true, err
+		}
+		cert, err = tls.LoadX509KeyPair(selfSignedCertFile, selfSignedKeyFile)
+	}
+	return cert, true, err
+}
+
+// generateCertificate generates a self-signed certificate for the host name and
+// the local IP addresses and writes it and its private key to the files
+func generateCertificate(certPath string, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: []string{"PowerMonitor"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	if host != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host, host+".local")
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ipn.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// certFingerprint returns the SHA-256 fingerprint of the certificate, in the form
+// shown by browsers and openssl x509 -fingerprint -sha256
+func certFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	h := sha256.Sum256(cert.Certificate[0])
+	l := make([]string, len(h))
+	for i, b := range h {
+		l[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(l, ":")
+}
+
+// redirectHandler creates a handler that redirects HTTP requests to the HTTPS port
+func redirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+			// IPv6 address
+			host = "[" + host + "]"
+		}
+		u := fmt.Sprintf("https://%s:%d%s", host, port, r.URL.RequestURI())
+		http.Redirect(w, r, u, http.StatusPermanentRedirect)
+	})
+}
@@ -1,48 +1,186 @@
-package main
-
-import (
-	"fmt"
-	"time"
-)
-
-// Uploader uploads the room telemetry to the various destinations
-type Uploader struct {
-	Srv               *Server   // Current Server
-	MqttClient        *Mqtt     // MQTT client
-	LastUpdateAttempt time.Time // Last time an update was attempted
-	LastUpdate        time.Time // Last time the update was run
-	lastValues        *Power    // Last values uploaded for Room
-}
-
-// Run is called from the scheduler (ClockWerk). This function will get the latest measurements
-// and send the measurements to Thingspeak
-func (u *Uploader) Run() {
-	if u.MqttClient == nil {
-		u.MqttClient = &Mqtt{}
-		u.MqttClient.Srv = u.Srv
-		u.MqttClient.Initialize()
-	}
-
-	if err := u.MqttClient.SendTelemetry(); err != nil {
-		u.logError("Error sending telemetry to MQTT")
-	}
-}
-
-// Close shuts down the Uploader
-func (u *Uploader) Close() {
-	if u.MqttClient != nil {
-		u.MqttClient.Close()
-	}
-}
-
-// logInfo logs an information message to the logger
-func (u *Uploader) logInfo(v ...interface{}) {
-	a := fmt.Sprint(v...)
-	logger.Info("Uploader: [Inf] ", a)
-}
-
-// logError logs an error message to the logger
-func (u *Uploader) logError(v ...interface{}) {
-	a := fmt.Sprint(v...)
-	logger.Error("Uploader [Err] ", a)
-}
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Uploader uploads the room telemetry to the various destinations
+type Uploader struct {
+	Srv               *Server               // Current Server
+	MqttClient        *Mqtt                 // MQTT client
+	Emoncms           *Emoncms              // emoncms client
+	PVOutput          *PVOutput             // PVOutput client
+	LastUpdateAttempt time.Time             // Last time an update was attempted
+	LastUpdate        time.Time             // Last time the update was run
+	lastValues        *Power                // Last values uploaded for Room
+	status            map[string]SinkStatus // Upload status of each destination
+	lastRun           time.Time             // Last time a run completed
+	mu                sync.Mutex
+	statusMu          sync.Mutex // Lock for the status, which is read while an upload runs
+}
+
+// SinkStatus holds the result of the uploads to a destination
+type SinkStatus struct {
+	Enabled     bool      `json:"enabled"`             // Signals that the destination is enabled
+	Connected   *bool     `json:"connected,omitempty"` // Signals that the client is connected (MQTT only)
+	LastAttempt time.Time `json:"lastAttempt"`         // Last time an upload was attempted
+	LastSuccess time.Time `json:"lastSuccess"`         // Last time an upload succeeded
+	LastError   string    `json:"lastError,omitempty"` // Error of the last upload, if it failed
+}
+
+// Run is called from the scheduler (ClockWerk). This function will get the latest measurements
+// and send the measurements to Thingspeak
+func (u *Uploader) Run() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.MqttClient == nil {
+		u.MqttClient = &Mqtt{}
+		u.MqttClient.Srv = u.Srv
+		u.MqttClient.Initialize()
+	}
+
+	err := u.MqttClient.SendTelemetry()
+	if err != nil {
+		u.logError("Error sending telemetry to MQTT")
+	}
+	u.setStatus("mqtt", u.MqttClient.enabled, err)
+
+	if u.Emoncms == nil {
+		u.Emoncms = &Emoncms{}
+		u.Emoncms.Srv = u.Srv
+		u.Emoncms.Initialize()
+	}
+
+	err = u.Emoncms.SendTelemetry()
+	if err != nil {
+		u.logError("Error sending telemetry to emoncms")
+	}
+	u.setStatus("emoncms", u.Emoncms.enabled, err)
+
+	if u.PVOutput == nil {
+		u.PVOutput = &PVOutput{}
+		u.PVOutput.Srv = u.Srv
+		u.PVOutput.Initialize()
+	}
+
+	err = u.PVOutput.SendTelemetry()
+	if err != nil {
+		u.logError("Error sending telemetry to PVOutput")
+	}
+	u.setStatus("pvoutput", u.PVOutput.enabled, err)
+
+	// Save the balance in case the service stops unexpectedly
+	if err := u.Srv.Power.SaveCurrentPower("power.dat"); err != nil {
+		u.logError("Error saving current power.", err.Error())
+	}
+	if err := u.Srv.History.WriteToFile("history.json", u.Srv.Now()); err != nil {
+		u.logError("Error saving history.", err.Error())
+	}
+
+	u.statusMu.Lock()
+	u.lastRun = u.Srv.Now()
+	u.statusMu.Unlock()
+}
+
+// LastRun returns the last time a run completed
+func (u *Uploader) LastRun() time.Time {
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	return u.lastRun
+}
+
+// Close shuts down the Uploader
+func (u *Uploader) Close() {
+	if u.MqttClient != nil {
+		u.MqttClient.Close()
+	}
+	u.setConnected("mqtt", false)
+}
+
+// setStatus records the result of an upload to the destination
+func (u *Uploader) setStatus(name string, enabled bool, err error) {
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	if u.status == nil {
+		u.status = map[string]SinkStatus{}
+	}
+	st := u.status[name]
+	st.Enabled = enabled
+	if enabled {
+		st.LastAttempt = u.Srv.Now()
+		if err != nil {
+			st.LastError = err.Error()
+		} else {
+			st.LastError = ""
+			st.LastSuccess = st.LastAttempt
+		}
+	}
+	u.status[name] = st
+}
+
+// setConnected records whether the client of the destination is connected
+func (u *Uploader) setConnected(name string, connected bool) {
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	if u.status == nil {
+		u.status = map[string]SinkStatus{}
+	}
+	st := u.status[name]
+	st.Connected = &connected
+	u.status[name] = st
+}
+
+// GetStatus returns the upload status of each destination
+func (u *Uploader) GetStatus() map[string]SinkStatus {
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	m := map[string]SinkStatus{}
+	for k, v := range u.status {
+		m[k] = v
+	}
+	return m
+}
+
+// Reset closes the specified clients ("mqtt", "emoncms" or "pvoutput") so that
+// they are initialized with the current configuration on the next run.
+// All the clients are reset if none are specified.
+func (u *Uploader) Reset(clients ...string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	all := len(clients) == 0
+	for _, c := range clients {
+		switch c {
+		case "mqtt":
+			if u.MqttClient != nil {
+				u.MqttClient.Close()
+				u.MqttClient = nil
+			}
+			u.setConnected("mqtt", false)
+		case "emoncms":
+			u.Emoncms = nil
+		case "pvoutput":
+			u.PVOutput = nil
+		}
+	}
+	if all {
+		u.Close()
+		u.MqttClient = nil
+		u.Emoncms = nil
+		u.PVOutput = nil
+	}
+}
+
+// logInfo logs an information message to the logger
+func (u *Uploader) logInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("Uploader", a)
+}
+
+// logError logs an error message to the logger
+func (u *Uploader) logError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("Uploader", a)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Channels a WebSocket client can subscribe to
+const (
+	wsChannelReport = "report" // PowerReport deltas
+)
+
+// WsController handles the WebSocket API used for live data and commands
+type WsController struct {
+	Srv      *Server
+	upgrader websocket.Upgrader
+}
+
+// wsCommand is a command sent by a WebSocket client
+type wsCommand struct {
+	ID       string   `json:"id"`       // Request ID, returned with the response
+	Cmd      string   `json:"cmd"`      // Command name
+	Units    float64  `json:"units"`    // Units for the topup and reading commands
+	Channels []string `json:"channels"` // Channels for the subscribe and unsubscribe commands
+}
+
+// wsMessage is a message sent to a WebSocket client
+type wsMessage struct {
+	Type    string      `json:"type"`              // Message type (response, report or event)
+	ID      string      `json:"id,omitempty"`      // Request ID of the command being responded to
+	Channel string      `json:"channel,omitempty"` // Channel of the event
+	OK      *bool       `json:"ok,omitempty"`      // Signals that the command succeeded
+	Error   string      `json:"error,omitempty"`   // Error message if the command failed
+	Data    interface{} `json:"data,omitempty"`    // Message payload
+}
+
+// wsClient holds the state of a connected WebSocket client
+type wsClient struct {
+	conn       *websocket.Conn
+	send       chan wsMessage         // Messages waiting to be written
+	closed     chan struct{}          // Closed when the write loop ends
+	channels   map[string]bool        // Subscribed channels
+	lastReport map[string]interface{} // Last report sent, used to calculate deltas
+	role       string                 // Role granted to the client when it connected
+	mu         sync.Mutex
+}
+
+// AddController adds the controller routes to the router
+func (c *WsController) AddController(router *mux.Router, s *Server) {
+	c.Srv = s
+	router.Methods("GET").Path("/ws").Name("WebSocket").
+		Handler(Logger(c, Authorize(s, RoleRead, http.HandlerFunc(c.handleWs))))
+}
+
+// handleWs upgrades the connection to a WebSocket and serves the client
+func (c *WsController) handleWs(w http.ResponseWriter, r *http.Request) {
+	conn, err := c.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		c.LogError("Error upgrading connection.", err.Error())
+		return
+	}
+
+	cl := &wsClient{
+		conn:     conn,
+		send:     make(chan wsMessage, 32),
+		closed:   make(chan struct{}),
+		channels: map[string]bool{wsChannelReport: true},
+		role:     RequestRole(r),
+	}
+
+	ch := c.Srv.Events.Subscribe()
+	done := make(chan struct{})
+	go c.writeLoop(cl, ch, done)
+
+	c.readLoop(cl)
+	close(done)
+	c.Srv.Events.Unsubscribe(ch)
+}
+
+// readLoop reads and executes the commands sent by the client until the connection closes
+func (c *WsController) readLoop(cl *wsClient) {
+	cl.conn.SetReadLimit(4096)
+	cl.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	cl.conn.SetPongHandler(func(string) error {
+		return cl.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	})
+	for {
+		cmd := wsCommand{}
+		if err := cl.conn.ReadJSON(&cmd); err != nil {
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+				err = fmt.Errorf("invalid command. %s", err.Error())
+				if !cl.write(c.response(cmd.ID, nil, err)) {
+					return
+				}
+				continue
+			}
+			return
+		}
+		data, err := c.execute(cl, cmd)
+		if !cl.write(c.response(cmd.ID, data, err)) {
+			return
+		}
+	}
+}
+
+// writeLoop writes the responses and subscribed events to the client.
+// All writes to the connection are done from here.
+func (c *WsController) writeLoop(cl *wsClient, ch chan Event, done chan struct{}) {
+	ping := time.NewTicker(30 * time.Second)
+	defer func() {
+		ping.Stop()
+		cl.conn.Close()
+		close(cl.closed)
+	}()
+
+	// Send the full report to start with
+	cl.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := cl.conn.WriteJSON(wsMessage{Type: wsChannelReport, Data: c.reportDelta(cl)}); err != nil {
+		return
+	}
+
+	for {
+		var m wsMessage
+		select {
+		case <-done:
+			return
+		case <-ping.C:
+			cl.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := cl.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+			continue
+		case m = <-cl.send:
+		case e, ok := <-ch:
+			if !ok {
+				// Service is shutting down
+				cl.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"))
+				return
+			}
+			if cl.isSubscribed(e.Type) {
+				m = wsMessage{Type: "event", Channel: e.Type, Data: e.Data}
+			} else if cl.isSubscribed(wsChannelReport) && (e.Type == EventBalance || e.Type == EventTopUp) {
+				d := c.reportDelta(cl)
+				if len(d) == 0 {
+					continue
+				}
+				m = wsMessage{Type: wsChannelReport, Data: d}
+			} else {
+				continue
+			}
+		}
+		cl.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := cl.conn.WriteJSON(m); err != nil {
+			return
+		}
+	}
+}
+
+// execute executes the command and returns the response data
+func (c *WsController) execute(cl *wsClient, cmd wsCommand) (interface{}, error) {
+	switch cmd.Cmd {
+	case "topup", "reading", "publish":
+		if !roleAllows(cl.role, RoleAdmin) {
+			return nil, fmt.Errorf("the '%s' command requires the %s role", cmd.Cmd, RoleAdmin)
+		}
+	}
+	switch cmd.Cmd {
+	case "get":
+		return c.Srv.Power.GetPowerReport(), nil
+	case "topup":
+		if cmd.Units <= 0 {
+			return nil, errors.New("units must be greater than zero")
+		}
+		c.Srv.Power.TopUp(cmd.Units)
+		c.saveCurrentPower()
+		return c.Srv.Power.GetPowerReport(), nil
+	case "reading":
+		if cmd.Units < 0 {
+			return nil, errors.New("units cannot be negative")
+		}
+		c.Srv.Power.SetReading(cmd.Units)
+		c.saveCurrentPower()
+		return c.Srv.Power.GetPowerReport(), nil
+	case "publish":
+		go c.Srv.Uploader.Run()
+		return nil, nil
+	case "subscribe", "unsubscribe":
+		for _, n := range cmd.Channels {
+			switch n {
+			case wsChannelReport, EventPulse, EventBalance, EventTopUp, EventAlert:
+			default:
+				return nil, fmt.Errorf("unknown channel '%s'", n)
+			}
+		}
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		for _, n := range cmd.Channels {
+			if cmd.Cmd == "subscribe" {
+				cl.channels[n] = true
+			} else {
+				delete(cl.channels, n)
+			}
+		}
+		l := []string{}
+		for n := range cl.channels {
+			l = append(l, n)
+		}
+		sort.Strings(l)
+		return l, nil
+	default:
+		return nil, fmt.Errorf("unknown command '%s'", cmd.Cmd)
+	}
+}
+
+// write queues the message to be written to the client.
+// It returns false if the connection has been closed.
+func (cl *wsClient) write(m wsMessage) bool {
+	select {
+	case cl.send <- m:
+		return true
+	case <-cl.closed:
+		return false
+	}
+}
+
+// isSubscribed returns whether the client is subscribed to the channel
+func (cl *wsClient) isSubscribed(n string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.channels[n]
+}
+
+// response creates the response message for a command
+func (c *WsController) response(id string, data interface{}, err error) wsMessage {
+	ok := err == nil
+	m := wsMessage{Type: "response", ID: id, OK: &ok, Data: data}
+	if err != nil {
+		m.Error = err.Error()
+	}
+	return m
+}
+
+// reportDelta returns the PowerReport fields that have changed since the
+// last report was sent to the client
+func (c *WsController) reportDelta(cl *wsClient) map[string]interface{} {
+	rep := c.Srv.Power.GetPowerReport()
+	b, err := json.Marshal(rep)
+	if err != nil {
+		c.LogError("Error serializing power.", err.Error())
+		return nil
+	}
+	cur := map[string]interface{}{}
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return nil
+	}
+	d := map[string]interface{}{}
+	for k, v := range cur {
+		if lv, ok := cl.lastReport[k]; !ok || !reflect.DeepEqual(lv, v) {
+			d[k] = v
+		}
+	}
+	cl.lastReport = cur
+	return d
+}
+
+// saveCurrentPower saves the balance after it has been changed
+func (c *WsController) saveCurrentPower() {
+	if err := c.Srv.Power.SaveCurrentPower("power.dat"); err != nil {
+		c.LogError("Error saving current power.", err.Error())
+	}
+}
+
+// LogInfo is used to log information messages for this controller.
+func (c *WsController) LogInfo(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Info("WsController", a)
+}
+
+// LogError is used to log error messages for this controller.
+func (c *WsController) LogError(v ...interface{}) {
+	a := fmt.Sprint(v...)
+	logs.Error("WsController", a)
+}